@@ -2,11 +2,15 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/extract"
 	"github.com/michelangelomo/ephimail/internal/redis"
 	"github.com/michelangelomo/ephimail/server"
 
@@ -31,6 +35,12 @@ func main() {
 		Name:  "ephimail",
 		Usage: "all-in-one disposable email service",
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "role",
+				Value:   "all",
+				EnvVars: []string{"ROLE"},
+				Usage:   "Servers to run: all, web or smtp, so that each tier can be scaled separately",
+			},
 			&cli.StringFlag{
 				Name:        "redis-address",
 				Value:       "127.0.0.1",
@@ -63,12 +73,25 @@ func main() {
 			},
 			&cli.StringSliceFlag{
 				Name:        "allow-domain",
-				Required:    true,
 				EnvVars:     []string{"ALLOWED_DOMAINS"},
-				Usage:       "Allowed recipient domains list (comma-separated)",
+				Usage:       "Allowed recipient domains list (comma-separated, required)",
 				Category:    "Mail server",
 				Destination: &mail.AllowedDomains,
 			},
+			&cli.StringSliceFlag{
+				Name:        "domain-mode",
+				EnvVars:     []string{"DOMAIN_MODES"},
+				Usage:       "Per-domain recipient mode as domain=mode, where mode is open or reserved-only (comma-separated)",
+				Category:    "Mail server",
+				Destination: &mail.DomainModes,
+			},
+			&cli.GenericFlag{
+				Name:     "extractor",
+				EnvVars:  []string{"EXTRACTORS"},
+				Value:    &extractorsFlag{},
+				Usage:    "Custom code extractor as name=regex, the code being the first group or the whole match (repeatable, newline-separated)",
+				Category: "Mail server",
+			},
 			&cli.StringFlag{
 				Name:        "web-address",
 				Value:       "127.0.0.1",
@@ -85,6 +108,13 @@ func main() {
 				Category:    "Web server",
 				Destination: &web.Port,
 			},
+			&cli.StringFlag{
+				Name:        "admin-token",
+				EnvVars:     []string{"ADMIN_TOKEN"},
+				Usage:       "Token granting access to domain and global webhooks (disabled if empty)",
+				Category:    "Web server",
+				Destination: &web.AdminToken,
+			},
 			&cli.IntFlag{
 				Name:     "email-ttl",
 				Value:    24,
@@ -92,43 +122,165 @@ func main() {
 				Usage:    "Email time-to-live in hours (0 for no expiration)",
 				Category: "Storage",
 			},
+			&cli.BoolFlag{
+				Name:        "enable-reservations",
+				EnvVars:     []string{"ENABLE_RESERVATIONS"},
+				Usage:       "Allow mailboxes to be reserved, encrypted and transferred",
+				Category:    "Web server",
+				Destination: &web.EnableReservations,
+			},
 			&cli.IntFlag{
-				Name:     "max-reservation-days",
-				Value:    7,
-				EnvVars:  []string{"MAX_RESERVATION_DAYS"},
-				Usage:    "Maximum reservation time in days",
-				Category: "Web server",
+				Name:        "max-reservation-days",
+				Value:       7,
+				EnvVars:     []string{"MAX_RESERVATION_DAYS"},
+				Usage:       "Maximum reservation time in days",
+				Category:    "Web server",
+				Destination: &web.MaxReservationDays,
+			},
+			&cli.StringFlag{
+				Name:     "search-backend",
+				Value:    server.SearchBackendRedis,
+				EnvVars:  []string{"SEARCH_BACKEND"},
+				Usage:    "Full-text search index: redis, memory (single instance with role all) or none",
+				Category: "Storage",
+			},
+			&cli.StringFlag{
+				Name:     "master-key",
+				EnvVars:  []string{"MASTER_KEY"},
+				Usage:    "Base64 encoded 32 bytes master key encrypting stored mail at rest",
+				Category: "Storage",
+			},
+			&cli.StringFlag{
+				Name:     "master-key-file",
+				EnvVars:  []string{"MASTER_KEY_FILE"},
+				Usage:    "File containing the master key, alternative to --master-key",
+				Category: "Storage",
+			},
+			&cli.StringSliceFlag{
+				Name:     "previous-master-key-file",
+				EnvVars:  []string{"PREVIOUS_MASTER_KEY_FILES"},
+				Usage:    "Files containing retired master keys still used to read mail during a rotation (comma-separated)",
+				Category: "Storage",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "rotate-keys",
+				Usage: "re-wrap the data keys of stored mail under the current master key",
+				Description: "Run with the new key as --master-key and the old ones as --previous-master-key-file, " +
+					"after the servers have been restarted with the same configuration.",
+				Action: func(c *cli.Context) error {
+					keyring, err := loadKeyring(c)
+					if err != nil {
+						return err
+					}
+					if keyring == nil {
+						return fmt.Errorf("a master key is required to rotate keys")
+					}
+					storage.Keyring = keyring
+
+					// Connect to redis
+					storage.Connect()
+
+					rewrapped, err := storage.RewrapEmails()
+					log.Printf("rewrapped %d emails under master key %s", rewrapped, keyring.PrimaryID())
+					return err
+				},
+			},
+			{
+				Name:  "migrate-envelopes",
+				Usage: "wrap encrypted mail stored before versioned envelopes in an envelope",
+				Action: func(c *cli.Context) error {
+					keyring, err := loadKeyring(c)
+					if err != nil {
+						return err
+					}
+					storage.Keyring = keyring
+
+					// Connect to redis
+					storage.Connect()
+
+					migrated, err := storage.MigrateEnvelopes()
+					log.Printf("migrated %d emails", migrated)
+					return err
+				},
 			},
 		},
 		Action: func(c *cli.Context) error {
 			var wg sync.WaitGroup
 
+			role := c.String("role")
+			if role != "all" && role != "web" && role != "smtp" {
+				return fmt.Errorf("invalid role %q, allowed values: all, web, smtp", role)
+			}
+
+			// Not marked as required so that commands can run without it
+			if len(mail.AllowedDomains.Value()) == 0 {
+				return fmt.Errorf("required flag \"allow-domain\" not set")
+			}
+
 			// Set email TTL if provided
 			if c.Int("email-ttl") > 0 {
 				storage.EmailTTL = time.Duration(c.Int("email-ttl")) * time.Hour
 			}
 
+			// Parse per-domain recipient modes
+			if err := mail.LoadDomainModes(); err != nil {
+				return err
+			}
+
+			// Encrypt stored mail at rest if a master key is provided
+			keyring, err := loadKeyring(c)
+			if err != nil {
+				return err
+			}
+			storage.Keyring = keyring
+
 			// Connect to redis
 			storage.Connect()
 
 			// Set allowed domains for web server
 			web.SetAllowedDomains(mail.AllowedDomains.Value())
 
+			// Find codes and links in stored mail, with the custom extractors
+			mail.Extractors = extract.NewPipeline(c.Generic("extractor").(*extractorsFlag).extractors...)
+			web.Extractors = mail.Extractors
+
+			// Index stored mail for search, an index kept in memory is only
+			// shared by servers running in the same process
+			if c.String("search-backend") == server.SearchBackendMemory && role != "all" {
+				return fmt.Errorf("search backend %s requires role all", server.SearchBackendMemory)
+			}
+			index, err := server.NewSearchIndex(c.String("search-backend"), storage)
+			if err != nil {
+				return err
+			}
+			web.Search = index
+			mail.Search = index
+
 			// Start web server with WebSocket support
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				if err := web.Run(); err != nil {
-					log.Fatal(err)
-				}
-			}()
-
-			// Start mail server with WebSocket support
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				mail.Run()
-			}()
+			if role == "all" || role == "web" {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := web.Run(); err != nil {
+						log.Fatal(err)
+					}
+				}()
+			}
+
+			// Start mail server, events reach the web servers through redis
+			if role == "all" || role == "smtp" {
+				// Deliver webhooks of stored messages
+				mail.Webhooks = server.NewWebhookDispatcher(storage)
+				go mail.Webhooks.Run()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					mail.Run()
+				}()
+			}
 
 			wg.Wait()
 			return nil
@@ -139,3 +291,67 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// loadKeyring builds the master keyring from the command line, it returns nil
+// if no master key is configured
+func loadKeyring(c *cli.Context) (*encryption.Keyring, error) {
+	var primary []byte
+	switch {
+	case c.String("master-key") != "":
+		primary = []byte(c.String("master-key"))
+	case c.String("master-key-file") != "":
+		data, err := os.ReadFile(c.String("master-key-file"))
+		if err != nil {
+			return nil, fmt.Errorf("can't read master key: %w", err)
+		}
+		primary = data
+	default:
+		return nil, nil
+	}
+
+	primaryKey, err := encryption.ParseMasterKey(primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var previousKeys [][]byte
+	for _, path := range c.StringSlice("previous-master-key-file") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read previous master key: %w", err)
+		}
+		key, err := encryption.ParseMasterKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous master key %s: %w", path, err)
+		}
+		previousKeys = append(previousKeys, key)
+	}
+
+	return encryption.NewKeyring(primaryKey, previousKeys...)
+}
+
+// extractorsFlag holds the custom extractors of the command line. Unlike
+// slice flags, values are not split on commas, which regexes may contain.
+type extractorsFlag struct {
+	definitions []string
+	extractors  []extract.Extractor
+}
+
+func (f *extractorsFlag) Set(value string) error {
+	for _, definition := range strings.Split(value, "\n") {
+		if strings.TrimSpace(definition) == "" {
+			continue
+		}
+		extractor, err := extract.ParseRegexExtractor(definition)
+		if err != nil {
+			return err
+		}
+		f.definitions = append(f.definitions, definition)
+		f.extractors = append(f.extractors, extractor)
+	}
+	return nil
+}
+
+func (f *extractorsFlag) String() string {
+	return strings.Join(f.definitions, "\n")
+}
@@ -0,0 +1,109 @@
+// Prefix of the sessionStorage keys holding the credentials of a mailbox
+const STORAGE_PREFIX = 'ephimail:credentials:';
+
+export default class AuthService {
+    /**
+     * Get the credentials stored for a mailbox
+     * @param {string} email - The email address of the mailbox
+     * @returns {{ownerToken?: string, expires?: string, sig?: string}} The credentials
+     */
+    static getCredentials(email) {
+      try {
+        return JSON.parse(sessionStorage.getItem(STORAGE_PREFIX + email)) || {};
+      } catch (error) {
+        return {};
+      }
+    }
+
+    /**
+     * Store the owner token returned when reserving or transferring a mailbox
+     * @param {string} email - The email address of the mailbox
+     * @param {string} ownerToken - The owner token
+     */
+    static setOwnerToken(email, ownerToken) {
+      this._setCredentials(email, { ...this.getCredentials(email), ownerToken });
+    }
+
+    /**
+     * Get the owner token of a mailbox
+     * @param {string} email - The email address of the mailbox
+     * @returns {string|null} The owner token or null if not known
+     */
+    static getOwnerToken(email) {
+      return this.getCredentials(email).ownerToken || null;
+    }
+
+    /**
+     * Store the expires and sig parameters of a signed mailbox link
+     * @param {string} email - The email address of the mailbox
+     * @param {string} link - The signed link
+     */
+    static setSignedLink(email, link) {
+      const params = new URL(link, window.location.origin).searchParams;
+      if (params.get('expires') && params.get('sig')) {
+        this._setCredentials(email, {
+          ...this.getCredentials(email),
+          expires: params.get('expires'),
+          sig: params.get('sig')
+        });
+      }
+    }
+
+    /**
+     * Store the signed link the page was opened with, if any. Its parameters
+     * are either in the query or in the query of the hash route.
+     * @param {string} email - The email address of the mailbox
+     */
+    static captureSignedLink(email) {
+      const url = new URL(window.location);
+      const hashParams = new URLSearchParams(url.hash.substring(1).split('?')[1] || '');
+      for (const params of [url.searchParams, hashParams]) {
+        if (params.get('expires') && params.get('sig')) {
+          this.setSignedLink(email, `?expires=${params.get('expires')}&sig=${params.get('sig')}`);
+          return;
+        }
+      }
+    }
+
+    /**
+     * Forget the credentials of a mailbox
+     * @param {string} email - The email address of the mailbox
+     */
+    static clear(email) {
+      sessionStorage.removeItem(STORAGE_PREFIX + email);
+    }
+
+    /**
+     * Get the headers authorizing a request to a mailbox
+     * @param {string} email - The email address of the mailbox
+     * @returns {object} The Authorization header if the owner token is known
+     */
+    static authHeaders(email) {
+      const ownerToken = this.getOwnerToken(email);
+      return ownerToken ? { Authorization: `Bearer ${ownerToken}` } : {};
+    }
+
+    /**
+     * Add the signed link parameters of a mailbox to a URL, for the requests
+     * that can't send headers such as iframes
+     * @param {string} url - The URL of the request
+     * @param {string} email - The email address of the mailbox
+     * @returns {string} The URL with the signed link parameters if known
+     */
+    static authorizeUrl(url, email) {
+      const { expires, sig } = this.getCredentials(email);
+      if (!expires || !sig) {
+        return url;
+      }
+      const separator = url.includes('?') ? '&' : '?';
+      return `${url}${separator}expires=${encodeURIComponent(expires)}&sig=${encodeURIComponent(sig)}`;
+    }
+
+    /**
+     * Persist the credentials of a mailbox for the browser session
+     * @private
+     */
+    static _setCredentials(email, credentials) {
+      sessionStorage.setItem(STORAGE_PREFIX + email, JSON.stringify(credentials));
+    }
+}
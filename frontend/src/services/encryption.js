@@ -1,3 +1,9 @@
+// HKDF info of X25519 envelopes, see SealX25519 in internal/encryption
+const X25519_INFO = 'ephimail x25519 aes-256-gcm';
+
+// DER prefix of a PKCS#8 X25519 private key, followed by the raw 32 bytes
+const X25519_PKCS8_PREFIX = [0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x6e, 0x04, 0x22, 0x04, 0x20];
+
 export default class EncryptionService {
     /**
      * Generate a new RSA key pair for email encryption
@@ -68,28 +74,126 @@ export default class EncryptionService {
       }
     }
   
+    /**
+     * Import an X25519 private key from base64 string
+     * @param {string} privateKeyBase64 - The base64 encoded PKCS#8 or raw 32 bytes private key
+     * @returns {Promise<CryptoKey>} The imported private key
+     */
+    static async importX25519PrivateKey(privateKeyBase64) {
+      try {
+        let privateKeyBuffer = new Uint8Array(this._base64ToArrayBuffer(privateKeyBase64));
+        if (privateKeyBuffer.length === 32) {
+          privateKeyBuffer = new Uint8Array([...X25519_PKCS8_PREFIX, ...privateKeyBuffer]);
+        }
+
+        return await window.crypto.subtle.importKey(
+          "pkcs8",
+          privateKeyBuffer,
+          { name: "X25519" },
+          false, // not extractable
+          ["deriveBits"] // key usage
+        );
+      } catch (error) {
+        console.error("Error importing private key:", error);
+        throw new Error("Invalid private key");
+      }
+    }
+
+    /**
+     * Decrypt an X25519 envelope: agree on a secret with its ephemeral key,
+     * expand it with HKDF-SHA256 and decrypt the body with AES-256-GCM
+     * @param {Object} envelope - The parsed envelope
+     * @param {string} privateKeyBase64 - Base64 encoded X25519 private key
+     * @returns {Promise<ArrayBuffer>} The decrypted email
+     */
+    static async decryptX25519(envelope, privateKeyBase64) {
+      const privateKey = await this.importX25519PrivateKey(privateKeyBase64);
+      const ephemeralKeyBuffer = this._base64ToArrayBuffer(envelope.epk);
+      const ephemeralKey = await window.crypto.subtle.importKey(
+        "raw",
+        ephemeralKeyBuffer,
+        { name: "X25519" },
+        false,
+        []
+      );
+
+      const sharedSecret = await window.crypto.subtle.deriveBits(
+        { name: "X25519", public: ephemeralKey },
+        privateKey,
+        256
+      );
+      const hkdfKey = await window.crypto.subtle.importKey(
+        "raw",
+        sharedSecret,
+        { name: "HKDF" },
+        false,
+        ["deriveKey"]
+      );
+      const contentKey = await window.crypto.subtle.deriveKey(
+        {
+          name: "HKDF",
+          hash: "SHA-256",
+          salt: ephemeralKeyBuffer,
+          info: new TextEncoder().encode(X25519_INFO),
+        },
+        hkdfKey,
+        { name: "AES-GCM", length: 256 },
+        false,
+        ["decrypt"]
+      );
+
+      return await window.crypto.subtle.decrypt(
+        { name: "AES-GCM", iv: this._base64ToArrayBuffer(envelope.nonce) },
+        contentKey,
+        this._base64ToArrayBuffer(envelope.ct)
+      );
+    }
+
     /**
      * Decrypt an email using the private key
-     * @param {string} encryptedData - Base64 encoded encrypted data
+     * @param {string} encryptedData - JSON envelope, or base64 data stored before envelopes existed
      * @param {string} privateKeyBase64 - Base64 encoded private key
      * @returns {Promise<string>} The decrypted email
      */
     static async decryptEmail(encryptedData, privateKeyBase64) {
       try {
-        // Import the private key
-        const privateKey = await this.importPrivateKey(privateKeyBase64);
-        
-        // Convert base64 encrypted data to ArrayBuffer
-        const encryptedBuffer = this._base64ToArrayBuffer(encryptedData);
-        
-        // Decrypt the data
-        const decryptedBuffer = await window.crypto.subtle.decrypt(
-          {
-            name: "RSA-OAEP",
-          },
-          privateKey,
-          encryptedBuffer
-        );
+        const envelope = this.parseEnvelope(encryptedData);
+
+        let decryptedBuffer;
+        if (envelope && envelope.alg === 'X25519-HKDF-SHA256+A256GCM') {
+          decryptedBuffer = await this.decryptX25519(envelope, privateKeyBase64);
+        } else if (envelope && envelope.alg === 'RSA-OAEP-256+A256GCM') {
+          const privateKey = await this.importPrivateKey(privateKeyBase64);
+          // Unwrap the content key, then decrypt the body with it
+          const contentKeyBuffer = await window.crypto.subtle.decrypt(
+            { name: "RSA-OAEP" },
+            privateKey,
+            this._base64ToArrayBuffer(envelope.ek)
+          );
+          const contentKey = await window.crypto.subtle.importKey(
+            "raw",
+            contentKeyBuffer,
+            { name: "AES-GCM" },
+            false,
+            ["decrypt"]
+          );
+          decryptedBuffer = await window.crypto.subtle.decrypt(
+            { name: "AES-GCM", iv: this._base64ToArrayBuffer(envelope.nonce) },
+            contentKey,
+            this._base64ToArrayBuffer(envelope.ct)
+          );
+        } else if (!envelope || envelope.alg === 'RSA-OAEP-256') {
+          // Body encrypted directly with RSA-OAEP
+          const privateKey = await this.importPrivateKey(privateKeyBase64);
+          const ciphertext = envelope ? envelope.ct : encryptedData;
+          decryptedBuffer = await window.crypto.subtle.decrypt(
+            { name: "RSA-OAEP" },
+            privateKey,
+            this._base64ToArrayBuffer(ciphertext)
+          );
+        } else {
+          throw new Error(`Unsupported algorithm ${envelope.alg}`);
+        }
         
         // Convert ArrayBuffer to string
         const decoder = new TextDecoder();
@@ -99,16 +203,31 @@ export default class EncryptionService {
         throw new Error("Failed to decrypt email. Invalid key or corrupted data.");
       }
     }
+
+    /**
+     * Parse an encrypted email envelope
+     * @param {string} data - The stored email
+     * @returns {Object|null} The envelope or null if the data is not an envelope
+     */
+    static parseEnvelope(data) {
+      if (typeof data !== 'string' || !data.startsWith('{"v":')) {
+        return null;
+      }
+      try {
+        const envelope = JSON.parse(data);
+        return envelope.v === 1 && envelope.alg && envelope.ct ? envelope : null;
+      } catch (error) {
+        return null;
+      }
+    }
   
     /**
-     * Check if a string is base64 encoded (likely encrypted)
+     * Check if a stored email is an encrypted envelope
      * @param {string} data - The data to check
-     * @returns {boolean} True if the data appears to be encrypted
+     * @returns {boolean} True if the data is encrypted
      */
     static isEncrypted(data) {
-      // Basic check for base64 encoding pattern
-      const base64Regex = /^[A-Za-z0-9+/]+={0,2}$/;
-      return base64Regex.test(data);
+      return this.parseEnvelope(data) !== null;
     }
   
     /**
@@ -1,3 +1,5 @@
+import AuthService from './auth';
+
 export default class WebSocketService {
     constructor() {
       this.socket = null;
@@ -5,9 +7,17 @@ export default class WebSocketService {
       this.reconnectAttempts = 0;
       this.maxReconnectAttempts = 5;
       this.reconnectTimeout = null;
+      // Last sequence number seen for each subscribed inbox, sent back on
+      // reconnect so that missed emails are replayed
+      this.cursors = {};
       this.eventListeners = {
         'new_email': [],
         'email_deleted': [],
+        'email_expired': [],
+        'inbox_cleared': [],
+        'reservation_expiring': [],
+        'reservation_deleted': [],
+        'subscription_revoked': [],
         'connect': [],
         'disconnect': [],
         'error': []
@@ -32,11 +42,22 @@ export default class WebSocketService {
         this.connected = true;
         this.reconnectAttempts = 0;
         this._triggerEvent('connect');
+
+        // Resubscribe after a reconnect, replaying what was missed
+        Object.keys(this.cursors).forEach(email => this.subscribeToInbox(email));
       };
   
       this.socket.onmessage = (event) => {
         try {
           const message = JSON.parse(event.data);
+          const payload = message.payload || {};
+          if (payload.seq && payload.email in this.cursors) {
+            this.cursors[payload.email] = Math.max(this.cursors[payload.email] || 0, payload.seq);
+          }
+          // The mailbox changed hands, don't subscribe again on reconnect
+          if (message.type === 'subscription_revoked') {
+            delete this.cursors[payload.email];
+          }
           if (message.type && this.eventListeners[message.type]) {
             this._triggerEvent(message.type, message.payload);
           }
@@ -102,6 +123,18 @@ export default class WebSocketService {
           email: email
         }
       };
+
+      // Reserved mailboxes require the owner token
+      const token = AuthService.getOwnerToken(email);
+      if (token) {
+        message.payload.token = token;
+      }
+
+      if (this.cursors[email]) {
+        message.payload.since = this.cursors[email];
+      } else {
+        this.cursors[email] = 0;
+      }
   
       this.socket.send(JSON.stringify(message));
     }
@@ -115,6 +148,8 @@ export default class WebSocketService {
         return;
       }
   
+      delete this.cursors[email];
+
       const message = {
         type: 'unsubscribe',
         payload: {
@@ -2,6 +2,8 @@
 package encryption
 
 import (
+	"crypto"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -12,12 +14,51 @@ import (
 	"fmt"
 )
 
-// EncryptEmail encrypts an email body using the recipient's public key
-func EncryptEmail(emailBody, publicKeyStr string) (string, error) {
+// Supported public key types
+const (
+	KeyTypeRSA    = "rsa"
+	KeyTypePGP    = "pgp"
+	KeyTypeX25519 = "x25519"
+)
+
+// DetectKeyType validates a public key and returns its type.
+// OpenPGP keys are ASCII armored, RSA and X25519 keys are base64 encoded PEM
+// or DER SPKI, X25519 keys can also be the raw 32 bytes.
+func DetectKeyType(publicKeyStr string) (string, error) {
+	if IsArmoredPGPKey(publicKeyStr) {
+		if _, err := readPGPKey(publicKeyStr); err != nil {
+			return "", err
+		}
+		return KeyTypePGP, nil
+	}
+
+	publicKey, err := parsePublicKey(publicKeyStr)
+	if err != nil {
+		return "", err
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA, nil
+	case *ecdh.PublicKey:
+		if key.Curve() == ecdh.X25519() {
+			return KeyTypeX25519, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+// parsePublicKey parses a base64 encoded PEM, DER or raw X25519 public key
+func parsePublicKey(publicKeyStr string) (crypto.PublicKey, error) {
 	// Decode the public key from base64
 	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKeyStr)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode public key: %w", err)
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+
+	// Raw X25519 key, as exported by WebCrypto in "raw" format
+	if len(publicKeyBytes) == 32 {
+		return ecdh.X25519().NewPublicKey(publicKeyBytes)
 	}
 
 	// Parse the public key
@@ -25,14 +66,67 @@ func EncryptEmail(emailBody, publicKeyStr string) (string, error) {
 	if block == nil {
 		// Try parsing as DER if PEM fails
 		block = &pem.Block{
-			Type:  "RSA PUBLIC KEY",
+			Type:  "PUBLIC KEY",
 			Bytes: publicKeyBytes,
 		}
 	}
 
 	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse public key: %w", err)
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	return publicKey, nil
+}
+
+// EncryptEmail encrypts an email body using the recipient's public key, the
+// scheme depends on the detected key type:
+//   - RSA keys wrap an AES-256-GCM key with RSA-OAEP SHA-256
+//   - X25519 keys agree on an AES-256-GCM key as described by SealX25519
+//   - OpenPGP keys produce a PGP/MIME message
+//
+// RSA and X25519 ciphertexts are returned as a JSON Envelope.
+func EncryptEmail(emailBody, publicKeyStr string) (string, error) {
+	keyType, err := DetectKeyType(publicKeyStr)
+	if err != nil {
+		return "", err
+	}
+
+	switch keyType {
+	case KeyTypePGP:
+		return EncryptPGPMIME(emailBody, publicKeyStr)
+	case KeyTypeX25519:
+		return encryptX25519(emailBody, publicKeyStr)
+	default:
+		return encryptRSA(emailBody, publicKeyStr)
+	}
+}
+
+// encryptX25519 encrypts an email body for an X25519 public key
+func encryptX25519(emailBody, publicKeyStr string) (string, error) {
+	publicKey, err := parsePublicKey(publicKeyStr)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := SealX25519(publicKey.(*ecdh.PublicKey), []byte(emailBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+
+	envelope, err := newX25519Envelope(sealed, publicKeyStr)
+	if err != nil {
+		return "", err
+	}
+	return envelope.String(), nil
+}
+
+// encryptRSA encrypts an email body with a random AES-256-GCM key, wrapped
+// with RSA-OAEP since RSA alone can't encrypt more than a few bytes
+func encryptRSA(emailBody, publicKeyStr string) (string, error) {
+	publicKey, err := parsePublicKey(publicKeyStr)
+	if err != nil {
+		return "", err
 	}
 
 	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
@@ -40,37 +134,36 @@ func EncryptEmail(emailBody, publicKeyStr string) (string, error) {
 		return "", errors.New("public key is not an RSA key")
 	}
 
-	// Encrypt the email body
-	encryptedBytes, err := rsa.EncryptOAEP(
+	// Encrypt the email body with a random key
+	contentKey := make([]byte, 32)
+	if _, err := rand.Read(contentKey); err != nil {
+		return "", fmt.Errorf("failed to generate content key: %w", err)
+	}
+
+	sealed, err := SealAESGCM(contentKey, []byte(emailBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+
+	// Encrypt the content key with the public key
+	encryptedKey, err := rsa.EncryptOAEP(
 		sha256.New(),
 		rand.Reader,
 		rsaPublicKey,
-		[]byte(emailBody),
+		contentKey,
 		nil,
 	)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt email: %w", err)
+		return "", fmt.Errorf("failed to encrypt content key: %w", err)
 	}
 
-	// Encode the encrypted data to base64
-	encryptedStr := base64.StdEncoding.EncodeToString(encryptedBytes)
-	return encryptedStr, nil
-}
-
-// IsEncrypted checks if the text is likely to be encrypted (base64 encoded)
-func IsEncrypted(text string) bool {
-	_, err := base64.StdEncoding.DecodeString(text)
-	return err == nil
-}
-
-// EncryptWithSymmetricKey implements hybrid encryption for larger emails
-func EncryptWithSymmetricKey(emailBody, publicKeyStr string) (string, error) {
-	// For larger emails, we would implement hybrid encryption here:
-	// 1. Generate a random symmetric key
-	// 2. Encrypt the email with the symmetric key
-	// 3. Encrypt the symmetric key with the recipient's public key
-	// 4. Combine the encrypted symmetric key and encrypted email
-
-	// This is a placeholder for the implementation
-	return EncryptEmail(emailBody, publicKeyStr)
+	envelope := &Envelope{
+		Version:      EnvelopeVersion,
+		Algorithm:    AlgRSAOAEPAESGCM,
+		KeyID:        Fingerprint(publicKeyStr),
+		EncryptedKey: base64.StdEncoding.EncodeToString(encryptedKey),
+		Nonce:        base64.StdEncoding.EncodeToString(sealed[:12]),
+		Ciphertext:   base64.StdEncoding.EncodeToString(sealed[12:]),
+	}
+	return envelope.String(), nil
 }
@@ -0,0 +1,144 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+// newRSAKey generates an RSA key and its base64 DER public key
+func newRSAKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, base64.StdEncoding.EncodeToString(der)
+}
+
+// openRSA decrypts an RSA envelope the way mail clients do
+func openRSA(key *rsa.PrivateKey, envelope *Envelope) ([]byte, error) {
+	var fields [3][]byte
+	for i, field := range []string{envelope.EncryptedKey, envelope.Nonce, envelope.Ciphertext} {
+		data, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = data
+	}
+
+	contentKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, fields[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	return OpenAESGCM(contentKey, append(fields[1], fields[2]...))
+}
+
+func TestDetectKeyType(t *testing.T) {
+	_, rsaKey := newRSAKey(t)
+	rsaDER, _ := base64.StdEncoding.DecodeString(rsaKey)
+	rsaPEM := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaDER}))
+
+	x25519Key := newX25519Key(t).PublicKey()
+	x25519DER, err := x509.MarshalPKIXPublicKey(x25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p256Key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256DER, err := x509.MarshalPKIXPublicKey(p256Key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{"rsa der", rsaKey, KeyTypeRSA, false},
+		{"rsa pem", rsaPEM, KeyTypeRSA, false},
+		{"x25519 der", base64.StdEncoding.EncodeToString(x25519DER), KeyTypeX25519, false},
+		{"x25519 raw", base64.StdEncoding.EncodeToString(x25519Key.Bytes()), KeyTypeX25519, false},
+		{"pgp", newPGPKey(t).armored, KeyTypePGP, false},
+		{"p256", base64.StdEncoding.EncodeToString(p256DER), "", true},
+		{"not base64", "not a key!", "", true},
+		{"garbage", base64.StdEncoding.EncodeToString([]byte("not a key")), "", true},
+		{"bad pgp", "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\ngarbage\n-----END PGP PUBLIC KEY BLOCK-----", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectKeyType(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptEmailRSA(t *testing.T) {
+	key, publicKey := newRSAKey(t)
+
+	// Bodies larger than the modulus need the hybrid scheme
+	body := "Subject: hello\r\n\r\n" + strings.Repeat("hello ", 10000)
+	encrypted, err := EncryptEmail(body, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := ParseEnvelope(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Algorithm != AlgRSAOAEPAESGCM || envelope.KeyID != Fingerprint(publicKey) {
+		t.Errorf("got algorithm %s and key %s", envelope.Algorithm, envelope.KeyID)
+	}
+	if strings.Contains(encrypted, "hello") {
+		t.Error("body stored in clear")
+	}
+
+	opened, err := openRSA(key, envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != body {
+		t.Errorf("got %d bytes back, want %d", len(opened), len(body))
+	}
+
+	for _, tamper := range []func(e *Envelope){
+		func(e *Envelope) { e.EncryptedKey = flipBase64(t, e.EncryptedKey, 0) },
+		func(e *Envelope) { e.Nonce = flipBase64(t, e.Nonce, 5) },
+		func(e *Envelope) { e.Ciphertext = flipBase64(t, e.Ciphertext, 100) },
+		func(e *Envelope) { e.Ciphertext = flipBase64(t, e.Ciphertext, -1) },
+	} {
+		tampered := *envelope
+		tamper(&tampered)
+		if _, err := openRSA(key, &tampered); err == nil {
+			t.Error("opened a tampered envelope")
+		}
+	}
+
+	other, _ := newRSAKey(t)
+	if _, err := openRSA(other, envelope); err == nil {
+		t.Error("opened with another key")
+	}
+}
@@ -0,0 +1,171 @@
+// internal/encryption/envelope.go
+package encryption
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// EnvelopeVersion is the version of the envelope produced by EncryptEmail
+const EnvelopeVersion = 1
+
+// Encryption algorithms of stored mail
+const (
+	// Body encrypted directly with RSA-OAEP SHA-256, only produced before
+	// envelopes existed and limited to very short bodies
+	AlgRSAOAEP = "RSA-OAEP-256"
+	// Body encrypted with AES-256-GCM, key wrapped with RSA-OAEP SHA-256
+	AlgRSAOAEPAESGCM = "RSA-OAEP-256+A256GCM"
+	// Body encrypted with AES-256-GCM, key agreed with X25519 and HKDF-SHA256
+	AlgX25519AESGCM = "X25519-HKDF-SHA256+A256GCM"
+	// PGP/MIME message, not wrapped in an envelope so mail clients can open it
+	AlgPGPMIME = "PGP/MIME"
+)
+
+// ErrNotEnvelope is returned when parsing text that is not an envelope
+var ErrNotEnvelope = errors.New("not an encrypted envelope")
+
+// Envelope wraps an encrypted email with everything needed to decrypt it.
+// It is stored as JSON, binary fields are base64 encoded.
+type Envelope struct {
+	Version      int    `json:"v"`
+	Algorithm    string `json:"alg"`
+	KeyID        string `json:"kid"`           // Fingerprint of the recipient public key, see Fingerprint
+	EphemeralKey string `json:"epk,omitempty"` // X25519 ephemeral public key
+	EncryptedKey string `json:"ek,omitempty"`  // RSA-OAEP wrapped AES key
+	Nonce        string `json:"nonce,omitempty"`
+	Ciphertext   string `json:"ct"`
+}
+
+// String returns the JSON encoding of the envelope
+func (e *Envelope) String() string {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+// ParseEnvelope parses an envelope produced by EncryptEmail
+func ParseEnvelope(text string) (*Envelope, error) {
+	if !strings.HasPrefix(text, `{"v":`) {
+		return nil, ErrNotEnvelope
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal([]byte(text), &envelope); err != nil {
+		return nil, ErrNotEnvelope
+	}
+
+	if envelope.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", envelope.Version)
+	}
+	if envelope.Algorithm == "" || envelope.Ciphertext == "" {
+		return nil, ErrNotEnvelope
+	}
+
+	return &envelope, nil
+}
+
+// IsEncrypted checks if the text is an encrypted email envelope
+func IsEncrypted(text string) bool {
+	_, err := ParseEnvelope(text)
+	return err == nil
+}
+
+// Fingerprint returns the fingerprint of a public key as standard tools show
+// it, whatever its encoding: the OpenPGP v4 fingerprint of the primary key for
+// OpenPGP keys, the hex SHA-256 of the DER SubjectPublicKeyInfo otherwise.
+// Keys that can't be parsed are hashed as they were submitted.
+func Fingerprint(publicKeyStr string) string {
+	if IsArmoredPGPKey(publicKeyStr) {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKeyStr))
+		if err == nil && len(entities) > 0 {
+			return strings.ToUpper(hex.EncodeToString(entities[0].PrimaryKey.Fingerprint))
+		}
+	} else if publicKey, err := parsePublicKey(publicKeyStr); err == nil {
+		if der, err := x509.MarshalPKIXPublicKey(publicKey); err == nil {
+			sum := sha256.Sum256(der)
+			return hex.EncodeToString(sum[:])
+		}
+	}
+
+	sum := sha256.Sum256([]byte(publicKeyStr))
+	return hex.EncodeToString(sum[:])
+}
+
+// AlgorithmFor returns the algorithm EncryptEmail uses for a key type
+func AlgorithmFor(keyType string) string {
+	switch keyType {
+	case KeyTypePGP:
+		return AlgPGPMIME
+	case KeyTypeX25519:
+		return AlgX25519AESGCM
+	default:
+		return AlgRSAOAEPAESGCM
+	}
+}
+
+// newX25519Envelope splits the output of SealX25519 into an envelope
+func newX25519Envelope(sealed []byte, publicKeyStr string) (*Envelope, error) {
+	if len(sealed) < 32+12 {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return &Envelope{
+		Version:      EnvelopeVersion,
+		Algorithm:    AlgX25519AESGCM,
+		KeyID:        Fingerprint(publicKeyStr),
+		EphemeralKey: base64.StdEncoding.EncodeToString(sealed[:32]),
+		Nonce:        base64.StdEncoding.EncodeToString(sealed[32:44]),
+		Ciphertext:   base64.StdEncoding.EncodeToString(sealed[44:]),
+	}, nil
+}
+
+// sealedX25519 joins an X25519 envelope back into the input of OpenX25519
+func (e *Envelope) sealedX25519() ([]byte, error) {
+	var sealed []byte
+	for _, field := range []string{e.EphemeralKey, e.Nonce, e.Ciphertext} {
+		data, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid envelope: %w", err)
+		}
+		sealed = append(sealed, data...)
+	}
+	return sealed, nil
+}
+
+// LegacyEnvelope wraps a base64 RSA-OAEP ciphertext stored before envelopes
+// existed, encrypted for the RSA public key publicKeyStr. Only data exactly
+// the size of the key modulus can be such a ciphertext.
+func LegacyEnvelope(ciphertext, publicKeyStr string) (*Envelope, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("not a legacy ciphertext: %w", err)
+	}
+
+	publicKey, err := parsePublicKey(publicKeyStr)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("legacy ciphertexts require an RSA key")
+	}
+	if len(sealed) != rsaKey.Size() {
+		return nil, fmt.Errorf("not a legacy ciphertext: %d bytes for a %d bytes modulus", len(sealed), rsaKey.Size())
+	}
+
+	return &Envelope{
+		Version:    EnvelopeVersion,
+		Algorithm:  AlgRSAOAEP,
+		KeyID:      Fingerprint(publicKeyStr),
+		Ciphertext: base64.StdEncoding.EncodeToString(sealed),
+	}, nil
+}
@@ -0,0 +1,129 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name           string
+		text           string
+		wantErr        bool
+		wantNoEnvelope bool
+	}{
+		{"valid", `{"v":1,"alg":"x","ct":"y"}`, false, false},
+		{"clear", "Subject: hello\r\n\r\nhello", true, true},
+		{"other json", `{"alg":"x","ct":"y"}`, true, true},
+		{"truncated", `{"v":1,"alg":"x","ct":`, true, true},
+		{"no ciphertext", `{"v":1,"alg":"x"}`, true, true},
+		{"no algorithm", `{"v":1,"ct":"y"}`, true, true},
+		{"future version", `{"v":2,"alg":"x","ct":"y"}`, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseEnvelope(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrNotEnvelope) != tt.wantNoEnvelope {
+				t.Errorf("got error %v, want ErrNotEnvelope %v", err, tt.wantNoEnvelope)
+			}
+			if IsEncrypted(tt.text) == tt.wantErr {
+				t.Errorf("IsEncrypted returned %v", !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLegacyEnvelope(t *testing.T) {
+	key, publicKey := newRSAKey(t)
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := LegacyEnvelope(base64.StdEncoding.EncodeToString(ciphertext), publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Algorithm != AlgRSAOAEP || envelope.KeyID != Fingerprint(publicKey) {
+		t.Errorf("got algorithm %s and key %s", envelope.Algorithm, envelope.KeyID)
+	}
+
+	// Only base64 data the size of the modulus, for an RSA key
+	x25519Key := base64.StdEncoding.EncodeToString(newX25519Key(t).PublicKey().Bytes())
+	for _, tt := range []struct{ ciphertext, key string }{
+		{"hello", publicKey},
+		{base64.StdEncoding.EncodeToString([]byte("hello")), publicKey},
+		{base64.StdEncoding.EncodeToString(ciphertext[1:]), publicKey},
+		{base64.StdEncoding.EncodeToString(ciphertext), x25519Key},
+	} {
+		if _, err := LegacyEnvelope(tt.ciphertext, tt.key); err == nil {
+			t.Errorf("wrapped %.20s...", tt.ciphertext)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	_, rsaKey := newRSAKey(t)
+	der, _ := base64.StdEncoding.DecodeString(rsaKey)
+	sum := sha256.Sum256(der)
+	rsaFingerprint := hex.EncodeToString(sum[:])
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	x25519Key := newX25519Key(t).PublicKey()
+	x25519DER, err := x509.MarshalPKIXPublicKey(x25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256(x25519DER)
+	x25519Fingerprint := hex.EncodeToString(sum[:])
+
+	pgp := newPGPKey(t)
+	pgpFingerprint := strings.ToUpper(hex.EncodeToString(pgp.entity.PrimaryKey.Fingerprint))
+
+	// The same key gets the same fingerprint whatever its encoding
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"rsa der", rsaKey, rsaFingerprint},
+		{"rsa pem", base64.StdEncoding.EncodeToString(rsaPEM), rsaFingerprint},
+		{"rsa pem crlf", base64.StdEncoding.EncodeToString(bytes.ReplaceAll(rsaPEM, []byte("\n"), []byte("\r\n"))), rsaFingerprint},
+		{"x25519 raw", base64.StdEncoding.EncodeToString(x25519Key.Bytes()), x25519Fingerprint},
+		{"x25519 der", base64.StdEncoding.EncodeToString(x25519DER), x25519Fingerprint},
+		{"pgp", pgp.armored, pgpFingerprint},
+		{"pgp crlf", strings.ReplaceAll(pgp.armored, "\n", "\r\n"), pgpFingerprint},
+		{"pgp headers", strings.Replace(pgp.armored, "\n\n", "\nComment: alice\n\n", 1), pgpFingerprint},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Fingerprint(tt.key); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Envelopes name the key by its fingerprint
+	encrypted, err := EncryptEmail("hello", rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope, err := ParseEnvelope(encrypted); err != nil || envelope.KeyID != rsaFingerprint {
+		t.Errorf("got envelope %s, want key %s", encrypted, rsaFingerprint)
+	}
+}
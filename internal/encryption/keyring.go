@@ -0,0 +1,209 @@
+// internal/encryption/keyring.go
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix of the messages sealed by a Keyring, followed by the master key ID,
+// the wrapped data key and the message ciphertext, separated by colons
+const sealedPrefix = "ephimail-sealed:v1:"
+
+// ErrUnknownKey is returned when a blob was sealed with a master key that is
+// not in the keyring
+var ErrUnknownKey = errors.New("unknown master key")
+
+// Keyring holds the master keys used to encrypt stored mail at rest.
+// Each message is encrypted with its own data key, which is wrapped with the
+// primary master key. Previous master keys are only used to open messages
+// sealed before a rotation.
+type Keyring struct {
+	primaryID string
+	keys      map[string][]byte
+}
+
+// NewKeyring creates a keyring sealing with primary and opening with any of
+// primary and previous
+func NewKeyring(primary []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{
+		primaryID: KeyID(primary),
+		keys:      make(map[string][]byte),
+	}
+
+	for _, key := range append([][]byte{primary}, previous...) {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, got %d", KeyID(key), len(key))
+		}
+		k.keys[KeyID(key)] = key
+	}
+
+	return k, nil
+}
+
+// ParseMasterKey parses a base64 encoded or raw 32 bytes master key
+func ParseMasterKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// KeyID returns the identifier of a master key, embedded in sealed blobs
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// PrimaryID returns the identifier of the master key used to seal
+func (k *Keyring) PrimaryID() string {
+	return k.primaryID
+}
+
+// Seal encrypts plaintext with a new data key wrapped by the primary master key
+func (k *Keyring) Seal(plaintext []byte) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	ciphertext, err := SealAESGCM(dataKey, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := SealAESGCM(k.keys[k.primaryID], dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return formatSealed(k.primaryID, wrappedKey, ciphertext), nil
+}
+
+// Open decrypts a blob produced by Seal
+func (k *Keyring) Open(blob string) ([]byte, error) {
+	keyID, wrappedKey, ciphertext, err := parseSealed(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := k.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenAESGCM(dataKey, ciphertext)
+}
+
+// Rewrap wraps the data key of a blob with the primary master key, leaving
+// the message ciphertext untouched. It reports whether the blob changed.
+func (k *Keyring) Rewrap(blob string) (string, bool, error) {
+	keyID, wrappedKey, ciphertext, err := parseSealed(blob)
+	if err != nil {
+		return "", false, err
+	}
+
+	if keyID == k.primaryID {
+		return blob, false, nil
+	}
+
+	dataKey, err := k.unwrap(keyID, wrappedKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	wrappedKey, err = SealAESGCM(k.keys[k.primaryID], dataKey)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return formatSealed(k.primaryID, wrappedKey, ciphertext), true, nil
+}
+
+// BlindIndex returns a keyed hash of term, so that indexes can be looked up
+// without storing the terms in clear. Hashes change when the primary master
+// key is rotated, indexes are rebuilt along with the rewrapped data keys.
+func (k *Keyring) BlindIndex(term string) string {
+	return blindIndex(k.keys[k.primaryID], term)
+}
+
+// PreviousBlindIndexes returns the hashes of term under the previous master
+// keys, the ones indexes are rebuilt from
+func (k *Keyring) PreviousBlindIndexes(term string) []string {
+	var hashes []string
+	for id, key := range k.keys {
+		if id != k.primaryID {
+			hashes = append(hashes, blindIndex(key, term))
+		}
+	}
+	return hashes
+}
+
+func blindIndex(key []byte, term string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("ephimail-blind-index:"))
+	mac.Write([]byte(term))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (k *Keyring) unwrap(keyID string, wrappedKey []byte) ([]byte, error) {
+	masterKey, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, keyID)
+	}
+
+	dataKey, err := OpenAESGCM(masterKey, wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// IsSealed checks if a stored blob was produced by a Keyring
+func IsSealed(blob string) bool {
+	return strings.HasPrefix(blob, sealedPrefix)
+}
+
+func formatSealed(keyID string, wrappedKey, ciphertext []byte) string {
+	return sealedPrefix + keyID + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+func parseSealed(blob string) (string, []byte, []byte, error) {
+	if !IsSealed(blob) {
+		return "", nil, nil, errors.New("blob is not sealed")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(blob, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("malformed sealed blob")
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+
+	return parts[0], wrappedKey, ciphertext, nil
+}
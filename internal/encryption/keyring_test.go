@@ -0,0 +1,178 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestKeyringRoundTrip(t *testing.T) {
+	keyring, err := NewKeyring(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := keyring.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(blob) || !strings.HasPrefix(blob, sealedPrefix+keyring.PrimaryID()+":") {
+		t.Errorf("unexpected blob %s", blob)
+	}
+
+	opened, err := keyring.Open(blob)
+	if err != nil || string(opened) != "hello" {
+		t.Fatalf("got %q, %v", opened, err)
+	}
+
+	// Each message has its own data key
+	if again, _ := keyring.Seal([]byte("hello")); again == blob {
+		t.Error("data key reused")
+	}
+}
+
+func TestKeyringTamper(t *testing.T) {
+	keyring, err := NewKeyring(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := keyring.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(blob, sealedPrefix), ":")
+
+	flip := func(field string) string {
+		data, _ := base64.StdEncoding.DecodeString(field)
+		data[len(data)/2] ^= 0x01
+		return base64.StdEncoding.EncodeToString(data)
+	}
+
+	for name, tampered := range map[string]string{
+		"wrapped key":  sealedPrefix + parts[0] + ":" + flip(parts[1]) + ":" + parts[2],
+		"ciphertext":   sealedPrefix + parts[0] + ":" + parts[1] + ":" + flip(parts[2]),
+		"swapped":      sealedPrefix + parts[0] + ":" + parts[2] + ":" + parts[1],
+		"truncated":    sealedPrefix + parts[0] + ":" + parts[1],
+		"not base64":   sealedPrefix + parts[0] + ":" + parts[1] + ":!",
+		"not sealed":   "hello",
+		"extra fields": blob + ":" + parts[2],
+	} {
+		if _, err := keyring.Open(tampered); err == nil {
+			t.Errorf("opened with %s tampered", name)
+		}
+	}
+
+	// Blobs name their master key, another key is never tried
+	other, _ := NewKeyring(bytes.Repeat([]byte{2}, 32))
+	if _, err := other.Open(blob); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+	if _, err := keyring.Open(sealedPrefix + other.PrimaryID() + ":" + parts[1] + ":" + parts[2]); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+
+	old, _ := NewKeyring(oldKey)
+	blob, err := old.Seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// During a rotation, blobs of both keys open and new ones use the new key
+	rotating, err := NewKeyring(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened, err := rotating.Open(blob); err != nil || string(opened) != "hello" {
+		t.Fatalf("got %q, %v", opened, err)
+	}
+	if fresh, _ := rotating.Seal([]byte("hello")); !strings.HasPrefix(fresh, sealedPrefix+KeyID(newKey)) {
+		t.Errorf("sealed with another key than the primary: %s", fresh)
+	}
+
+	rewrapped, changed, err := rotating.Rewrap(blob)
+	if err != nil || !changed {
+		t.Fatalf("got changed %v, %v", changed, err)
+	}
+	if !strings.HasPrefix(rewrapped, sealedPrefix+KeyID(newKey)) {
+		t.Errorf("rewrapped under another key than the primary: %s", rewrapped)
+	}
+
+	// Only the data key is rewrapped
+	if strings.Split(rewrapped, ":")[4] != strings.Split(blob, ":")[4] {
+		t.Error("ciphertext changed")
+	}
+
+	// Rewrapping is idempotent
+	if again, changed, err := rotating.Rewrap(rewrapped); err != nil || changed || again != rewrapped {
+		t.Errorf("rewrapped twice: %v, %v", changed, err)
+	}
+
+	// The old key can be retired
+	rotated, _ := NewKeyring(newKey)
+	if opened, err := rotated.Open(rewrapped); err != nil || string(opened) != "hello" {
+		t.Errorf("got %q, %v", opened, err)
+	}
+	if _, err := rotated.Open(blob); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+	if _, _, err := rotated.Rewrap(blob); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyringBlindIndex(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	old, _ := NewKeyring(oldKey)
+	rotating, _ := NewKeyring(newKey, oldKey)
+
+	if old.BlindIndex("hello") != old.BlindIndex("hello") {
+		t.Error("blind index is not deterministic")
+	}
+	if old.BlindIndex("hello") == old.BlindIndex("hellp") {
+		t.Error("different terms share a blind index")
+	}
+	if strings.Contains(old.BlindIndex("hello"), "hello") || len(old.BlindIndex("hello")) != 32 {
+		t.Errorf("unexpected blind index %s", old.BlindIndex("hello"))
+	}
+
+	// Rotating the key changes the hashes, the previous ones are still known
+	if rotating.BlindIndex("hello") == old.BlindIndex("hello") {
+		t.Error("blind index unchanged by the rotation")
+	}
+	if previous := rotating.PreviousBlindIndexes("hello"); !slices.Equal(previous, []string{old.BlindIndex("hello")}) {
+		t.Errorf("got previous %v", previous)
+	}
+	if previous := old.PreviousBlindIndexes("hello"); previous != nil {
+		t.Errorf("got previous %v without previous keys", previous)
+	}
+}
+
+func TestMasterKeys(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	for _, data := range [][]byte{key, []byte(base64.StdEncoding.EncodeToString(key)), []byte(base64.StdEncoding.EncodeToString(key) + "\n")} {
+		if parsed, err := ParseMasterKey(data); err != nil || !bytes.Equal(parsed, key) {
+			t.Errorf("parsing %q: got %x, %v", data, parsed, err)
+		}
+	}
+
+	for _, data := range [][]byte{nil, []byte("short"), key[1:], []byte(base64.StdEncoding.EncodeToString(key[1:]))} {
+		if _, err := ParseMasterKey(data); err == nil {
+			t.Errorf("parsed %q", data)
+		}
+	}
+
+	if _, err := NewKeyring(key[1:]); err == nil {
+		t.Error("created a keyring with a short primary key")
+	}
+	if _, err := NewKeyring(key, key[1:]); err == nil {
+		t.Error("created a keyring with a short previous key")
+	}
+}
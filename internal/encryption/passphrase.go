@@ -0,0 +1,150 @@
+// internal/encryption/passphrase.go
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters used to derive keys from passphrases
+const (
+	argonTime    = 1
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// HKDF info string binding session keys to their use
+const sessionInfo = "ephimail session"
+
+// ErrWrongPassphrase is returned when a passphrase can't unlock a mailbox key
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// PassphraseKey holds the key material of a passphrase protected mailbox.
+// Mail is encrypted with the public key as it arrives, the private key is only
+// stored sealed with a key derived from the passphrase.
+type PassphraseKey struct {
+	PublicKey  string // Base64 X25519 public key
+	Salt       string // Base64 Argon2id salt
+	WrappedKey string // Base64 private key sealed with the passphrase-derived key
+}
+
+// NewPassphraseKey generates the key material of a mailbox protected by passphrase
+func NewPassphraseKey(passphrase string) (*PassphraseKey, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate mailbox key: %w", err)
+	}
+
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	wrapped, err := SealAESGCM(derivePassphraseKey(passphrase, salt), privateKey.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap mailbox key: %w", err)
+	}
+
+	return &PassphraseKey{
+		PublicKey:  base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()),
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+// Unlock returns the mailbox private key if the passphrase is correct
+func (k *PassphraseKey) Unlock(passphrase string) (*ecdh.PrivateKey, error) {
+	salt, err := base64.StdEncoding.DecodeString(k.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(k.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+
+	keyBytes, err := OpenAESGCM(derivePassphraseKey(passphrase, salt), wrapped)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return ecdh.X25519().NewPrivateKey(keyBytes)
+}
+
+func derivePassphraseKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+}
+
+// WrapSessionKey seals a mailbox private key with a session token, so that the
+// token alone can unlock the mailbox without storing the key in clear
+func WrapSessionKey(privateKey *ecdh.PrivateKey, token string) (string, error) {
+	key, err := hkdf.Key(sha256.New, []byte(token), nil, sessionInfo, 32)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := SealAESGCM(key, privateKey.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap session key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// UnwrapSessionKey returns the mailbox private key sealed by WrapSessionKey
+func UnwrapSessionKey(wrappedKey, token string) (*ecdh.PrivateKey, error) {
+	key, err := hkdf.Key(sha256.New, []byte(token), nil, sessionInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+
+	keyBytes, err := OpenAESGCM(key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdh.X25519().NewPrivateKey(keyBytes)
+}
+
+// EncryptForMailbox encrypts an email with the base64 X25519 public key of a mailbox
+func EncryptForMailbox(emailBody, publicKeyStr string) (string, error) {
+	return encryptX25519(emailBody, publicKeyStr)
+}
+
+// DecryptFromMailbox decrypts an email encrypted by EncryptForMailbox, also
+// accepting the raw base64 ciphertexts stored before envelopes existed
+func DecryptFromMailbox(encryptedBody string, privateKey *ecdh.PrivateKey) (string, error) {
+	var sealed []byte
+	envelope, err := ParseEnvelope(encryptedBody)
+	switch {
+	case err == nil && envelope.Algorithm == AlgX25519AESGCM:
+		sealed, err = envelope.sealedX25519()
+	case err == nil:
+		return "", fmt.Errorf("unexpected algorithm %s", envelope.Algorithm)
+	default:
+		sealed, err = base64.StdEncoding.DecodeString(encryptedBody)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decode email: %w", err)
+	}
+
+	plaintext, err := OpenX25519(privateKey, sealed)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt email: %w", err)
+	}
+	return string(plaintext), nil
+}
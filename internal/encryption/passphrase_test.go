@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// newX25519Key generates an X25519 key pair, failing the test on errors
+func newX25519Key(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// flipBase64 flips a bit of the i-th byte of base64 encoded data, counting
+// from the end if i is negative
+func flipBase64(t *testing.T, data string, i int) string {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i < 0 {
+		i += len(decoded)
+	}
+	decoded[i] ^= 0x01
+	return base64.StdEncoding.EncodeToString(decoded)
+}
+
+func TestPassphraseKey(t *testing.T) {
+	key, err := NewPassphraseKey("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := key.Unlock("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()) != key.PublicKey {
+		t.Error("unlocked key doesn't match the public key")
+	}
+
+	if _, err := key.Unlock("wrong horse battery staple"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("got %v, want ErrWrongPassphrase", err)
+	}
+
+	// Salts are random, the same passphrase never gives the same key
+	other, _ := NewPassphraseKey("correct horse battery staple")
+	if other.Salt == key.Salt || other.PublicKey == key.PublicKey {
+		t.Error("key material reused")
+	}
+
+	for name, tampered := range map[string]*PassphraseKey{
+		"wrapped key": {PublicKey: key.PublicKey, Salt: key.Salt, WrappedKey: flipBase64(t, key.WrappedKey, 0)},
+		"salt":        {PublicKey: key.PublicKey, Salt: flipBase64(t, key.Salt, 0), WrappedKey: key.WrappedKey},
+		"swapped":     {PublicKey: key.PublicKey, Salt: other.Salt, WrappedKey: key.WrappedKey},
+	} {
+		if _, err := tampered.Unlock("correct horse battery staple"); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("unlocked with %s tampered: %v", name, err)
+		}
+	}
+
+	for name, invalid := range map[string]*PassphraseKey{
+		"salt":        {Salt: "!", WrappedKey: key.WrappedKey},
+		"wrapped key": {Salt: key.Salt, WrappedKey: "!"},
+	} {
+		if _, err := invalid.Unlock("correct horse battery staple"); err == nil {
+			t.Errorf("unlocked with an invalid %s", name)
+		}
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	privateKey := newX25519Key(t)
+
+	wrapped, err := WrapSessionKey(privateKey, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := UnwrapSessionKey(wrapped, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unwrapped.Equal(privateKey) {
+		t.Error("unwrapped another key")
+	}
+
+	if _, err := UnwrapSessionKey(wrapped, "other token"); err == nil {
+		t.Error("unwrapped with another token")
+	}
+	if _, err := UnwrapSessionKey(flipBase64(t, wrapped, -1), "token"); err == nil {
+		t.Error("unwrapped a tampered key")
+	}
+	if _, err := UnwrapSessionKey("!", "token"); err == nil {
+		t.Error("unwrapped an invalid key")
+	}
+}
+
+func TestEncryptForMailbox(t *testing.T) {
+	privateKey := newX25519Key(t)
+	publicKey := base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes())
+
+	encrypted, err := EncryptForMailbox("hello", publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(encrypted) {
+		t.Errorf("not an envelope: %s", encrypted)
+	}
+
+	decrypted, err := DecryptFromMailbox(encrypted, privateKey)
+	if err != nil || decrypted != "hello" {
+		t.Fatalf("got %q, %v", decrypted, err)
+	}
+
+	if _, err := DecryptFromMailbox(encrypted, newX25519Key(t)); err == nil {
+		t.Error("decrypted with another key")
+	}
+
+	envelope, _ := ParseEnvelope(encrypted)
+	envelope.Ciphertext = flipBase64(t, envelope.Ciphertext, 0)
+	if _, err := DecryptFromMailbox(envelope.String(), privateKey); err == nil {
+		t.Error("decrypted a tampered envelope")
+	}
+
+	// Other algorithms are not for passphrase protected mailboxes
+	envelope.Algorithm = AlgRSAOAEPAESGCM
+	if _, err := DecryptFromMailbox(envelope.String(), privateKey); err == nil {
+		t.Error("decrypted an RSA envelope")
+	}
+}
+
+func TestDecryptFromMailboxLegacy(t *testing.T) {
+	privateKey := newX25519Key(t)
+
+	// Raw base64 ciphertexts were stored before envelopes existed
+	sealed, err := SealX25519(privateKey.PublicKey(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := base64.StdEncoding.EncodeToString(sealed)
+
+	if decrypted, err := DecryptFromMailbox(legacy, privateKey); err != nil || decrypted != "hello" {
+		t.Errorf("got %q, %v", decrypted, err)
+	}
+	if _, err := DecryptFromMailbox(flipBase64(t, legacy, 40), privateKey); err == nil {
+		t.Error("decrypted a tampered ciphertext")
+	}
+	if _, err := DecryptFromMailbox("hello", privateKey); err == nil {
+		t.Error("decrypted clear text")
+	}
+}
@@ -0,0 +1,108 @@
+// internal/encryption/pgp.go
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// Headers of the original message copied on the PGP/MIME envelope so mail
+// clients can still thread and sort it. The subject stays inside the ciphertext.
+var pgpEnvelopeHeaders = []string{"From", "To", "Cc", "Date", "Message-Id"}
+
+// IsArmoredPGPKey checks if the key is an ASCII armored OpenPGP public key
+func IsArmoredPGPKey(publicKey string) bool {
+	return strings.HasPrefix(strings.TrimSpace(publicKey), "-----BEGIN PGP PUBLIC KEY BLOCK-----")
+}
+
+// readPGPKey parses an ASCII armored OpenPGP public key. Every key must be
+// able to encrypt right now, sign-only, expired and revoked keys are refused.
+func readPGPKey(armoredKey string) (openpgp.EntityList, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenPGP key: %w", err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no OpenPGP key found")
+	}
+
+	now := time.Now()
+	for _, entity := range entities {
+		if _, ok := entity.EncryptionKey(now); !ok {
+			return nil, fmt.Errorf("OpenPGP key %X has no valid encryption key, it may be sign-only, expired or revoked", entity.PrimaryKey.Fingerprint)
+		}
+	}
+	return entities, nil
+}
+
+// EncryptPGPMIME encrypts a raw email for an ASCII armored OpenPGP key and
+// wraps it in a PGP/MIME (RFC 3156) message that standard mail clients can open
+func EncryptPGPMIME(emailBody, armoredKey string) (string, error) {
+	entities, err := readPGPKey(armoredKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Encrypt the whole original message, headers included
+	var encrypted bytes.Buffer
+	armorWriter, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+
+	plaintextWriter, err := openpgp.Encrypt(armorWriter, entities, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+
+	if _, err := plaintextWriter.Write([]byte(emailBody)); err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+	if err := plaintextWriter.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+	if err := armorWriter.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt email: %w", err)
+	}
+
+	boundary := make([]byte, 16)
+	if _, err := rand.Read(boundary); err != nil {
+		return "", fmt.Errorf("failed to generate boundary: %w", err)
+	}
+
+	var message strings.Builder
+
+	// Copy the routing headers of the original message if it can be parsed
+	if original, err := mail.ReadMessage(strings.NewReader(emailBody)); err == nil {
+		for _, name := range pgpEnvelopeHeaders {
+			if value := original.Header.Get(name); value != "" {
+				fmt.Fprintf(&message, "%s: %s\r\n", name, value)
+			}
+		}
+	}
+
+	fmt.Fprintf(&message, "Subject: ...\r\n")
+	fmt.Fprintf(&message, "X-Ephimail-Key-Fingerprint: %s\r\n", Fingerprint(armoredKey))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\"%x\"\r\n", boundary)
+	fmt.Fprintf(&message, "\r\nThis is an OpenPGP/MIME encrypted message (RFC 4880 and 3156)\r\n")
+	fmt.Fprintf(&message, "--%x\r\n", boundary)
+	fmt.Fprintf(&message, "Content-Type: application/pgp-encrypted\r\n")
+	fmt.Fprintf(&message, "Content-Description: PGP/MIME version identification\r\n\r\n")
+	fmt.Fprintf(&message, "Version: 1\r\n\r\n")
+	fmt.Fprintf(&message, "--%x\r\n", boundary)
+	fmt.Fprintf(&message, "Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	fmt.Fprintf(&message, "Content-Description: OpenPGP encrypted message\r\n")
+	fmt.Fprintf(&message, "Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(encrypted.String(), "\n", "\r\n"))
+	fmt.Fprintf(&message, "\r\n--%x--\r\n", boundary)
+
+	return message.String(), nil
+}
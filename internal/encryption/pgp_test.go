@@ -0,0 +1,188 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+type pgpKey struct {
+	entity  *openpgp.Entity
+	armored string
+}
+
+// newPGPKey generates an OpenPGP key and its armored public key
+func newPGPKey(t *testing.T) pgpKey {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity("Alice", "", "alice@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pgpKey{entity: entity, armored: armorPGPKey(t, entity)}
+}
+
+// pgpMIMEParts parses a PGP/MIME message and returns its headers and the
+// binary OpenPGP message of its encrypted part
+func pgpMIMEParts(t *testing.T, message string) (mail.Header, []byte) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(strings.NewReader(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("got content type %s %v, %v", mediaType, params, err)
+	}
+
+	var parts []string
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Type"), string(data))
+	}
+	if len(parts) != 4 || parts[0] != "application/pgp-encrypted" || !strings.Contains(parts[1], "Version: 1") {
+		t.Fatalf("unexpected parts %q", parts)
+	}
+
+	block, err := armor.Decode(strings.NewReader(parts[3]))
+	if err != nil || block.Type != "PGP MESSAGE" {
+		t.Fatalf("got armor block %v, %v", block, err)
+	}
+	data, err := io.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Header, data
+}
+
+// readPGPMessage decrypts a binary OpenPGP message, checking its integrity
+func readPGPMessage(key pgpKey, data []byte) ([]byte, error) {
+	md, err := openpgp.ReadMessage(bytes.NewReader(data), openpgp.EntityList{key.entity}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(md.UnverifiedBody)
+}
+
+func TestEncryptPGPMIME(t *testing.T) {
+	key := newPGPKey(t)
+	body := "From: bob@example.com\r\nTo: alice@example.com\r\nSubject: secret plans\r\nMessage-Id: <1@example.com>\r\n\r\nhello\r\n"
+
+	encrypted, err := EncryptEmail(body, key.armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, data := pgpMIMEParts(t, encrypted)
+	if header.Get("To") != "alice@example.com" || header.Get("Message-Id") != "<1@example.com>" {
+		t.Errorf("routing headers not copied: %v", header)
+	}
+	if header.Get("Subject") != "..." || strings.Contains(encrypted, "secret plans") {
+		t.Error("subject leaked")
+	}
+	if header.Get("X-Ephimail-Key-Fingerprint") != Fingerprint(key.armored) {
+		t.Errorf("got fingerprint %s", header.Get("X-Ephimail-Key-Fingerprint"))
+	}
+
+	// The whole message is encrypted, headers included
+	opened, err := readPGPMessage(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != body {
+		t.Errorf("got %q, want %q", opened, body)
+	}
+
+	tampered := bytes.Clone(data)
+	tampered[len(tampered)-10] ^= 0x01
+	if _, err := readPGPMessage(key, tampered); err == nil {
+		t.Error("opened a tampered message")
+	}
+
+	if _, err := readPGPMessage(newPGPKey(t), data); err == nil {
+		t.Error("opened with another key")
+	}
+}
+
+func TestEncryptPGPMIMEUnparsable(t *testing.T) {
+	key := newPGPKey(t)
+
+	// Bodies that are not messages are still encrypted, without headers to copy
+	encrypted, err := EncryptPGPMIME("hello", key.armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, data := pgpMIMEParts(t, encrypted)
+	if header.Get("From") != "" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	if opened, err := readPGPMessage(key, data); err != nil || string(opened) != "hello" {
+		t.Errorf("got %q, %v", opened, err)
+	}
+
+	if _, err := EncryptPGPMIME("hello", "-----BEGIN PGP PUBLIC KEY BLOCK-----\n"); err == nil {
+		t.Error("encrypted for an invalid key")
+	}
+}
+
+// armorPGPKey returns the armored public key of an entity
+func armorPGPKey(t *testing.T, entity *openpgp.Entity) string {
+	t.Helper()
+
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return armored.String()
+}
+
+func TestPGPKeyCanEncrypt(t *testing.T) {
+	// Keys without an encryption subkey can only sign
+	signOnly := newPGPKey(t).entity
+	signOnly.Subkeys = nil
+
+	// Keys past their lifetime
+	expired, err := openpgp.NewEntity("Alice", "", "alice@example.com", &packet.Config{
+		Time:            func() time.Time { return time.Now().Add(-2 * time.Hour) },
+		KeyLifetimeSecs: 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, entity := range map[string]*openpgp.Entity{"sign-only": signOnly, "expired": expired} {
+		key := armorPGPKey(t, entity)
+		if _, err := DetectKeyType(key); err == nil || !strings.Contains(err.Error(), "no valid encryption key") {
+			t.Errorf("%s key: got %v", name, err)
+		}
+		if _, err := EncryptEmail("hello", key); err == nil {
+			t.Errorf("encrypted for a %s key", name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// internal/encryption/x25519.go
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// HKDF info string binding derived keys to this scheme
+const x25519Info = "ephimail x25519 aes-256-gcm"
+
+// SealX25519 encrypts plaintext for an X25519 public key.
+// An ephemeral key pair is generated and the shared secret is expanded with
+// HKDF-SHA256 into an AES-256-GCM key. The output is the ephemeral public key
+// followed by the nonce and the ciphertext.
+//
+// It only uses primitives available in WebCrypto, a browser decrypts with:
+//   - importKey("raw", first 32 bytes, "X25519") and deriveBits with its private key
+//   - HKDF with SHA-256, the ephemeral public key as salt and x25519Info as info
+//   - AES-GCM with the next 12 bytes as IV over the rest of the data
+func SealX25519(publicKey *ecdh.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+
+	key, err := x25519Key(ephemeral, publicKey, ephemeral.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := SealAESGCM(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ephemeral.PublicKey().Bytes(), sealed...), nil
+}
+
+// OpenX25519 decrypts data produced by SealX25519
+func OpenX25519(privateKey *ecdh.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 32 {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+
+	key, err := x25519Key(privateKey, ephemeral, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenAESGCM(key, data[32:])
+}
+
+// x25519Key derives the symmetric key shared between private and peer,
+// salted with the ephemeral public key of the exchange
+func x25519Key(private *ecdh.PrivateKey, peer, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+
+	return hkdf.Key(sha256.New, shared, ephemeral.Bytes(), x25519Info, 32)
+}
+
+// SealAESGCM encrypts plaintext with AES-GCM, the random nonce is prepended
+// to the ciphertext
+func SealAESGCM(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// OpenAESGCM decrypts data produced by SealAESGCM
+func OpenAESGCM(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,130 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestX25519RoundTrip(t *testing.T) {
+	key := newX25519Key(t)
+
+	for _, plaintext := range [][]byte{nil, []byte("x"), []byte("Subject: hello\r\n\r\nhello\r\n"), bytes.Repeat([]byte("a"), 1<<20)} {
+		sealed, err := SealX25519(key.PublicKey(), plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed) != 32+12+len(plaintext)+16 {
+			t.Errorf("sealed %d bytes into %d bytes", len(plaintext), len(sealed))
+		}
+
+		opened, err := OpenX25519(key, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Errorf("got %d bytes back, want %d", len(opened), len(plaintext))
+		}
+	}
+
+	// Ephemeral keys make each ciphertext different
+	first, _ := SealX25519(key.PublicKey(), []byte("hello"))
+	second, _ := SealX25519(key.PublicKey(), []byte("hello"))
+	if bytes.Equal(first[:32], second[:32]) || bytes.Equal(first, second) {
+		t.Error("ephemeral key reused")
+	}
+}
+
+func TestX25519Tamper(t *testing.T) {
+	key := newX25519Key(t)
+	sealed, err := SealX25519(key.PublicKey(), []byte("Subject: hello\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any flipped bit, in the ephemeral key, the nonce, the ciphertext or the tag
+	for i := range sealed {
+		tampered := bytes.Clone(sealed)
+		tampered[i] ^= 0x01
+		if _, err := OpenX25519(key, tampered); err == nil {
+			t.Errorf("opened with byte %d flipped", i)
+		}
+	}
+
+	for _, truncated := range [][]byte{nil, sealed[:31], sealed[:32], sealed[:44], sealed[:len(sealed)-1]} {
+		if _, err := OpenX25519(key, truncated); err == nil {
+			t.Errorf("opened %d bytes truncated data", len(truncated))
+		}
+	}
+
+	if _, err := OpenX25519(newX25519Key(t), sealed); err == nil {
+		t.Error("opened with another key")
+	}
+}
+
+func TestAESGCM(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	sealed, err := SealAESGCM(key, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenAESGCM(key, sealed)
+	if err != nil || string(opened) != "hello" {
+		t.Fatalf("got %q, %v", opened, err)
+	}
+
+	if _, err := OpenAESGCM(bytes.Repeat([]byte{2}, 32), sealed); err == nil {
+		t.Error("opened with another key")
+	}
+	sealed[len(sealed)-1] ^= 0x01
+	if _, err := OpenAESGCM(key, sealed); err == nil {
+		t.Error("opened tampered data")
+	}
+	if _, err := SealAESGCM([]byte("short"), []byte("hello")); err == nil {
+		t.Error("sealed with an invalid key")
+	}
+}
+
+func TestEncryptEmailX25519(t *testing.T) {
+	key := newX25519Key(t)
+	publicKey := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+
+	encrypted, err := EncryptEmail("Subject: hello\r\n\r\nhello\r\n", publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := ParseEnvelope(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Algorithm != AlgX25519AESGCM || envelope.KeyID != Fingerprint(publicKey) || envelope.EncryptedKey != "" {
+		t.Errorf("unexpected envelope %s", encrypted)
+	}
+
+	sealed, err := envelope.sealedX25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := OpenX25519(key, sealed)
+	if err != nil || string(opened) != "Subject: hello\r\n\r\nhello\r\n" {
+		t.Fatalf("got %q, %v", opened, err)
+	}
+
+	for _, tamper := range []func(e *Envelope){
+		func(e *Envelope) { e.EphemeralKey = flipBase64(t, e.EphemeralKey, 3) },
+		func(e *Envelope) { e.Nonce = flipBase64(t, e.Nonce, 0) },
+		func(e *Envelope) { e.Ciphertext = flipBase64(t, e.Ciphertext, 7) },
+	} {
+		tampered := *envelope
+		tamper(&tampered)
+		sealed, err := tampered.sealedX25519()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenX25519(key, sealed); err == nil {
+			t.Error("opened a tampered envelope")
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// internal/extract/code.go
+package extract
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Maximum distance in characters between a code and its keyword
+const maxKeywordDistance = 60
+
+var (
+	// Words announcing a one-time code
+	codeKeywords = regexp.MustCompile(`(?i)\b(code|codes|otp|one[- ]time|passcode|password|pin|verification|verify|confirmation|confirm|security|log[- ]?in|sign[- ]?in|token|2fa|mfa|authentication)\b`)
+
+	// Numeric codes, possibly split in two groups, and uppercase
+	// alphanumeric codes
+	codeCandidates = regexp.MustCompile(`\b([0-9]{3}[- ][0-9]{3}|[0-9]{4,8}|[A-Z0-9]{4,10})\b`)
+
+	// Addresses, links and copyright years hold numbers that are not codes
+	codeNoise = regexp.MustCompile(`(?i)(https?://|www\.)\S+|\S+@\S+|(©|\(c\)|copyright)\s*[0-9]{4}`)
+)
+
+// CodeExtractor finds the one-time codes next to keywords such as "code" or
+// "verification", closest first
+type CodeExtractor struct{}
+
+type codeMatch struct {
+	code     Code
+	distance int
+}
+
+// Extract adds the one-time codes of the visible text of a message
+func (e *CodeExtractor) Extract(content *Content, result *Result) {
+	text := codeNoise.ReplaceAllStringFunc(content.VisibleText(), func(noise string) string {
+		return strings.Repeat(" ", len(noise))
+	})
+
+	keywords := codeKeywords.FindAllStringIndex(text, -1)
+	if len(keywords) == 0 {
+		return
+	}
+
+	var matches []codeMatch
+	for _, candidate := range codeCandidates.FindAllStringIndex(text, -1) {
+		start, end := candidate[0], candidate[1]
+		value := text[start:end]
+		if !isCode(value) || partOfToken(text, start, end) {
+			continue
+		}
+
+		distance, keyword := -1, ""
+		for _, span := range keywords {
+			d := spanDistance(span[0], span[1], start, end)
+			if distance < 0 || d < distance {
+				distance, keyword = d, text[span[0]:span[1]]
+			}
+		}
+		if distance > maxKeywordDistance {
+			continue
+		}
+
+		matches = append(matches, codeMatch{
+			code: Code{
+				Value:   strings.NewReplacer(" ", "", "-", "").Replace(value),
+				Type:    "otp",
+				Keyword: strings.ToLower(keyword),
+			},
+			distance: distance,
+		})
+	}
+
+	// Stable, codes as close to a keyword keep their order
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+	for _, match := range matches {
+		result.AddCode(match.code)
+	}
+}
+
+// isCode tells whether a candidate looks like a code: digits, or uppercase
+// letters mixed with at least two digits
+func isCode(value string) bool {
+	digits, letters := 0, 0
+	for _, r := range value {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case unicode.IsLetter(r):
+			letters++
+		}
+	}
+	return letters == 0 || digits >= 2
+}
+
+// partOfToken tells whether a candidate belongs to a larger number, such as
+// a date, an amount or a phone number, or to an identifier such as REF-1234
+func partOfToken(text string, start, end int) bool {
+	isSeparator := func(b byte) bool {
+		return strings.IndexByte(".,:/-+_ ", b) >= 0
+	}
+	isDigit := func(b byte) bool {
+		return b >= '0' && b <= '9'
+	}
+	isAlphanumeric := func(b byte) bool {
+		return isDigit(b) || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+	}
+
+	if start >= 2 && isSeparator(text[start-1]) {
+		// Spaces only join digits, other separators join words too
+		if isDigit(text[start-2]) || (text[start-1] != ' ' && isAlphanumeric(text[start-2])) {
+			return true
+		}
+	}
+	if end+1 < len(text) && isSeparator(text[end]) {
+		if isDigit(text[end+1]) || (text[end] != ' ' && isAlphanumeric(text[end+1])) {
+			return true
+		}
+	}
+	if start >= 1 && strings.IndexByte("$#+", text[start-1]) >= 0 {
+		return true
+	}
+	return end < len(text) && text[end] == '%'
+}
+
+// spanDistance returns the number of characters between two spans
+func spanDistance(start1, end1, start2, end2 int) int {
+	if end1 <= start2 {
+		return start2 - end1
+	}
+	if end2 <= start1 {
+		return start1 - end2
+	}
+	return 0
+}
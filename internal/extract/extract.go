@@ -0,0 +1,156 @@
+// internal/extract/extract.go
+package extract
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/michelangelomo/ephimail/internal/message"
+)
+
+// Maximum number of results of each kind kept for a message
+const (
+	maxCodes = 20
+	maxLinks = 200
+)
+
+// Result holds what the extractors found in a message
+type Result struct {
+	Codes []Code `json:"codes"`
+	Links []Link `json:"links"`
+}
+
+// Code is a one-time code or any value found by a custom extractor
+type Code struct {
+	Value   string `json:"value"`
+	Type    string `json:"type"`              // otp, or the name of the custom extractor
+	Keyword string `json:"keyword,omitempty"` // Keyword the code was found next to
+}
+
+// Link is a link found in a message, with its anchor text if it was found in
+// the HTML body
+type Link struct {
+	URL  string `json:"url"`
+	Text string `json:"text,omitempty"`
+}
+
+// Content is the decoded content of a message extractors run on
+type Content struct {
+	Subject string
+	Text    string // text/plain parts
+	HTML    string // text/html parts
+}
+
+// ParseContent decodes the content of a raw email
+func ParseContent(raw string) *Content {
+	content := &Content{}
+	if headers, err := message.ParseHeaders(raw); err == nil {
+		content.Subject = headers.Subject
+	}
+	content.Text, content.HTML = message.Bodies(raw)
+	return content
+}
+
+// VisibleText returns the text a reader sees: the subject, then the plain
+// text or else the text of the HTML body
+func (c *Content) VisibleText() string {
+	body := c.Text
+	if strings.TrimSpace(body) == "" {
+		body = message.HTMLText(c.HTML)
+	}
+	return c.Subject + "\n" + body
+}
+
+// Extractor finds codes or links in the content of a message
+type Extractor interface {
+	Extract(content *Content, result *Result)
+}
+
+// Pipeline runs extractors in turn on the content of messages
+type Pipeline struct {
+	extractors []Extractor
+}
+
+// NewPipeline creates a pipeline running the one-time code and link
+// extractors, then the custom extractors
+func NewPipeline(custom ...Extractor) *Pipeline {
+	return &Pipeline{
+		extractors: append([]Extractor{&CodeExtractor{}, &LinkExtractor{}}, custom...),
+	}
+}
+
+// Run runs the extractors on the content of a message
+func (p *Pipeline) Run(content *Content) *Result {
+	result := &Result{Codes: []Code{}, Links: []Link{}}
+	for _, extractor := range p.extractors {
+		extractor.Extract(content, result)
+	}
+	return result
+}
+
+// Extract runs the extractors on a raw email
+func (p *Pipeline) Extract(raw string) *Result {
+	return p.Run(ParseContent(raw))
+}
+
+// AddCode adds a code to the result, unless the extractor already found it
+func (r *Result) AddCode(code Code) {
+	if len(r.Codes) >= maxCodes {
+		return
+	}
+	for _, found := range r.Codes {
+		if found.Value == code.Value && found.Type == code.Type {
+			return
+		}
+	}
+	r.Codes = append(r.Codes, code)
+}
+
+// AddLink adds a link to the result. Links already found only get the anchor
+// text they were missing.
+func (r *Result) AddLink(link Link) {
+	for i, found := range r.Links {
+		if found.URL == link.URL {
+			if found.Text == "" {
+				r.Links[i].Text = link.Text
+			}
+			return
+		}
+	}
+	if len(r.Links) < maxLinks {
+		r.Links = append(r.Links, link)
+	}
+}
+
+// RegexExtractor finds the codes matching a custom regular expression, the
+// code is the first group or else the whole match
+type RegexExtractor struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// ParseRegexExtractor parses a custom extractor given as "name=regex"
+func ParseRegexExtractor(definition string) (*RegexExtractor, error) {
+	name, pattern, ok := strings.Cut(definition, "=")
+	if !ok || name == "" || pattern == "" {
+		return nil, fmt.Errorf("invalid extractor %q, expected name=regex", definition)
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex of extractor %s: %w", name, err)
+	}
+	return &RegexExtractor{Name: name, Pattern: compiled}, nil
+}
+
+// Extract adds the matches of the pattern in the visible text of a message
+func (e *RegexExtractor) Extract(content *Content, result *Result) {
+	for _, match := range e.Pattern.FindAllStringSubmatch(content.VisibleText(), maxCodes) {
+		value := match[0]
+		if len(match) > 1 && match[1] != "" {
+			value = match[1]
+		}
+		result.AddCode(Code{Value: value, Type: e.Name})
+	}
+}
@@ -0,0 +1,151 @@
+package extract
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	order, err := ParseRegexExtractor(`order=Order #([0-9]+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := NewPipeline(order)
+
+	for _, tt := range []struct {
+		name  string
+		raw   string
+		codes []Code
+		links []Link
+	}{
+		{
+			name:  "otp",
+			raw:   "Subject: Your verification code\r\n\r\nYour verification code is 123456. It expires in 10 minutes.\r\n",
+			codes: []Code{{Value: "123456", Type: "otp", Keyword: "code"}},
+		},
+		{
+			name:  "split otp",
+			raw:   "Subject: Sign in\r\n\r\nUse 482-913 to sign in.\r\n",
+			codes: []Code{{Value: "482913", Type: "otp", Keyword: "sign in"}},
+		},
+		{
+			name:  "alphanumeric otp among noise",
+			raw:   "Subject: Security\r\n\r\nYour security code: AB12CD\r\nCall us at +1 555 123 4567 or visit https://example.com/help.\r\n© 2024 Example\r\n",
+			codes: []Code{{Value: "AB12CD", Type: "otp", Keyword: "code"}},
+			links: []Link{{URL: "https://example.com/help"}},
+		},
+		{
+			name: "numbers without keyword",
+			raw:  "Subject: Hello\r\n\r\nHello 123456 world\r\n",
+		},
+		{
+			name:  "custom extractor",
+			raw:   "Subject: Receipt\r\n\r\nOrder #98765 total $1234 on 2024-05-01\r\n",
+			codes: []Code{{Value: "98765", Type: "order"}},
+		},
+		{
+			name:  "magic link",
+			raw:   "Subject: Sign in to Example\r\n\r\nClick https://example.com/login?token=abc123&next=%2F to sign in.\r\n",
+			links: []Link{{URL: "https://example.com/login?token=abc123&next=%2F"}},
+		},
+		{
+			name: "html only",
+			raw: "Subject: Magic link\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" +
+				`<p>Click <a href="https://example.com/magic?t=a&amp;u=1">Sign <b>in</b></a> to continue.</p>` +
+				`<p>Your code is <strong>654321</strong></p><img src="https://tracker.example/p.gif">` + "\r\n",
+			codes: []Code{{Value: "654321", Type: "otp", Keyword: "code"}},
+			links: []Link{{URL: "https://example.com/magic?t=a&u=1", Text: "Sign in"}, {URL: "https://tracker.example/p.gif"}},
+		},
+		{
+			name: "html links that are not web links",
+			raw: "Subject: Links\r\nContent-Type: text/html\r\n\r\n" +
+				`<a href="javascript:alert(1)">x</a><a href="/relative">r</a><a href=mailto:alice@example.com>m</a>` + "\r\n",
+		},
+		{
+			name: "alternative",
+			raw: "Subject: Hi\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nYour code is 111222\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>Your code is <b>111222</b> <a href='https://example.com/verify'>verify</a></p>\r\n" +
+				"--b--\r\n",
+			codes: []Code{{Value: "111222", Type: "otp", Keyword: "code"}},
+			links: []Link{{URL: "https://example.com/verify", Text: "verify"}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			result := pipeline.Extract(tt.raw)
+			if tt.codes == nil {
+				tt.codes = []Code{}
+			}
+			if tt.links == nil {
+				tt.links = []Link{}
+			}
+			if !reflect.DeepEqual(result.Codes, tt.codes) {
+				t.Errorf("codes = %+v, want %+v", result.Codes, tt.codes)
+			}
+			if !reflect.DeepEqual(result.Links, tt.links) {
+				t.Errorf("links = %+v, want %+v", result.Links, tt.links)
+			}
+		})
+	}
+}
+
+func TestResultLimits(t *testing.T) {
+	var text strings.Builder
+	text.WriteString("Subject: Codes\r\n\r\n")
+	for i := range maxCodes + 5 {
+		text.WriteString("code " + strings.Repeat(string(rune('1'+i%9)), 6) + strings.Repeat("0", i/9) + "\n")
+	}
+
+	result := NewPipeline().Extract(text.String())
+	if len(result.Codes) != maxCodes {
+		t.Errorf("got %d codes, want %d", len(result.Codes), maxCodes)
+	}
+
+	// Links found again only get their missing anchor text
+	result = &Result{}
+	result.AddLink(Link{URL: "https://example.com"})
+	result.AddLink(Link{URL: "https://example.com", Text: "Example"})
+	result.AddLink(Link{URL: "https://example.com", Text: "Other"})
+	if want := []Link{{URL: "https://example.com", Text: "Example"}}; !reflect.DeepEqual(result.Links, want) {
+		t.Errorf("links = %+v, want %+v", result.Links, want)
+	}
+}
+
+func TestParseRegexExtractor(t *testing.T) {
+	for _, tt := range []struct {
+		definition string
+		valid      bool
+	}{
+		{`order=Order #([0-9]+)`, true},
+		{`ticket=[A-Z]{3}-[0-9]{4}`, true},
+		{`equals=a=b`, true},
+		{``, false},
+		{`order`, false},
+		{`=Order #([0-9]+)`, false},
+		{`order=`, false},
+		{`order=Order #([0-9]+`, false},
+		{`order=(?<name)`, false},
+		{`order=a**`, false},
+	} {
+		extractor, err := ParseRegexExtractor(tt.definition)
+		if tt.valid != (err == nil) {
+			t.Errorf("ParseRegexExtractor(%q): got error %v, want valid %v", tt.definition, err, tt.valid)
+		}
+		if err == nil && extractor.Name == "" {
+			t.Errorf("ParseRegexExtractor(%q): no name", tt.definition)
+		}
+	}
+
+	// The first group is the code, or else the whole match
+	ticket, err := ParseRegexExtractor(`ticket=[A-Z]{3}-[0-9]{4}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &Result{}
+	ticket.Extract(&Content{Text: "Tickets ABC-1234 and XYZ-9876"}, result)
+	want := []Code{{Value: "ABC-1234", Type: "ticket"}, {Value: "XYZ-9876", Type: "ticket"}}
+	if !reflect.DeepEqual(result.Codes, want) {
+		t.Errorf("codes = %+v, want %+v", result.Codes, want)
+	}
+}
@@ -0,0 +1,52 @@
+// internal/extract/link.go
+package extract
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/michelangelomo/ephimail/internal/message"
+)
+
+var (
+	// Anchors of HTML bodies, with their href and content
+	htmlAnchors = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))[^>]*>(.*?)</a\s*>`)
+
+	// Links of text bodies
+	textLinks = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+)
+
+// LinkExtractor finds the links of the HTML and text bodies of a message,
+// with the anchor text of HTML links
+type LinkExtractor struct{}
+
+// Extract adds the web links of a message, HTML anchors first
+func (e *LinkExtractor) Extract(content *Content, result *Result) {
+	for _, anchor := range htmlAnchors.FindAllStringSubmatch(content.HTML, -1) {
+		href := anchor[1] + anchor[2] + anchor[3]
+		if link, ok := webLink(html.UnescapeString(href)); ok {
+			result.AddLink(Link{URL: link, Text: message.HTMLText(anchor[4])})
+		}
+	}
+
+	// Links of the HTML body that are not anchors, then those of the text
+	for _, body := range []string{html.UnescapeString(content.HTML), content.Text} {
+		for _, match := range textLinks.FindAllString(body, -1) {
+			if link, ok := webLink(strings.TrimRight(match, ".,;:!?)]}>")); ok {
+				result.AddLink(Link{URL: link})
+			}
+		}
+	}
+}
+
+// webLink returns an absolute http or https link, without surrounding spaces
+func webLink(link string) (string, bool) {
+	link = strings.TrimSpace(link)
+	parsed, err := url.Parse(link)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", false
+	}
+	return link, true
+}
@@ -0,0 +1,147 @@
+// internal/message/attachment.go
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// ErrAttachmentNotFound is returned when an email has no attachment at an index
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// Attachment describes an attachment of an email, or an inline part
+// referenced by its content ID
+type Attachment struct {
+	Index       int    `json:"index"` // Position among the attachments of the email
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"` // Decoded size
+	ContentID   string `json:"content_id,omitempty"`
+	SHA256      string `json:"sha256"`
+}
+
+// Attachments returns the attachments of an email, in order
+func Attachments(raw string) []*Attachment {
+	attachments := []*Attachment{}
+	walkAttachments(raw, func(attachment *Attachment, content []byte) bool {
+		attachments = append(attachments, attachment)
+		return true
+	})
+	return attachments
+}
+
+// AttachmentContent returns an attachment of an email with its decoded content
+func AttachmentContent(raw string, index int) (*Attachment, []byte, error) {
+	var found *Attachment
+	var data []byte
+	walkAttachments(raw, func(attachment *Attachment, content []byte) bool {
+		if attachment.Index != index {
+			return true
+		}
+		found, data = attachment, content
+		return false
+	})
+
+	if found == nil {
+		return nil, nil, ErrAttachmentNotFound
+	}
+	return found, data, nil
+}
+
+// partHeader reads the headers of an email or of a part
+type partHeader interface {
+	Get(key string) string
+}
+
+// walkAttachments calls fn with each attachment of an email and its decoded
+// content, until fn returns false
+func walkAttachments(raw string, fn func(*Attachment, []byte) bool) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return
+	}
+
+	index := 0
+	walkParts(msg.Header, msg.Body, 0, func(header partHeader, body io.Reader) bool {
+		attachment, content, ok := readAttachment(header, body)
+		if !ok {
+			return true
+		}
+		attachment.Index = index
+		index++
+		return fn(attachment, content)
+	})
+}
+
+// walkParts calls fn with each leaf part of a body, until fn returns false.
+// It reports whether the walk should go on.
+func walkParts(header partHeader, body io.Reader, depth int, fn func(partHeader, io.Reader) bool) bool {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fn(header, body)
+	}
+	if depth >= maxMultipartDepth {
+		return true
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return true
+		}
+		if !walkParts(part.Header, part, depth+1, fn) {
+			return false
+		}
+	}
+}
+
+// readAttachment decodes a part if it is an attachment, or an inline part
+// other than a text body
+func readAttachment(header partHeader, body io.Reader) (*Attachment, []byte, bool) {
+	mediaType, typeParams, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = typeParams["name"]
+	}
+	contentID := strings.Trim(strings.TrimSpace(header.Get("Content-ID")), "<>")
+
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if disposition != "attachment" && filename == "" && (contentID == "" || isText) {
+		return nil, nil, false
+	}
+
+	// Multipart readers already decode quoted-printable parts
+	content, err := io.ReadAll(decodeTransfer(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil && len(content) == 0 {
+		return nil, nil, false
+	}
+
+	sum := sha256.Sum256(content)
+	return &Attachment{
+		Filename:    cleanFilename(decodeHeader(filename)),
+		ContentType: mediaType,
+		Size:        len(content),
+		ContentID:   contentID,
+		SHA256:      hex.EncodeToString(sum[:]),
+	}, content, true
+}
+
+// cleanFilename drops the directories of a file name
+func cleanFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	return strings.TrimSpace(filename)
+}
@@ -0,0 +1,189 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testEmail returns a nested multipart email with an inline image, a text
+// body in both formats and attachments in various encodings
+func testEmail() string {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	return strings.ReplaceAll(`From: Alice <alice@example.com>
+To: bob@example.com
+Subject: Report
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="mixed"
+
+--mixed
+Content-Type: multipart/alternative; boundary="alt"
+
+--alt
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Caf=C3=A9 au lait, the report is =
+attached.
+--alt
+Content-Type: multipart/related; boundary="rel"
+
+--rel
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+`+b64(`<p>Caf&eacute; <img src="cid:logo@example.com"></p>`)+`
+--rel
+Content-Type: image/png
+Content-Transfer-Encoding: base64
+Content-ID: <logo@example.com>
+Content-Disposition: inline
+
+`+b64("\x89PNG logo")+`
+--rel--
+--alt--
+--mixed
+Content-Type: application/pdf
+Content-Transfer-Encoding: base64
+Content-Disposition: attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf
+
+`+b64("%PDF-1.7 résumé")+`
+--mixed
+Content-Type: text/plain; name="=?UTF-8?B?`+b64("notes é.txt")+`?="
+Content-Transfer-Encoding: quoted-printable
+Content-Disposition: attachment
+
+caf=C3=A9
+--mixed
+Content-Type: text/csv
+Content-Disposition: inline; filename*0="quarterly-"; filename*1="figures.csv"
+
+a,b
+--mixed
+Content-Type: application/octet-stream
+Content-Disposition: attachment; filename="../../etc/passwd"
+
+root
+--mixed
+Content-Type: text/plain
+Content-Disposition: inline
+
+Signature, part of the body
+--mixed--
+`, "\n", "\r\n")
+}
+
+func TestAttachments(t *testing.T) {
+	raw := testEmail()
+
+	tests := []struct {
+		filename    string
+		contentType string
+		contentID   string
+		content     string
+	}{
+		// Inline parts referenced by content ID are listed without a name
+		{"", "image/png", "logo@example.com", "\x89PNG logo"},
+		// RFC 2231 encoded name
+		{"résumé.pdf", "application/pdf", "", "%PDF-1.7 résumé"},
+		// RFC 2047 encoded name, quoted-printable content
+		{"notes é.txt", "text/plain", "", "café"},
+		// Inline disposition with a name, in RFC 2231 continuations
+		{"quarterly-figures.csv", "text/csv", "", "a,b"},
+		// Directories are dropped from names
+		{"passwd", "application/octet-stream", "", "root"},
+	}
+
+	attachments := Attachments(raw)
+	if len(attachments) != len(tests) {
+		t.Fatalf("got %d attachments, want %d", len(attachments), len(tests))
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			sum := sha256.Sum256([]byte(tt.content))
+			want := Attachment{
+				Index:       i,
+				Filename:    tt.filename,
+				ContentType: tt.contentType,
+				Size:        len(tt.content),
+				ContentID:   tt.contentID,
+				SHA256:      hex.EncodeToString(sum[:]),
+			}
+			if *attachments[i] != want {
+				t.Errorf("got %+v, want %+v", *attachments[i], want)
+			}
+
+			attachment, content, err := AttachmentContent(raw, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *attachment != want || string(content) != tt.content {
+				t.Errorf("got %+v with %q", *attachment, content)
+			}
+		})
+	}
+
+	if _, _, err := AttachmentContent(raw, len(tests)); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("got %v, want ErrAttachmentNotFound", err)
+	}
+}
+
+func TestAttachmentByContentID(t *testing.T) {
+	// cid: references are resolved against the content IDs of the parts
+	var index = -1
+	for _, attachment := range Attachments(testEmail()) {
+		if attachment.ContentID == "logo@example.com" {
+			index = attachment.Index
+		}
+	}
+
+	attachment, content, err := AttachmentContent(testEmail(), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attachment.ContentType != "image/png" || string(content) != "\x89PNG logo" {
+		t.Errorf("got %+v with %q", *attachment, content)
+	}
+}
+
+// nested returns an email with an attachment nested in depth multiparts
+func nested(depth int) string {
+	var raw strings.Builder
+	for i := range depth {
+		fmt.Fprintf(&raw, "Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n", i, i)
+	}
+	raw.WriteString("Content-Disposition: attachment\r\n\r\nx\r\n")
+	for i := depth - 1; i >= 0; i-- {
+		fmt.Fprintf(&raw, "--b%d--\r\n", i)
+	}
+	return raw.String()
+}
+
+func TestAttachmentsEdgeCases(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want int
+	}{
+		{"plain text", "Subject: hi\r\n\r\nhello", 0},
+		{"not an email", "hello", 0},
+		{"text only multipart", "Content-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n--b\r\nContent-Type: text/html\r\n\r\n<p>hi</p>\r\n--b--\r\n", 0},
+		{"single part attachment", "Content-Type: application/pdf; name=a.pdf\r\n\r\n%PDF", 1},
+		{"deep", nested(maxMultipartDepth), 1},
+		{"too deep", nested(maxMultipartDepth + 1), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := len(Attachments(tt.raw)); got != tt.want {
+				t.Errorf("got %d attachments, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// internal/message/message.go
+package message
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Headers holds the decoded headers of an email
+type Headers struct {
+	From       string    // Address of the sender
+	FromName   string    // Display name of the sender
+	FromDomain string    // Domain of the sender address
+	To         []string  // Addresses of the recipients
+	Subject    string    // Subject with encoded words decoded
+	Date       time.Time // Date header, zero if missing or invalid
+}
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		// Only UTF-8, US-ASCII and ISO-8859-1 are supported natively,
+		// anything else is passed through rather than rejected
+		return input, nil
+	},
+}
+
+// decodeHeader decodes the RFC 2047 encoded words of a header value
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// ParseHeaders parses the headers of a raw email
+func ParseHeaders(raw string) (*Headers, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return parseHeaders(msg.Header), nil
+}
+
+func parseHeaders(header mail.Header) *Headers {
+	parser := &mail.AddressParser{WordDecoder: wordDecoder}
+
+	headers := &Headers{
+		Subject: decodeHeader(header.Get("Subject")),
+	}
+
+	if from, err := parser.Parse(header.Get("From")); err == nil {
+		headers.From = from.Address
+		headers.FromName = from.Name
+		if at := strings.LastIndex(from.Address, "@"); at >= 0 {
+			headers.FromDomain = strings.ToLower(from.Address[at+1:])
+		}
+	}
+
+	if to, err := parser.ParseList(header.Get("To")); err == nil {
+		for _, address := range to {
+			headers.To = append(headers.To, address.Address)
+		}
+	}
+
+	if date, err := header.Date(); err == nil {
+		headers.Date = date
+	}
+
+	return headers
+}
@@ -0,0 +1,156 @@
+// internal/message/mime.go
+package message
+
+import (
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Maximum nesting of multipart bodies walked, deeper parts are ignored
+	maxMultipartDepth = 10
+	// Maximum size of the text extracted from an email
+	maxTextSize = 256 << 10
+)
+
+var (
+	// Elements whose content is not text
+	invisibleElements = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlTags          = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaces            = regexp.MustCompile(`\s+`)
+)
+
+// HasAttachments tells whether an email has attachments, parts with an
+// attachment disposition or a file name
+func HasAttachments(raw string) bool {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return false
+	}
+	return hasAttachments(msg.Header.Get("Content-Type"), msg.Body, 0)
+}
+
+func hasAttachments(contentType string, body io.Reader, depth int) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || depth >= maxMultipartDepth {
+		return false
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return false
+		}
+
+		if isAttachment(part) {
+			return true
+		}
+		if hasAttachments(part.Header.Get("Content-Type"), part, depth+1) {
+			return true
+		}
+	}
+}
+
+// isAttachment tells whether a part is an attachment rather than a body
+func isAttachment(part *multipart.Part) bool {
+	disposition, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err == nil && (disposition == "attachment" || params["filename"] != "") {
+		return true
+	}
+
+	_, params, err = mime.ParseMediaType(part.Header.Get("Content-Type"))
+	return err == nil && params["name"] != ""
+}
+
+// TextBody returns the decoded text of an email: its text/plain parts, or
+// the text of its text/html parts if it has no plain text. Attachments are
+// left out.
+func TextBody(raw string) string {
+	text, htmlBody := Bodies(raw)
+	if text == "" {
+		return HTMLText(htmlBody)
+	}
+	return text
+}
+
+// Bodies returns the decoded text/plain and text/html parts of an email,
+// each joined by line breaks. Attachments are left out.
+func Bodies(raw string) (text, htmlBody string) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return "", ""
+	}
+
+	var plain, htmlParts []string
+	collectText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0, &plain, &htmlParts)
+	return strings.Join(plain, "\n"), strings.Join(htmlParts, "\n")
+}
+
+func collectText(contentType, encoding string, body io.Reader, depth int, plain, htmlParts *[]string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Bodies without a valid content type are plain text
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMultipartDepth {
+			return
+		}
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				return
+			}
+			if isAttachment(part) {
+				continue
+			}
+			// NextPart already decodes quoted-printable parts
+			collectText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part, depth+1, plain, htmlParts)
+		}
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(decodeTransfer(body, encoding), maxTextSize))
+	if err != nil && len(data) == 0 {
+		return
+	}
+
+	if mediaType == "text/html" {
+		*htmlParts = append(*htmlParts, string(data))
+		return
+	}
+	*plain = append(*plain, string(data))
+}
+
+// decodeTransfer decodes a body according to its Content-Transfer-Encoding
+func decodeTransfer(body io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// HTMLText returns the text of an HTML document, without markup
+func HTMLText(document string) string {
+	text := invisibleElements.ReplaceAllString(document, " ")
+	text = htmlTags.ReplaceAllString(text, " ")
+	text = html.UnescapeString(text)
+	return strings.TrimSpace(spaces.ReplaceAllString(text, " "))
+}
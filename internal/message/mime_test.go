@@ -0,0 +1,38 @@
+package message
+
+import "testing"
+
+func TestBodies(t *testing.T) {
+	// Nested alternatives, quoted-printable and base64 parts are decoded and
+	// attachments are left out
+	text, htmlBody := Bodies(testEmail())
+	if want := "Café au lait, the report is attached.\nSignature, part of the body"; text != want {
+		t.Errorf("got text %q, want %q", text, want)
+	}
+	if want := `<p>Caf&eacute; <img src="cid:logo@example.com"></p>`; htmlBody != want {
+		t.Errorf("got html %q, want %q", htmlBody, want)
+	}
+	if !HasAttachments(testEmail()) {
+		t.Error("attachments not found")
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"plain", "Subject: hi\r\n\r\nhello", "hello"},
+		{"base64", "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=", "hello"},
+		{"quoted-printable", "Content-Type: text/plain\r\nContent-Transfer-Encoding: Quoted-Printable\r\n\r\nh=C3=A9llo=\r\n world", "héllo world"},
+		{"html only", "Content-Type: text/html\r\n\r\n<style>p{}</style><p>Hi &amp; bye</p>", "Hi & bye"},
+		{"invalid content type", "Content-Type: ;;\r\n\r\nhello", "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TextBody(tt.raw); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+// internal/redis/events.go
+package redis
+
+import (
+	"context"
+)
+
+// Channel carrying the mailbox events between instances
+const eventsChannel = "events"
+
+// PublishEvent publishes an event to every instance subscribed to the events
+func (r *RedisStorage) PublishEvent(data []byte) error {
+	return r.Client.Publish(r.GetContext(), eventsChannel, data).Err()
+}
+
+// SubscribeEvents returns the events published by any instance until ctx is
+// done. The subscription is restored if the connection drops, events
+// published in the meantime are lost.
+func (r *RedisStorage) SubscribeEvents(ctx context.Context) <-chan []byte {
+	pubsub := r.Client.Subscribe(ctx, eventsChannel)
+	events := make(chan []byte, 256)
+
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				events <- []byte(message.Payload)
+			}
+		}
+	}()
+
+	return events
+}
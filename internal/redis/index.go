@@ -0,0 +1,189 @@
+// internal/redis/index.go
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Each mailbox keeps an index of its messages, a sorted set scored by a
+// sequence number increasing with each stored message. Clients resume from
+// the last sequence number they saw. Entries of expired messages are pruned
+// by SweepExpiredMessages, the index expires along with the last message.
+
+func indexKey(to string) string {
+	return fmt.Sprintf("index:%s", to)
+}
+
+func seqKey(to string) string {
+	return fmt.Sprintf("seq:%s", to)
+}
+
+// nextSeq returns the sequence number of the next message of a mailbox
+func (r *RedisStorage) nextSeq(to string) (int64, error) {
+	seq, err := r.Client.Incr(r.GetContext(), seqKey(to)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sequence number: %w", err)
+	}
+	return seq, nil
+}
+
+// indexMessage adds a message to the index of its mailbox
+func (r *RedisStorage) indexMessage(pipe redis.Pipeliner, to string, message *Message) {
+	pipe.ZAdd(r.GetContext(), indexKey(to), redis.Z{
+		Score:  float64(message.Seq),
+		Member: message.ID,
+	})
+	if r.EmailTTL > 0 {
+		pipe.Expire(r.GetContext(), indexKey(to), r.EmailTTL)
+		pipe.Expire(r.GetContext(), seqKey(to), r.EmailTTL)
+	}
+}
+
+// RetrieveMessagesSince returns the messages of a mailbox stored after the
+// sequence number seq, oldest first. A seq ahead of the mailbox, as left by
+// an index that expired in the meantime, returns all the messages.
+func (r *RedisStorage) RetrieveMessagesSince(to string, seq int64) ([]*Message, error) {
+	last, err := r.Client.Get(r.GetContext(), seqKey(to)).Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if seq > last {
+		seq = 0
+	}
+
+	ids, err := r.Client.ZRangeByScore(r.GetContext(), indexKey(to), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(seq, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		message, err := r.RetrieveMessage(to, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if message != nil {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages, nil
+}
+
+// Number of messages fetched at once by ScanSummaries
+const scanBatchSize = 100
+
+// ScanSummaries calls fn with the summaries of the messages of a mailbox in
+// index order, newest first if desc, starting after the sequence number after
+// or from the start if zero. It stops at the end of the index or when fn
+// returns false. Messages stored before the index existed are not scanned.
+func (r *RedisStorage) ScanSummaries(to string, after int64, desc bool, fn func(*MessageSummary) bool) error {
+	for {
+		var ids []redis.Z
+		var err error
+		if desc {
+			upper := "+inf"
+			if after > 0 {
+				upper = "(" + strconv.FormatInt(after, 10)
+			}
+			ids, err = r.Client.ZRevRangeByScoreWithScores(r.GetContext(), indexKey(to), &redis.ZRangeBy{
+				Min:   "-inf",
+				Max:   upper,
+				Count: scanBatchSize,
+			}).Result()
+		} else {
+			ids, err = r.Client.ZRangeByScoreWithScores(r.GetContext(), indexKey(to), &redis.ZRangeBy{
+				Min:   "(" + strconv.FormatInt(after, 10),
+				Max:   "+inf",
+				Count: scanBatchSize,
+			}).Result()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan mailbox index: %w", err)
+		}
+
+		metas := make([]*redis.MapStringStringCmd, len(ids))
+		_, err = r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				metas[i] = pipe.HGetAll(r.GetContext(), metaKey(to, id.Member.(string)))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get metadata: %w", err)
+		}
+
+		for i, id := range ids {
+			after = int64(id.Score)
+
+			// Expired, not swept yet
+			if len(metas[i].Val()) == 0 {
+				continue
+			}
+
+			message := &Message{ID: id.Member.(string)}
+			message.parseMeta(metas[i].Val())
+			r.openHeaders(message)
+			if !fn(message.Summary()) {
+				return nil
+			}
+		}
+
+		if len(ids) < scanBatchSize {
+			return nil
+		}
+	}
+}
+
+// SweepExpiredMessages removes the messages that expired from the mailbox
+// indexes, it returns their IDs by mailbox. Each expired message is only
+// returned once, even with several instances sweeping.
+func (r *RedisStorage) SweepExpiredMessages() (map[string][]string, error) {
+	expired := make(map[string][]string)
+
+	iter := r.Client.Scan(r.GetContext(), 0, "index:*", 0).Iterator()
+	for iter.Next(r.GetContext()) {
+		to := strings.TrimPrefix(iter.Val(), "index:")
+
+		ids, err := r.Client.ZRange(r.GetContext(), indexKey(to), 0, -1).Result()
+		if err != nil {
+			return expired, err
+		}
+
+		exists := make([]*redis.IntCmd, len(ids))
+		_, err = r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+			for i, id := range ids {
+				exists[i] = pipe.Exists(r.GetContext(), fmt.Sprintf("%s:%s", to, id))
+			}
+			return nil
+		})
+		if err != nil {
+			return expired, err
+		}
+
+		for i, id := range ids {
+			if exists[i].Val() > 0 {
+				continue
+			}
+
+			// Only the instance removing the entry reports it
+			removed, err := r.Client.ZRem(r.GetContext(), indexKey(to), id).Result()
+			if err != nil {
+				return expired, err
+			}
+			if removed > 0 {
+				expired[to] = append(expired[to], id)
+			}
+		}
+	}
+
+	return expired, iter.Err()
+}
@@ -0,0 +1,447 @@
+// internal/redis/message.go
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal"
+	"github.com/michelangelomo/ephimail/internal/extract"
+	"github.com/michelangelomo/ephimail/internal/message"
+	"github.com/redis/go-redis/v9"
+)
+
+// Message is a stored email along with its metadata
+type Message struct {
+	ID         string    `json:"id"`
+	Seq        int64     `json:"seq,omitempty"` // Position in the mailbox index, see RetrieveMessagesSince
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+	Size       int       `json:"size,omitempty"` // Size of the email as received
+	Encrypted  bool      `json:"encrypted"`
+	Algorithm  string    `json:"algorithm,omitempty"` // Encryption algorithm, see encryption.AlgorithmFor
+	Body       string    `json:"body,omitempty"`
+
+	// Parsed headers, not set for encrypted mail. Mailboxes keeping plaintext
+	// metadata get the domain of the sender and the subject encrypted on its
+	// own, so listings can be decrypted without the whole message, see
+	// Reservation.Metadata. Stored sealed with the master key if set.
+	From       string `json:"from,omitempty"`
+	FromDomain string `json:"from_domain,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+
+	// Whether the email has attachments, not set for encrypted mail
+	HasAttachments bool `json:"has_attachments"`
+
+	// Whether the message was read, see SetMessageRead
+	Read bool `json:"read"`
+
+	// Codes and links found in the message, not set for encrypted mail.
+	// Stored sealed as they grant access to accounts.
+	Extracted *extract.Result `json:"extracted,omitempty"`
+
+	// Attachments of the message, not set for encrypted mail
+	Attachments []*message.Attachment `json:"attachments,omitempty"`
+
+	// Set if the mailbox doesn't keep the reception time as plaintext
+	// metadata. ReceivedAt is still stored to order and expire messages, but
+	// left out of listings and API responses, see VisibleReceivedAt.
+	HideReceivedAt bool `json:"-"`
+
+	// Set if metadata was stored along with the message
+	hasMeta bool
+}
+
+// VisibleReceivedAt returns the reception time shown to clients, zero if it
+// is hidden
+func (m *Message) VisibleReceivedAt() time.Time {
+	if m.HideReceivedAt {
+		return time.Time{}
+	}
+	return m.ReceivedAt
+}
+
+// MarshalJSON encodes the message as shown to clients
+func (m Message) MarshalJSON() ([]byte, error) {
+	type message Message
+	visible := message(m)
+	visible.ReceivedAt = m.VisibleReceivedAt()
+	return json.Marshal(visible)
+}
+
+// MessageSummary is the part of a message shown in listings and events
+type MessageSummary struct {
+	ID         string    `json:"id"`
+	Seq        int64     `json:"seq,omitempty"`
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+	Size       int       `json:"size,omitempty"`
+	Encrypted  bool      `json:"encrypted"`
+	From       string    `json:"from,omitempty"`
+	FromDomain string    `json:"from_domain,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+
+	HasAttachments bool `json:"has_attachments"`
+	Read           bool `json:"read"`
+}
+
+// Summary returns the summary of the message
+func (m *Message) Summary() *MessageSummary {
+	return &MessageSummary{
+		ID:         m.ID,
+		Seq:        m.Seq,
+		ReceivedAt: m.VisibleReceivedAt(),
+		Size:       m.Size,
+		Encrypted:  m.Encrypted,
+		From:       m.From,
+		FromDomain: m.FromDomain,
+		Subject:    m.Subject,
+
+		HasAttachments: m.HasAttachments,
+		Read:           m.Read,
+	}
+}
+
+// metaFields returns the metadata of the message as stored in redis
+func (m *Message) metaFields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"size":      m.Size,
+		"encrypted": m.Encrypted,
+		"algorithm": m.Algorithm,
+	}
+	if !m.ReceivedAt.IsZero() {
+		fields["received_at"] = m.ReceivedAt.UnixMilli()
+	}
+	if m.HideReceivedAt {
+		fields["hide_received_at"] = true
+	}
+	if m.Seq > 0 {
+		fields["seq"] = m.Seq
+	}
+	if m.From != "" {
+		fields["from"] = m.From
+	}
+	if m.Subject != "" {
+		fields["subject"] = m.Subject
+	}
+	if m.FromDomain != "" {
+		fields["from_domain"] = m.FromDomain
+	}
+	if m.HasAttachments {
+		fields["has_attachments"] = true
+	}
+	if m.Read {
+		fields["read"] = true
+	}
+	return fields
+}
+
+// parseMeta fills the message metadata from the stored fields
+func (m *Message) parseMeta(data map[string]string) {
+	m.hasMeta = len(data) > 0
+	if receivedAt, err := strconv.ParseInt(data["received_at"], 10, 64); err == nil {
+		m.ReceivedAt = time.UnixMilli(receivedAt)
+	}
+	m.HideReceivedAt = data["hide_received_at"] == "1"
+	m.Seq, _ = strconv.ParseInt(data["seq"], 10, 64)
+	m.Size, _ = strconv.Atoi(data["size"])
+	m.Encrypted = data["encrypted"] == "1" || data["encrypted"] == "true"
+	m.Algorithm = data["algorithm"]
+	m.From = data["from"]
+	m.Subject = data["subject"]
+	m.FromDomain = data["from_domain"]
+	m.HasAttachments = data["has_attachments"] == "1"
+	m.Read = data["read"] == "1"
+}
+
+// Metadata stored sealed, as it reveals the content of messages
+var sealedMetaFields = []string{"extracted", "attachments"}
+
+// Headers stored sealed, they are opened along with the summary of messages
+var sealedHeaderFields = []string{"from", "subject", "from_domain"}
+
+// storedMetaFields returns the metadata of a message as stored in redis,
+// with its headers sealed
+func (r *RedisStorage) storedMetaFields(message *Message) (map[string]interface{}, error) {
+	fields := message.metaFields()
+	for _, field := range sealedHeaderFields {
+		value, ok := fields[field].(string)
+		if !ok {
+			continue
+		}
+
+		sealed, err := r.sealEmail(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = sealed
+	}
+	return fields, nil
+}
+
+// openHeaders decodes the sealed headers of a message, headers stored in
+// clear are left as they are
+func (r *RedisStorage) openHeaders(message *Message) {
+	for _, header := range []*string{&message.From, &message.Subject, &message.FromDomain} {
+		opened, err := r.openEmail(*header)
+		if err != nil {
+			log.Printf("can't open headers of message %s: %v", message.ID, err)
+			opened = ""
+		}
+		*header = opened
+	}
+}
+
+// sealMeta encodes metadata as stored in redis
+func (r *RedisStorage) sealMeta(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return r.sealEmail(string(data))
+}
+
+// openSealedMeta decodes the sealed metadata of a message, fields stored
+// before they existed are left as they are
+func (r *RedisStorage) openSealedMeta(message *Message, data map[string]string) {
+	fields := map[string]interface{}{
+		"extracted":   &message.Extracted,
+		"attachments": &message.Attachments,
+	}
+	for _, field := range sealedMetaFields {
+		if data[field] == "" {
+			continue
+		}
+
+		opened, err := r.openEmail(data[field])
+		if err == nil {
+			err = json.Unmarshal([]byte(opened), fields[field])
+		}
+		if err != nil {
+			log.Printf("can't open %s of message %s: %v", field, message.ID, err)
+		}
+	}
+}
+
+func metaKey(to, id string) string {
+	return fmt.Sprintf("meta:%s:%s", to, id)
+}
+
+// StoreMessage stores an email with its metadata and the configured TTL, it
+// returns the ID of the message. Metadata left empty is not stored.
+func (r *RedisStorage) StoreMessage(to string, message *Message) (string, error) {
+	message.ID = internal.GenerateHash(
+		message.Body,
+		time.Now().String(),
+	)
+
+	body, err := r.sealEmail(message.Body)
+	if err != nil {
+		return "", err
+	}
+
+	message.Seq, err = r.nextSeq(to)
+	if err != nil {
+		return "", err
+	}
+
+	fields, err := r.storedMetaFields(message)
+	if err != nil {
+		return "", err
+	}
+	if message.Extracted != nil {
+		if fields["extracted"], err = r.sealMeta(message.Extracted); err != nil {
+			return "", err
+		}
+	}
+	if message.Attachments != nil {
+		if fields["attachments"], err = r.sealMeta(message.Attachments); err != nil {
+			return "", err
+		}
+	}
+
+	// Keep metadata and body together, both expire with the configured TTL
+	_, err = r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.Set(r.GetContext(), fmt.Sprintf("%s:%s", to, message.ID), body, r.EmailTTL)
+		pipe.HSet(r.GetContext(), metaKey(to, message.ID), fields)
+		if r.EmailTTL > 0 {
+			pipe.Expire(r.GetContext(), metaKey(to, message.ID), r.EmailTTL)
+		}
+		r.indexMessage(pipe, to, message)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return message.ID, nil
+}
+
+// UpdateMessage replaces the body and metadata of a stored message, keeping
+// its TTL. Messages that expired in the meantime are not recreated.
+func (r *RedisStorage) UpdateMessage(to string, message *Message) error {
+	key := fmt.Sprintf("%s:%s", to, message.ID)
+
+	body, err := r.sealEmail(message.Body)
+	if err != nil {
+		return err
+	}
+
+	ttl, err := r.Client.PTTL(r.GetContext(), key).Result()
+	if err != nil {
+		return err
+	}
+
+	err = r.Client.SetArgs(r.GetContext(), key, body, redis.SetArgs{
+		Mode:    "XX",
+		KeepTTL: true,
+	}).Err()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fields, err := r.storedMetaFields(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.GetContext(), metaKey(to, message.ID), fields)
+		if ttl > 0 {
+			pipe.PExpire(r.GetContext(), metaKey(to, message.ID), ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// RetrieveMessage returns a single message of a mailbox by its ID, or nil if
+// it doesn't exist or has expired
+func (r *RedisStorage) RetrieveMessage(to, id string) (*Message, error) {
+	body, err := r.RetrieveEmail(to, id)
+	if err != nil || body == "" {
+		return nil, err
+	}
+
+	data, err := r.Client.HGetAll(r.GetContext(), metaKey(to, id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{ID: id, Body: body}
+	message.parseMeta(data)
+	r.openHeaders(message)
+	r.openSealedMeta(message, data)
+	return message, nil
+}
+
+// Sets a field of the metadata of a message, unless the message expired
+var setMetaScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// SetMessageRead marks a message of a mailbox as read or unread, it reports
+// whether the message exists
+func (r *RedisStorage) SetMessageRead(to, id string, read bool) (bool, error) {
+	value := "0"
+	if read {
+		value = "1"
+	}
+
+	set, err := setMetaScript.Run(r.GetContext(), r.Client, []string{metaKey(to, id)}, "read", value).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to update message: %w", err)
+	}
+	return set == 1, nil
+}
+
+// DeleteMessage deletes a message of a mailbox, it reports whether the
+// message existed
+func (r *RedisStorage) DeleteMessage(to, id string) (bool, error) {
+	var deleted *redis.IntCmd
+	_, err := r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(r.GetContext(), fmt.Sprintf("%s:%s", to, id))
+		pipe.Del(r.GetContext(), metaKey(to, id))
+		pipe.ZRem(r.GetContext(), indexKey(to), id)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to delete message: %w", err)
+	}
+	return deleted.Val() > 0, nil
+}
+
+// ClearMailbox deletes all the messages listed by the index of a mailbox, it
+// returns the number of deleted messages
+func (r *RedisStorage) ClearMailbox(to string) (int, error) {
+	ids, err := r.Client.ZRange(r.GetContext(), indexKey(to), 0, -1).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear mailbox: %w", err)
+	}
+
+	var deleted *redis.IntCmd
+	_, err = r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		if len(ids) > 0 {
+			bodies := make([]string, len(ids))
+			metas := make([]string, len(ids))
+			for i, id := range ids {
+				bodies[i] = fmt.Sprintf("%s:%s", to, id)
+				metas[i] = metaKey(to, id)
+			}
+			deleted = pipe.Del(r.GetContext(), bodies...)
+			pipe.Del(r.GetContext(), metas...)
+		}
+		pipe.Del(r.GetContext(), indexKey(to))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear mailbox: %w", err)
+	}
+
+	if deleted == nil {
+		return 0, nil
+	}
+	return int(deleted.Val()), nil
+}
+
+// RetrieveMessages returns all the messages of a mailbox, newest first.
+// Messages stored before metadata existed have no receive time.
+func (r *RedisStorage) RetrieveMessages(to string) ([]*Message, error) {
+	emails, err := r.RetrieveEmails(to)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*Message, 0, len(emails))
+	for key, body := range emails {
+		message := &Message{
+			ID:   strings.TrimPrefix(key, to+":"),
+			Body: body,
+		}
+
+		data, err := r.Client.HGetAll(r.GetContext(), metaKey(to, message.ID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		message.parseMeta(data)
+		r.openSealedMeta(message, data)
+
+		messages = append(messages, message)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ReceivedAt.After(messages[j].ReceivedAt)
+	})
+
+	return messages, nil
+}
@@ -0,0 +1,105 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSealedMetadata(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	storage.Keyring = newTestKeyring(t, 1)
+
+	const to = "alice@example.com"
+	message := &Message{
+		Body:       "Subject: Secret plans\r\n\r\nhello",
+		ReceivedAt: time.Now(),
+		From:       "bob@secret.example",
+		FromDomain: "secret.example",
+		Subject:    "Secret plans",
+	}
+	id, err := storage.StoreMessage(to, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rawValues returns everything stored for the message
+	rawValues := func() []string {
+		values := []string{}
+		if body, err := mr.Get(to + ":" + id); err == nil {
+			values = append(values, body)
+		}
+		fields, _ := mr.HKeys(metaKey(to, id))
+		for _, field := range fields {
+			values = append(values, mr.HGet(metaKey(to, id), field))
+		}
+		return values
+	}
+
+	// checkOpened checks that the headers read back in clear
+	checkOpened := func(stage string) {
+		t.Helper()
+
+		stored, err := storage.RetrieveMessage(to, id)
+		if err != nil || stored == nil {
+			t.Fatalf("%s: got %v, %v", stage, stored, err)
+		}
+		var summary *MessageSummary
+		err = storage.ScanSummaries(to, 0, false, func(s *MessageSummary) bool {
+			summary = s
+			return false
+		})
+		if err != nil || summary == nil {
+			t.Fatalf("%s: got summary %v, %v", stage, summary, err)
+		}
+
+		for _, got := range []*Message{stored, {From: summary.From, FromDomain: summary.FromDomain, Subject: summary.Subject}} {
+			if got.From != message.From || got.FromDomain != message.FromDomain || got.Subject != message.Subject {
+				t.Errorf("%s: got from %q, domain %q, subject %q", stage, got.From, got.FromDomain, got.Subject)
+			}
+		}
+	}
+
+	checkSealed := func(stage string) {
+		t.Helper()
+
+		for _, value := range rawValues() {
+			if strings.Contains(strings.ToLower(value), "secret") {
+				t.Errorf("%s: stored in clear: %q", stage, value)
+			}
+		}
+	}
+
+	checkSealed("stored")
+	checkOpened("stored")
+
+	message.Read = true
+	if err := storage.UpdateMessage(to, message); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed("updated")
+	checkOpened("updated")
+
+	// Headers are rewrapped along with the rest
+	storage.Keyring = newTestKeyring(t, 2, 1)
+	if _, err := storage.RewrapEmails(); err != nil {
+		t.Fatal(err)
+	}
+	storage.Keyring = newTestKeyring(t, 2)
+	checkSealed("rotated")
+	checkOpened("rotated")
+
+	// Messages stored without a master key read as they are
+	storage.Keyring = nil
+	id, err = storage.StoreMessage(to, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := mr.HGet(metaKey(to, id), "from"); from != message.From {
+		t.Errorf("got from %q without a master key", from)
+	}
+	storage.Keyring = newTestKeyring(t, 2)
+	if stored, err := storage.RetrieveMessage(to, id); err != nil || stored.From != message.From {
+		t.Errorf("got %v, %v", stored, err)
+	}
+}
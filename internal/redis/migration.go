@@ -0,0 +1,75 @@
+// internal/redis/migration.go
+package redis
+
+import (
+	"fmt"
+
+	"github.com/michelangelomo/ephimail/internal/encryption"
+)
+
+// MigrateEnvelopes wraps the ciphertexts stored before envelopes existed and
+// records their encrypted flag in the message metadata. Only mailboxes with an
+// active reservation for an RSA key are migrated, as legacy ciphertexts were
+// encrypted with RSA-OAEP and are assumed to be for the current public key.
+// Messages that can't be told apart from mail delivered in clear are left as
+// they are. It returns the number of migrated messages.
+func (r *RedisStorage) MigrateEnvelopes() (int, error) {
+	reservations, err := r.ListReservations()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, reservation := range reservations {
+		if !reservation.Encrypted || reservation.PassphraseProtected || reservation.KeyType != encryption.KeyTypeRSA {
+			continue
+		}
+
+		messages, err := r.RetrieveMessages(reservation.Email)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to get emails of %s: %w", reservation.Email, err)
+		}
+
+		for _, message := range messages {
+			// Messages with metadata are already up to date
+			if message.hasMeta {
+				continue
+			}
+
+			if !migrateMessage(reservation, message) {
+				continue
+			}
+
+			if err := r.UpdateMessage(reservation.Email, message); err != nil {
+				return migrated, fmt.Errorf("failed to migrate %s:%s: %w", reservation.Email, message.ID, err)
+			}
+			migrated++
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateMessage wraps a legacy message of an RSA mailbox in an envelope and
+// fills its metadata, it reports whether the message changed
+func migrateMessage(reservation *Reservation, message *Message) bool {
+	if envelope, err := encryption.ParseEnvelope(message.Body); err == nil {
+		message.Size = len(message.Body)
+		message.Encrypted = true
+		message.Algorithm = envelope.Algorithm
+		return true
+	}
+
+	// Anything else than a ciphertext the size of the modulus may have been
+	// delivered in clear
+	envelope, err := encryption.LegacyEnvelope(message.Body, reservation.PublicKey)
+	if err != nil {
+		return false
+	}
+
+	message.Size = len(message.Body)
+	message.Body = envelope.String()
+	message.Encrypted = true
+	message.Algorithm = envelope.Algorithm
+	return true
+}
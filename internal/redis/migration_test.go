@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+
+	"github.com/michelangelomo/ephimail/internal/encryption"
+)
+
+func TestMigrateEnvelopes(t *testing.T) {
+	storage, mr := newTestStorage(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicKey := base64.StdEncoding.EncodeToString(der)
+
+	x25519Key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519PublicKey := base64.StdEncoding.EncodeToString(x25519Key.PublicKey().Bytes())
+
+	sealed, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &rsaKey.PublicKey, []byte("Subject: legacy\r\n\r\nhello\r\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := base64.StdEncoding.EncodeToString(sealed)
+	envelope, err := encryption.EncryptEmail("Subject: new\r\n\r\nhello\r\n", rsaPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reservation := range []struct {
+		email, publicKey, keyType string
+	}{
+		{"rsa@example.com", rsaPublicKey, encryption.KeyTypeRSA},
+		{"x25519@example.com", x25519PublicKey, encryption.KeyTypeX25519},
+	} {
+		if _, err := storage.ReserveMailbox(reservation.email, OneHour, reservation.publicKey, reservation.keyType, nil, "token", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages stored before envelopes, without metadata
+	bodies := map[string]string{
+		"rsa@example.com:legacy":       legacy,
+		"rsa@example.com:envelope":     envelope,
+		"rsa@example.com:clear":        "Subject: clear\r\n\r\nhello\r\n",
+		"rsa@example.com:base64":       base64.StdEncoding.EncodeToString([]byte("a clear mail that happens to be base64")),
+		"rsa@example.com:short":        legacy[:len(legacy)-8],
+		"x25519@example.com:legacy":    legacy,
+		"x25519@example.com:truncated": base64.StdEncoding.EncodeToString(make([]byte, 64)),
+	}
+	for key, body := range bodies {
+		mr.Set(key, body)
+	}
+
+	migrated, err := storage.MigrateEnvelopes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 {
+		t.Errorf("migrated %d messages, want 2", migrated)
+	}
+
+	message, err := storage.RetrieveMessage("rsa@example.com", "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := encryption.ParseEnvelope(message.Body)
+	if err != nil || !message.Encrypted || parsed.Algorithm != encryption.AlgRSAOAEP || parsed.Ciphertext != legacy {
+		t.Errorf("legacy message not wrapped: %+v %v", message, err)
+	}
+
+	message, err = storage.RetrieveMessage("rsa@example.com", "envelope")
+	if err != nil || message.Body != envelope || !message.Encrypted || message.Algorithm != encryption.AlgRSAOAEPAESGCM {
+		t.Errorf("envelope not recorded: %+v %v", message, err)
+	}
+
+	// Everything else is left as it was
+	for _, key := range []string{"rsa@example.com:clear", "rsa@example.com:base64", "rsa@example.com:short", "x25519@example.com:legacy", "x25519@example.com:truncated"} {
+		if body, _ := mr.Get(key); body != bodies[key] {
+			t.Errorf("%s changed to %q", key, body)
+		}
+		if mr.Exists("meta:" + key) {
+			t.Errorf("%s got metadata", key)
+		}
+	}
+}
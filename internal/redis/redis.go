@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/michelangelomo/ephimail/internal/encryption"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -14,6 +15,9 @@ type RedisStorage struct {
 	Client   *redis.Client
 	EmailTTL time.Duration
 
+	// Encrypts stored mail at rest when set
+	Keyring *encryption.Keyring
+
 	context context.Context
 }
 
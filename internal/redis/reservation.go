@@ -2,9 +2,16 @@
 package redis
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/michelangelomo/ephimail/internal"
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/redis/go-redis/v9"
 )
 
 // ReservationDuration represents the possible durations for mailbox reservation
@@ -16,26 +23,91 @@ const (
 	OneWeek ReservationDuration = "168h"
 )
 
+// Envelope metadata that E2E encrypted mailboxes can keep in plaintext
+const (
+	MetadataReceivedAt = "received_at"
+	MetadataSize       = "size"
+	MetadataFromDomain = "from_domain"
+)
+
+// ErrMailboxReserved is returned when reserving a mailbox that is already reserved
+var ErrMailboxReserved = errors.New("mailbox is already reserved")
+
+// Creates a reservation hash along with its expiry, unless the mailbox is
+// already reserved, so that concurrent reservations can't overwrite each other
+var createReservationScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], unpack(ARGV, 2))
+redis.call("EXPIREAT", KEYS[1], ARGV[1])
+return 1
+`)
+
+// MetadataFields lists the metadata that can be kept in plaintext
+var MetadataFields = []string{MetadataReceivedAt, MetadataSize, MetadataFromDomain}
+
 // Reservation represents a mailbox reservation
 type Reservation struct {
-	Email     string    `json:"email"`
-	ExpiresAt time.Time `json:"expires_at"`
-	PublicKey string    `json:"public_key,omitempty"` // Optional for E2E encryption
-	Encrypted bool      `json:"encrypted"`
+	Email      string    `json:"email"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	ReservedAt time.Time `json:"reserved_at"`
+	PublicKey  string    `json:"public_key,omitempty"` // Optional for E2E encryption
+	KeyType    string    `json:"key_type,omitempty"`   // Type of PublicKey, see encryption.DetectKeyType
+	Encrypted  bool      `json:"encrypted"`
+
+	// Metadata kept in plaintext for E2E encrypted mail, if set the subject
+	// and the message are encrypted separately
+	Metadata []string `json:"metadata,omitempty"`
+
+	// Hash of the secret token handed to the owner, the token itself is never stored
+	OwnerTokenHash string `json:"-"`
+
+	// Set for mailboxes encrypted at rest with a passphrase instead of a client key
+	PassphraseProtected bool                      `json:"passphrase_protected"`
+	PassphraseKey       *encryption.PassphraseKey `json:"-"`
 }
 
-// ReserveMailbox reserves a mailbox for a specific duration
-func (r *RedisStorage) ReserveMailbox(email string, duration ReservationDuration, publicKey string) (*Reservation, error) {
-	// Check if mailbox is already reserved
-	exists, err := r.IsMailboxReserved(email)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check reservation: %w", err)
+// KeepsMetadata checks whether field is kept in plaintext for encrypted mail
+func (r *Reservation) KeepsMetadata(field string) bool {
+	for _, f := range r.Metadata {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Fingerprint returns the fingerprint of the public key, or an empty
+// string if the mailbox isn't encrypted with one
+func (r *Reservation) Fingerprint() string {
+	if r.PublicKey == "" {
+		return ""
 	}
+	return encryption.Fingerprint(r.PublicKey)
+}
 
-	if exists {
-		return nil, fmt.Errorf("mailbox %s is already reserved", email)
+// SetOwnerToken replaces the owner token of the reservation
+func (r *Reservation) SetOwnerToken(token string) {
+	r.OwnerTokenHash = internal.GenerateHash(token)
+}
+
+// VerifyOwnerToken checks whether token is the owner token of the reservation
+func (r *Reservation) VerifyOwnerToken(token string) bool {
+	if token == "" || r.OwnerTokenHash == "" {
+		return false
 	}
+	return subtle.ConstantTimeCompare(
+		[]byte(internal.GenerateHash(token)),
+		[]byte(r.OwnerTokenHash),
+	) == 1
+}
 
+// ReserveMailbox reserves a mailbox for a specific duration.
+// Mail is encrypted with publicKey of keyType if set, keeping metadata in
+// plaintext, or at rest with passphraseKey if set.
+// It returns ErrMailboxReserved if the mailbox is already reserved.
+func (r *RedisStorage) ReserveMailbox(email string, duration ReservationDuration, publicKey, keyType string, metadata []string, ownerToken string, passphraseKey *encryption.PassphraseKey) (*Reservation, error) {
 	// Parse duration
 	parsedDuration, err := time.ParseDuration(string(duration))
 	if err != nil {
@@ -43,38 +115,91 @@ func (r *RedisStorage) ReserveMailbox(email string, duration ReservationDuration
 	}
 
 	// Create reservation
-	expiresAt := time.Now().Add(parsedDuration)
+	now := time.Now()
 	reservation := &Reservation{
-		Email:     email,
-		ExpiresAt: expiresAt,
-		PublicKey: publicKey,
-		Encrypted: publicKey != "",
+		Email:               email,
+		ExpiresAt:           now.Add(parsedDuration),
+		ReservedAt:          now,
+		PublicKey:           publicKey,
+		KeyType:             keyType,
+		Encrypted:           publicKey != "",
+		Metadata:            metadata,
+		PassphraseProtected: passphraseKey != nil,
+		PassphraseKey:       passphraseKey,
 	}
+	reservation.SetOwnerToken(ownerToken)
 
-	// Store reservation in Redis
-	key := fmt.Sprintf("reservation:%s", email)
-	err = r.Client.HSet(
-		r.GetContext(),
-		key,
-		map[string]interface{}{
-			"email":      reservation.Email,
-			"expires_at": reservation.ExpiresAt.Unix(),
-			"public_key": reservation.PublicKey,
-			"encrypted":  reservation.Encrypted,
-		},
-	).Err()
+	args := []interface{}{reservation.ExpiresAt.Unix()}
+	for field, value := range reservation.fields() {
+		args = append(args, field, value)
+	}
 
+	created, err := createReservationScript.Run(r.GetContext(), r.Client, []string{fmt.Sprintf("reservation:%s", email)}, args...).Int()
 	if err != nil {
 		return nil, fmt.Errorf("failed to save reservation: %w", err)
 	}
+	if created == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMailboxReserved, email)
+	}
+
+	return reservation, nil
+}
+
+// fields returns the fields of the reservation hash
+func (r *Reservation) fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"email":       r.Email,
+		"expires_at":  r.ExpiresAt.Unix(),
+		"created_at":  r.ReservedAt.Unix(),
+		"public_key":  r.PublicKey,
+		"key_type":    r.KeyType,
+		"encrypted":   r.Encrypted,
+		"owner_token": r.OwnerTokenHash,
+		"passphrase":  r.PassphraseProtected,
+		"metadata":    strings.Join(r.Metadata, ","),
+	}
+
+	if r.PassphraseKey != nil {
+		fields["passphrase_public_key"] = r.PassphraseKey.PublicKey
+		fields["passphrase_salt"] = r.PassphraseKey.Salt
+		fields["passphrase_wrapped_key"] = r.PassphraseKey.WrappedKey
+	}
+
+	return fields
+}
+
+// SaveReservation stores a reservation, the key expires along with it
+func (r *RedisStorage) SaveReservation(reservation *Reservation) error {
+	key := fmt.Sprintf("reservation:%s", reservation.Email)
+	err := r.Client.HSet(r.GetContext(), key, reservation.fields()).Err()
+
+	if err != nil {
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
 
 	// Set expiration for the reservation
-	err = r.Client.Expire(r.GetContext(), key, parsedDuration).Err()
+	err = r.Client.ExpireAt(r.GetContext(), key, reservation.ExpiresAt).Err()
 	if err != nil {
-		return nil, fmt.Errorf("failed to set expiration: %w", err)
+		return fmt.Errorf("failed to set expiration: %w", err)
 	}
 
-	return reservation, nil
+	return nil
+}
+
+// ListReservations returns all the active reservations
+func (r *RedisStorage) ListReservations() ([]*Reservation, error) {
+	var reservations []*Reservation
+
+	iter := r.Client.Scan(r.GetContext(), 0, "reservation:*", 0).Iterator()
+	for iter.Next(r.GetContext()) {
+		reservation, err := r.GetReservation(strings.TrimPrefix(iter.Val(), "reservation:"))
+		if err != nil || reservation == nil {
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, iter.Err()
 }
 
 // IsMailboxReserved checks if a mailbox is reserved
@@ -106,10 +231,34 @@ func (r *RedisStorage) GetReservation(email string) (*Reservation, error) {
 	}
 
 	reservation := &Reservation{
-		Email:     data["email"],
-		ExpiresAt: time.Unix(expiresAtUnix, 0),
-		PublicKey: data["public_key"],
-		Encrypted: data["encrypted"] == "1" || data["encrypted"] == "true",
+		Email:          data["email"],
+		ExpiresAt:      time.Unix(expiresAtUnix, 0),
+		PublicKey:      data["public_key"],
+		KeyType:        data["key_type"],
+		Encrypted:      data["encrypted"] == "1" || data["encrypted"] == "true",
+		OwnerTokenHash: data["owner_token"],
+	}
+
+	// Reservations made before key types were recorded only had RSA keys
+	if reservation.PublicKey != "" && reservation.KeyType == "" {
+		reservation.KeyType = encryption.KeyTypeRSA
+	}
+
+	if data["metadata"] != "" {
+		reservation.Metadata = strings.Split(data["metadata"], ",")
+	}
+
+	if createdAtUnix, err := strconv.ParseInt(data["created_at"], 10, 64); err == nil {
+		reservation.ReservedAt = time.Unix(createdAtUnix, 0)
+	}
+
+	if data["passphrase"] == "1" || data["passphrase"] == "true" {
+		reservation.PassphraseProtected = true
+		reservation.PassphraseKey = &encryption.PassphraseKey{
+			PublicKey:  data["passphrase_public_key"],
+			Salt:       data["passphrase_salt"],
+			WrappedKey: data["passphrase_wrapped_key"],
+		}
 	}
 
 	return reservation, nil
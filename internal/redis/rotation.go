@@ -0,0 +1,95 @@
+// internal/redis/rotation.go
+package redis
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/redis/go-redis/v9"
+)
+
+// RewrapEmails wraps the data keys of all the sealed emails, of the data
+// extracted from them and of webhook payloads, with the primary master key of
+// the keyring, and rebuilds the search index under its blind index. Message
+// ciphertexts and TTLs are left untouched, so it can run while the servers
+// keep serving with both master keys loaded. It returns the number of
+// rewrapped emails.
+func (r *RedisStorage) RewrapEmails() (int, error) {
+	if r.Keyring == nil {
+		return 0, fmt.Errorf("no master key configured")
+	}
+
+	rewrapped := 0
+	iter := r.Client.ScanType(r.GetContext(), 0, "*", 0, "string").Iterator()
+	for iter.Next(r.GetContext()) {
+		key := iter.Val()
+
+		body, err := r.Client.Get(r.GetContext(), key).Result()
+		if err != nil || !encryption.IsSealed(body) {
+			continue
+		}
+
+		blob, changed, err := r.Keyring.Rewrap(body)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to rewrap %s: %w", key, err)
+		}
+		if !changed {
+			continue
+		}
+
+		// Only overwrite emails that didn't expire in the meantime
+		err = r.Client.SetArgs(r.GetContext(), key, blob, redis.SetArgs{
+			Mode:    "XX",
+			KeepTTL: true,
+		}).Err()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to store %s: %w", key, err)
+		}
+		rewrapped++
+	}
+	if err := iter.Err(); err != nil {
+		return rewrapped, err
+	}
+
+	if err := r.rewrapHashFields("meta:*", slices.Concat(sealedMetaFields, sealedHeaderFields)); err != nil {
+		return rewrapped, err
+	}
+	if err := r.rewrapHashFields("webhook:delivery:*", []string{"payload"}); err != nil {
+		return rewrapped, err
+	}
+	return rewrapped, NewSearchIndex(r).reindex()
+}
+
+// rewrapHashFields wraps the data keys of the sealed fields of the hashes
+// matching pattern with the primary master key
+func (r *RedisStorage) rewrapHashFields(pattern string, fields []string) error {
+	iter := r.Client.ScanType(r.GetContext(), 0, pattern, 0, "hash").Iterator()
+	for iter.Next(r.GetContext()) {
+		key := iter.Val()
+
+		for _, field := range fields {
+			stored, err := r.Client.HGet(r.GetContext(), key, field).Result()
+			if err != nil || !encryption.IsSealed(stored) {
+				continue
+			}
+
+			blob, changed, err := r.Keyring.Rewrap(stored)
+			if err != nil {
+				return fmt.Errorf("failed to rewrap %s %s: %w", key, field, err)
+			}
+			if !changed {
+				continue
+			}
+
+			if err := setMetaScript.Run(r.GetContext(), r.Client, []string{key}, field, blob).Err(); err != nil {
+				return fmt.Errorf("failed to store %s %s: %w", key, field, err)
+			}
+		}
+	}
+
+	return iter.Err()
+}
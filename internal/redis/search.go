@@ -0,0 +1,279 @@
+// internal/redis/search.go
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal/search"
+	"github.com/redis/go-redis/v9"
+)
+
+// The search index of a mailbox is made of a set of message IDs per term and
+// of the tokens of each message, used to check phrases and fields. Both
+// expire along with the messages. Term sets are refreshed by each new message
+// and may keep the IDs of expired messages, which are pruned by searches.
+// The keys of a mailbox are listed in a set, to clear them without a SCAN.
+// With a master key configured, terms are blinded and tokens sealed.
+
+func searchDocKey(to, id string) string {
+	return fmt.Sprintf("search:%s:doc:%s", to, id)
+}
+
+func searchTermKey(to, term string) string {
+	return fmt.Sprintf("search:%s:term:%s", to, term)
+}
+
+func searchKeysKey(to string) string {
+	return fmt.Sprintf("search:%s:keys", to)
+}
+
+// SearchIndex is a search.Index stored in redis, shared by all the instances
+type SearchIndex struct {
+	storage *RedisStorage
+}
+
+// NewSearchIndex creates a search index stored along with the messages
+func NewSearchIndex(storage *RedisStorage) *SearchIndex {
+	return &SearchIndex{storage: storage}
+}
+
+// term returns the key of a term, blinded if a master key is configured
+func (s *SearchIndex) term(term string) string {
+	if s.storage.Keyring != nil {
+		return s.storage.Keyring.BlindIndex(term)
+	}
+	return term
+}
+
+// Add indexes a message of a mailbox
+func (s *SearchIndex) Add(to string, doc *search.Document) error {
+	r := s.storage
+	tokens := doc.Tokenize()
+
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("failed to encode search document: %w", err)
+	}
+	sealed, err := r.sealEmail(string(data))
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.Set(r.GetContext(), searchDocKey(to, doc.ID), sealed, r.EmailTTL)
+		keys := []interface{}{searchDocKey(to, doc.ID)}
+		for _, term := range tokens.Terms() {
+			key := searchTermKey(to, s.term(term))
+			pipe.SAdd(r.GetContext(), key, doc.ID)
+			if r.EmailTTL > 0 {
+				pipe.Expire(r.GetContext(), key, r.EmailTTL)
+			}
+			keys = append(keys, key)
+		}
+		pipe.SAdd(r.GetContext(), searchKeysKey(to), keys...)
+		if r.EmailTTL > 0 {
+			pipe.Expire(r.GetContext(), searchKeysKey(to), r.EmailTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index message: %w", err)
+	}
+	return nil
+}
+
+// Search returns the IDs of the messages of a mailbox matching a query
+func (s *SearchIndex) Search(to string, query *search.Query) ([]string, error) {
+	r := s.storage
+
+	var keys []string
+	for _, term := range query.Terms() {
+		keys = append(keys, searchTermKey(to, s.term(term)))
+	}
+
+	candidates, err := r.Client.SInter(r.GetContext(), keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	docs := make([]*redis.StringCmd, len(candidates))
+	_, err = r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		for i, id := range candidates {
+			docs[i] = pipe.Get(r.GetContext(), searchDocKey(to, id))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to search: %w", err)
+	}
+
+	var ids, expired []string
+	for i, id := range candidates {
+		if docs[i].Err() == redis.Nil {
+			expired = append(expired, id)
+			continue
+		}
+
+		tokens, err := s.openTokens(docs[i].Val())
+		if err != nil {
+			log.Printf("can't open search document %s: %v", searchDocKey(to, id), err)
+			continue
+		}
+		if tokens.Matches(query) {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(expired) > 0 {
+		s.prune(keys, expired)
+	}
+
+	return ids, nil
+}
+
+// openTokens decodes the tokens of an indexed message
+func (s *SearchIndex) openTokens(data string) (search.Tokens, error) {
+	data, err := s.storage.openEmail(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens search.Tokens
+	if err := json.Unmarshal([]byte(data), &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// prune removes the IDs of expired messages from term sets
+func (s *SearchIndex) prune(keys, ids []string) {
+	r := s.storage
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+
+	_, err := r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.SRem(r.GetContext(), key, members...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("can't prune search index: %v", err)
+	}
+}
+
+// Remove removes a message from the index of a mailbox
+func (s *SearchIndex) Remove(to, id string) error {
+	r := s.storage
+
+	data, err := r.Client.Get(r.GetContext(), searchDocKey(to, id)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove message from index: %w", err)
+	}
+
+	var keys []string
+	if tokens, err := s.openTokens(data); err == nil {
+		for _, term := range tokens.Terms() {
+			keys = append(keys, searchTermKey(to, s.term(term)))
+		}
+	}
+
+	_, err = r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.Del(r.GetContext(), searchDocKey(to, id))
+		pipe.SRem(r.GetContext(), searchKeysKey(to), searchDocKey(to, id))
+		for _, key := range keys {
+			pipe.SRem(r.GetContext(), key, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove message from index: %w", err)
+	}
+	return nil
+}
+
+// Clear removes all the messages of a mailbox from the index
+func (s *SearchIndex) Clear(to string) error {
+	r := s.storage
+
+	keys, err := r.Client.SMembers(r.GetContext(), searchKeysKey(to)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to clear index: %w", err)
+	}
+
+	keys = append(keys, searchKeysKey(to))
+	if err := r.Client.Del(r.GetContext(), keys...).Err(); err != nil {
+		return fmt.Errorf("failed to clear index: %w", err)
+	}
+	return nil
+}
+
+// reindex moves the indexed messages to the term sets blinded with the
+// primary master key, deleting the ones blinded with previous keys
+func (s *SearchIndex) reindex() error {
+	r := s.storage
+
+	iter := r.Client.ScanType(r.GetContext(), 0, "search:*:doc:*", 0, "string").Iterator()
+	for iter.Next(r.GetContext()) {
+		key := iter.Val()
+		at := strings.LastIndex(key, ":doc:")
+		to, id := strings.TrimPrefix(key[:at], "search:"), key[at+len(":doc:"):]
+
+		data, err := r.Client.Get(r.GetContext(), key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reindex %s: %w", key, err)
+		}
+		tokens, err := s.openTokens(data)
+		if err != nil {
+			return fmt.Errorf("failed to reindex %s: %w", key, err)
+		}
+		ttl, err := r.Client.PTTL(r.GetContext(), key).Result()
+		if err != nil {
+			return fmt.Errorf("failed to reindex %s: %w", key, err)
+		}
+
+		_, err = r.Client.Pipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+			for _, term := range tokens.Terms() {
+				termKey := searchTermKey(to, s.term(term))
+				pipe.SAdd(r.GetContext(), termKey, id)
+				pipe.SAdd(r.GetContext(), searchKeysKey(to), termKey)
+				expireAtLeast(pipe, r, termKey, ttl)
+
+				for _, previous := range r.Keyring.PreviousBlindIndexes(term) {
+					pipe.Del(r.GetContext(), searchTermKey(to, previous))
+					pipe.SRem(r.GetContext(), searchKeysKey(to), searchTermKey(to, previous))
+				}
+			}
+			expireAtLeast(pipe, r, searchKeysKey(to), ttl)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to reindex %s: %w", key, err)
+		}
+	}
+	return iter.Err()
+}
+
+// expireAtLeast makes a key expire no sooner than ttl
+func expireAtLeast(pipe redis.Pipeliner, r *RedisStorage, key string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	pipe.ExpireNX(r.GetContext(), key, ttl)
+	pipe.ExpireGT(r.GetContext(), key, ttl)
+}
@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/search"
+)
+
+// newTestStorage returns a storage backed by an in-memory redis
+func newTestStorage(t *testing.T) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	storage := NewStorage()
+	storage.Address = mr.Host()
+	storage.Port, _ = strconv.Atoi(mr.Port())
+	storage.Connect()
+	return storage, mr
+}
+
+// newTestKeyring returns a keyring whose master keys are made of the given
+// bytes, the first one being the primary
+func newTestKeyring(t *testing.T, keys ...byte) *encryption.Keyring {
+	t.Helper()
+
+	var previous [][]byte
+	for _, b := range keys[1:] {
+		previous = append(previous, bytes.Repeat([]byte{b}, 32))
+	}
+	keyring, err := encryption.NewKeyring(bytes.Repeat([]byte{keys[0]}, 32), previous...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// searchIDs runs a query, failing the test on errors
+func searchIDs(t *testing.T, index search.Index, mailbox, text string) []string {
+	t.Helper()
+
+	query, err := search.ParseQuery(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := index.Search(mailbox, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestSearchIndexClear(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	index := NewSearchIndex(storage)
+
+	for _, add := range []struct {
+		mailbox string
+		doc     *search.Document
+	}{
+		{"alice@example.com", &search.Document{ID: "1", Subject: "hello", Body: "first"}},
+		{"alice@example.com", &search.Document{ID: "2", Subject: "hello", Body: "second"}},
+		{"bob@example.com", &search.Document{ID: "3", Subject: "hello"}},
+	} {
+		if err := index.Add(add.mailbox, add.doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Patterns are mailbox names like any other
+	if err := index.Clear("*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Clear("alice@example.co?"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, index, "alice@example.com", "hello"); !slices.Equal(ids, []string{"1", "2"}) {
+		t.Errorf("alice@example.com matches %v after clearing patterns", ids)
+	}
+
+	if err := index.Clear("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "search:alice@example.com:") {
+			t.Errorf("%s left after clearing", key)
+		}
+	}
+	if ids := searchIDs(t, index, "bob@example.com", "hello"); !slices.Equal(ids, []string{"3"}) {
+		t.Errorf("bob@example.com matches %v, want [3]", ids)
+	}
+}
+
+func TestSearchIndexRotation(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	storage.Keyring = newTestKeyring(t, 1)
+	index := NewSearchIndex(storage)
+
+	doc := &search.Document{ID: "1", Subject: "Your code", Body: "Use 123456 to sign in"}
+	if err := index.Add("alice@example.com", doc); err != nil {
+		t.Fatal(err)
+	}
+	terms := len(doc.Tokenize().Terms())
+
+	// Terms are blinded, never stored in clear
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, "123456") {
+			t.Errorf("term stored in clear: %s", key)
+		}
+	}
+
+	// Rotating the master key moves the index under the new blind index
+	storage.Keyring = newTestKeyring(t, 2, 1)
+	if _, err := storage.RewrapEmails(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, index, "alice@example.com", "123456 code"); !slices.Equal(ids, []string{"1"}) {
+		t.Errorf("got %v after rotation, want [1]", ids)
+	}
+
+	termKeys := 0
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "search:alice@example.com:term:") {
+			termKeys++
+		}
+	}
+	if termKeys != terms {
+		t.Errorf("got %d term sets after rotation, want %d", termKeys, terms)
+	}
+
+	// The previous key can be retired
+	storage.Keyring = newTestKeyring(t, 2)
+	if ids := searchIDs(t, index, "alice@example.com", "subject:code"); !slices.Equal(ids, []string{"1"}) {
+		t.Errorf("got %v without the previous key, want [1]", ids)
+	}
+
+	// Clearing after a rotation leaves nothing behind
+	if err := index.Clear("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, "search:") {
+			t.Errorf("%s left after clearing", key)
+		}
+	}
+}
+
+func TestSearchIndexExpiry(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	storage.EmailTTL = time.Hour
+	index := NewSearchIndex(storage)
+
+	for _, doc := range []*search.Document{
+		{ID: "1", Subject: "hello"},
+		{ID: "2", Subject: "hello again"},
+	} {
+		if err := index.Add("alice@example.com", doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := index.Remove("alice@example.com", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchIDs(t, index, "alice@example.com", "hello"); !slices.Equal(ids, []string{"1"}) {
+		t.Errorf("got %v after removal, want [1]", ids)
+	}
+	if ids := searchIDs(t, index, "alice@example.com", "again"); ids != nil {
+		t.Errorf("removed document matches: %v", ids)
+	}
+
+	// The index expires along with the messages
+	mr.FastForward(2 * time.Hour)
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("keys left after expiry: %v", keys)
+	}
+	if ids := searchIDs(t, index, "alice@example.com", "hello"); ids != nil {
+		t.Errorf("expired document matches: %v", ids)
+	}
+}
@@ -0,0 +1,75 @@
+// internal/redis/session.go
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// StoreMailboxSession stores the wrapped key of a mailbox session, identified
+// by the hash of its token
+func (r *RedisStorage) StoreMailboxSession(email, tokenHash, wrappedKey string, ttl time.Duration) error {
+	key := fmt.Sprintf("session:%s:%s", email, tokenHash)
+	return r.Client.Set(r.GetContext(), key, wrappedKey, ttl).Err()
+}
+
+// GetMailboxSession returns the wrapped key of a mailbox session, or an empty
+// string if the session doesn't exist or has expired
+func (r *RedisStorage) GetMailboxSession(email, tokenHash string) (string, error) {
+	key := fmt.Sprintf("session:%s:%s", email, tokenHash)
+	wrappedKey, err := r.Client.Get(r.GetContext(), key).Result()
+	if err == goredis.Nil {
+		return "", nil
+	}
+	return wrappedKey, err
+}
+
+// unlockFailuresKey is the key counting the wrong passphrases sent for a mailbox
+func unlockFailuresKey(email string) string {
+	return fmt.Sprintf("unlock_failures:%s", email)
+}
+
+// UnlockFailures returns the number of wrong passphrases sent for a mailbox
+// in the current window, and the time left until the window ends
+func (r *RedisStorage) UnlockFailures(email string) (int64, time.Duration, error) {
+	var count *goredis.StringCmd
+	var ttl *goredis.DurationCmd
+	_, err := r.Client.TxPipelined(r.GetContext(), func(pipe goredis.Pipeliner) error {
+		count = pipe.Get(r.GetContext(), unlockFailuresKey(email))
+		ttl = pipe.TTL(r.GetContext(), unlockFailuresKey(email))
+		return nil
+	})
+	if err == goredis.Nil {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get unlock failures: %w", err)
+	}
+
+	failures, err := count.Int64()
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid unlock failures: %w", err)
+	}
+	return failures, ttl.Val(), nil
+}
+
+// RecordUnlockFailure counts a wrong passphrase sent for a mailbox, the count
+// is reset window after the first failure
+func (r *RedisStorage) RecordUnlockFailure(email string, window time.Duration) error {
+	_, err := r.Client.TxPipelined(r.GetContext(), func(pipe goredis.Pipeliner) error {
+		pipe.Incr(r.GetContext(), unlockFailuresKey(email))
+		pipe.ExpireNX(r.GetContext(), unlockFailuresKey(email), window)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record unlock failure: %w", err)
+	}
+	return nil
+}
+
+// ResetUnlockFailures forgets the wrong passphrases sent for a mailbox
+func (r *RedisStorage) ResetUnlockFailures(email string) error {
+	return r.Client.Del(r.GetContext(), unlockFailuresKey(email)).Err()
+}
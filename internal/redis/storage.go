@@ -1,12 +1,27 @@
 package redis
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/redis/go-redis/v9"
 )
 
 type Storage interface {
 	StoreEmail(to, body string) error
+	StoreMessage(to string, message *Message) (string, error)
 	RetrieveEmails(to string) (map[string]string, error)
+	RetrieveMessages(to string) ([]*Message, error)
+	RetrieveMessage(to, id string) (*Message, error)
+	DeleteMessage(to, id string) (bool, error)
+	SetMessageRead(to, id string, read bool) (bool, error)
+	ScanSummaries(to string, after int64, desc bool, fn func(*MessageSummary) bool) error
+	ClearMailbox(to string) (int, error)
+	RetrieveEmail(to, id string) (string, error)
+	GetReservation(email string) (*Reservation, error)
 }
 
 // Override StoreEmail to use TTL
@@ -14,11 +29,14 @@ func (r *RedisStorage) StoreEmail(to, body string) error {
 	return r.StoreEmailWithTTL(to, body)
 }
 
+// RetrieveEmails returns the emails of a mailbox by key. Keys are scanned
+// rather than read from the mailbox index, which misses the emails stored
+// before the index existed.
 func (r *RedisStorage) RetrieveEmails(to string) (map[string]string, error) {
 	var keys []string
 	var result map[string]string
 
-	iter := r.Client.Scan(r.context, 0, fmt.Sprintf("%s:*", to), 0).Iterator()
+	iter := r.Client.Scan(r.context, 0, escapePattern(to)+":*", 0).Iterator()
 	for iter.Next(r.context) {
 		keys = append(keys, iter.Val())
 	}
@@ -32,7 +50,69 @@ func (r *RedisStorage) RetrieveEmails(to string) (map[string]string, error) {
 		if err != nil {
 			continue
 		}
+		body, err = r.openEmail(body)
+		if err != nil {
+			log.Printf("can't open email %s: %v", key, err)
+			continue
+		}
 		result[key] = body
 	}
 	return result, nil
 }
+
+// escapePattern escapes the glob characters of a key pattern, so that it
+// only matches s literally
+func escapePattern(s string) string {
+	var escaped strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
+
+// RetrieveEmail returns a single email of a mailbox by its ID, or an empty
+// string if it doesn't exist or has expired
+func (r *RedisStorage) RetrieveEmail(to, id string) (string, error) {
+	body, err := r.Client.Get(r.context, fmt.Sprintf("%s:%s", to, id)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.openEmail(body)
+}
+
+// sealEmail encrypts an email at rest if a keyring is configured
+func (r *RedisStorage) sealEmail(body string) (string, error) {
+	if r.Keyring == nil {
+		return body, nil
+	}
+
+	sealed, err := r.Keyring.Seal([]byte(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to seal email: %w", err)
+	}
+	return sealed, nil
+}
+
+// openEmail decrypts an email sealed at rest, emails stored in clear are
+// returned as they are
+func (r *RedisStorage) openEmail(body string) (string, error) {
+	if !encryption.IsSealed(body) {
+		return body, nil
+	}
+
+	if r.Keyring == nil {
+		return "", errors.New("email is sealed but no master key is configured")
+	}
+
+	plaintext, err := r.Keyring.Open(body)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
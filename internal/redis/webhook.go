@@ -0,0 +1,367 @@
+// internal/redis/webhook.go
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Scopes of a webhook subscription
+const (
+	WebhookScopeMailbox = "mailbox"
+	WebhookScopeDomain  = "domain"
+	WebhookScopeGlobal  = "global"
+)
+
+// Status of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// Deliveries are scheduled in a sorted set scored by their next attempt
+	webhookQueueKey = "webhook:queue"
+	// How long deliveries are kept for the delivery log, at most the TTL of
+	// emails as payloads carry their content
+	webhookDeliveryRetention = 7 * 24 * time.Hour
+	// Deliveries kept in the log of each webhook
+	webhookLogSize = 100
+)
+
+// claimDeliveries atomically takes the due deliveries out of reach of other
+// workers until the lease expires, so a crashed worker doesn't lose them
+var claimDeliveries = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[3], id)
+end
+return ids
+`)
+
+// Webhook is a subscription to the mail received by a mailbox, a domain or
+// the whole server
+type Webhook struct {
+	ID         string    `json:"id"`
+	Scope      string    `json:"scope"`
+	Target     string    `json:"target,omitempty"` // Mailbox or domain, empty for global webhooks
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"` // Key of the HMAC-SHA256 payload signature
+	IncludeRaw bool      `json:"include_raw"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is a payload queued for a webhook, along with the outcome
+// of its delivery attempts
+type WebhookDelivery struct {
+	ID            string    `json:"id"`
+	WebhookID     string    `json:"webhook_id"`
+	Event         string    `json:"event"`
+	Payload       string    `json:"-"` // Stored sealed if a master key is configured
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	ResponseCode  int       `json:"response_code,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at,omitzero"`
+}
+
+func webhookKey(id string) string {
+	return fmt.Sprintf("webhook:%s", id)
+}
+
+func webhookIndexKey(scope, target string) string {
+	if scope == WebhookScopeGlobal {
+		return "webhooks:global"
+	}
+	return fmt.Sprintf("webhooks:%s:%s", scope, target)
+}
+
+func deliveryKey(id string) string {
+	return fmt.Sprintf("webhook:delivery:%s", id)
+}
+
+func deliveryLogKey(webhookID string) string {
+	return fmt.Sprintf("webhook:log:%s", webhookID)
+}
+
+// SaveWebhook stores a webhook and indexes it by scope
+func (r *RedisStorage) SaveWebhook(webhook *Webhook) error {
+	_, err := r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.GetContext(), webhookKey(webhook.ID), map[string]interface{}{
+			"scope":       webhook.Scope,
+			"target":      webhook.Target,
+			"url":         webhook.URL,
+			"secret":      webhook.Secret,
+			"include_raw": webhook.IncludeRaw,
+			"created_at":  webhook.CreatedAt.Unix(),
+		})
+		pipe.SAdd(r.GetContext(), webhookIndexKey(webhook.Scope, webhook.Target), webhook.ID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save webhook: %w", err)
+	}
+	return nil
+}
+
+// GetWebhook returns a webhook by its ID, or nil if it doesn't exist
+func (r *RedisStorage) GetWebhook(id string) (*Webhook, error) {
+	data, err := r.Client.HGetAll(r.GetContext(), webhookKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	webhook := &Webhook{
+		ID:         id,
+		Scope:      data["scope"],
+		Target:     data["target"],
+		URL:        data["url"],
+		Secret:     data["secret"],
+		IncludeRaw: data["include_raw"] == "1" || data["include_raw"] == "true",
+	}
+	if createdAtUnix, err := strconv.ParseInt(data["created_at"], 10, 64); err == nil {
+		webhook.CreatedAt = time.Unix(createdAtUnix, 0)
+	}
+
+	return webhook, nil
+}
+
+// DeleteWebhook deletes a webhook and its delivery log, pending deliveries
+// fail on their next attempt
+func (r *RedisStorage) DeleteWebhook(webhook *Webhook) error {
+	_, err := r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.Del(r.GetContext(), webhookKey(webhook.ID), deliveryLogKey(webhook.ID))
+		pipe.SRem(r.GetContext(), webhookIndexKey(webhook.Scope, webhook.Target), webhook.ID)
+		return nil
+	})
+	return err
+}
+
+// DeleteMailboxWebhooks deletes the webhooks subscribed to a mailbox, it
+// returns the number of deleted webhooks
+func (r *RedisStorage) DeleteMailboxWebhooks(email string) (int, error) {
+	ids, err := r.Client.SMembers(r.GetContext(), webhookIndexKey(WebhookScopeMailbox, email)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete webhooks: %w", err)
+	}
+
+	_, err = r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.Del(r.GetContext(), webhookKey(id), deliveryLogKey(id))
+		}
+		pipe.Del(r.GetContext(), webhookIndexKey(WebhookScopeMailbox, email))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete webhooks: %w", err)
+	}
+	return len(ids), nil
+}
+
+// MatchWebhooks returns the webhooks subscribed to the mail of a mailbox,
+// whether directly, through its domain or globally
+func (r *RedisStorage) MatchWebhooks(email string) ([]*Webhook, error) {
+	keys := []string{
+		webhookIndexKey(WebhookScopeMailbox, email),
+		webhookIndexKey(WebhookScopeGlobal, ""),
+	}
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		keys = append(keys, webhookIndexKey(WebhookScopeDomain, email[at+1:]))
+	}
+
+	ids, err := r.Client.SUnion(r.GetContext(), keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*Webhook, 0, len(ids))
+	for _, id := range ids {
+		webhook, err := r.GetWebhook(id)
+		if err != nil {
+			return nil, err
+		}
+		if webhook != nil {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+// deliveryRetention returns how long deliveries are kept
+func (r *RedisStorage) deliveryRetention() time.Duration {
+	if r.EmailTTL > 0 && r.EmailTTL < webhookDeliveryRetention {
+		return r.EmailTTL
+	}
+	return webhookDeliveryRetention
+}
+
+// EnqueueDelivery stores a delivery and schedules its first attempt now
+func (r *RedisStorage) EnqueueDelivery(delivery *WebhookDelivery) error {
+	delivery.Status = DeliveryPending
+	delivery.NextAttemptAt = delivery.CreatedAt
+
+	fields := delivery.fields()
+	payload, err := r.sealEmail(delivery.Payload)
+	if err != nil {
+		return err
+	}
+	fields["payload"] = payload
+
+	retention := r.deliveryRetention()
+	_, err = r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.GetContext(), deliveryKey(delivery.ID), fields)
+		pipe.Expire(r.GetContext(), deliveryKey(delivery.ID), retention)
+		pipe.LPush(r.GetContext(), deliveryLogKey(delivery.WebhookID), delivery.ID)
+		pipe.LTrim(r.GetContext(), deliveryLogKey(delivery.WebhookID), 0, webhookLogSize-1)
+		pipe.Expire(r.GetContext(), deliveryLogKey(delivery.WebhookID), retention)
+		pipe.ZAdd(r.GetContext(), webhookQueueKey, redis.Z{
+			Score:  float64(delivery.NextAttemptAt.UnixMilli()),
+			Member: delivery.ID,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue delivery: %w", err)
+	}
+	return nil
+}
+
+// ClaimDeliveries returns up to limit deliveries due for an attempt. They are
+// leased for the given duration, then claimable again unless saved before.
+func (r *RedisStorage) ClaimDeliveries(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	now := time.Now()
+	ids, err := claimDeliveries.Run(r.GetContext(), r.Client, []string{webhookQueueKey},
+		now.UnixMilli(), limit, now.Add(lease).UnixMilli()).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim deliveries: %w", err)
+	}
+
+	deliveries := make([]*WebhookDelivery, 0, len(ids))
+	for _, id := range ids {
+		delivery, err := r.GetDelivery(id)
+		if err != nil {
+			return nil, err
+		}
+
+		// Expired from the log, nothing left to deliver
+		if delivery == nil {
+			r.Client.ZRem(r.GetContext(), webhookQueueKey, id)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// SaveDelivery records the outcome of an attempt, pending deliveries are
+// rescheduled at their next attempt and others leave the queue. The payload
+// is left as it was stored.
+func (r *RedisStorage) SaveDelivery(delivery *WebhookDelivery) error {
+	_, err := r.Client.TxPipelined(r.GetContext(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.GetContext(), deliveryKey(delivery.ID), delivery.fields())
+		// Keeps the retention of the delivery, or sets it if the delivery
+		// expired meanwhile and the hash was created again
+		pipe.ExpireNX(r.GetContext(), deliveryKey(delivery.ID), r.deliveryRetention())
+		if delivery.Status == DeliveryPending {
+			pipe.ZAdd(r.GetContext(), webhookQueueKey, redis.Z{
+				Score:  float64(delivery.NextAttemptAt.UnixMilli()),
+				Member: delivery.ID,
+			})
+		} else {
+			pipe.ZRem(r.GetContext(), webhookQueueKey, delivery.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save delivery: %w", err)
+	}
+	return nil
+}
+
+// GetDelivery returns a delivery by its ID, or nil if it doesn't exist
+func (r *RedisStorage) GetDelivery(id string) (*WebhookDelivery, error) {
+	data, err := r.Client.HGetAll(r.GetContext(), deliveryKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	payload, err := r.openEmail(data["payload"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payload of delivery %s: %w", id, err)
+	}
+
+	delivery := &WebhookDelivery{
+		ID:        id,
+		WebhookID: data["webhook_id"],
+		Event:     data["event"],
+		Payload:   payload,
+		Status:    data["status"],
+		LastError: data["last_error"],
+	}
+	delivery.Attempts, _ = strconv.Atoi(data["attempts"])
+	delivery.ResponseCode, _ = strconv.Atoi(data["response_code"])
+	if createdAt, err := strconv.ParseInt(data["created_at"], 10, 64); err == nil {
+		delivery.CreatedAt = time.UnixMilli(createdAt)
+	}
+	if nextAttemptAt, err := strconv.ParseInt(data["next_attempt_at"], 10, 64); err == nil && nextAttemptAt > 0 {
+		delivery.NextAttemptAt = time.UnixMilli(nextAttemptAt)
+	}
+
+	return delivery, nil
+}
+
+// ListDeliveries returns the latest deliveries of a webhook, newest first
+func (r *RedisStorage) ListDeliveries(webhookID string) ([]*WebhookDelivery, error) {
+	ids, err := r.Client.LRange(r.GetContext(), deliveryLogKey(webhookID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]*WebhookDelivery, 0, len(ids))
+	for _, id := range ids {
+		delivery, err := r.GetDelivery(id)
+		if err != nil {
+			return nil, err
+		}
+		if delivery != nil {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+// fields returns the delivery as stored in redis, without its payload
+func (d *WebhookDelivery) fields() map[string]interface{} {
+	nextAttemptAt := int64(0)
+	if d.Status == DeliveryPending {
+		nextAttemptAt = d.NextAttemptAt.UnixMilli()
+	}
+
+	return map[string]interface{}{
+		"webhook_id":      d.WebhookID,
+		"event":           d.Event,
+		"status":          d.Status,
+		"attempts":        d.Attempts,
+		"response_code":   d.ResponseCode,
+		"last_error":      d.LastError,
+		"created_at":      d.CreatedAt.UnixMilli(),
+		"next_attempt_at": nextAttemptAt,
+	}
+}
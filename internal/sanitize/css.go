@@ -0,0 +1,158 @@
+// internal/sanitize/css.go
+package sanitize
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	cssComments = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssProperty = regexp.MustCompile(`^-?[a-z][a-z0-9-]*$`)
+
+	// Values that run code, load resources the sanitizer can't check, or hide
+	// them behind escapes
+	dangerousCSS = regexp.MustCompile(`(?i)expression|javascript:|vbscript:|behavior|binding|image-set|@import|[\\<{}]`)
+
+	// URLs of CSS values, quoted or not
+	cssURL = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`)
+)
+
+// Properties dropped whatever their value
+var droppedProperties = map[string]bool{
+	"behavior":     true,
+	"-moz-binding": true,
+}
+
+// At-rules whose block of rules is kept, others are dropped
+var groupingRules = []string{"@media", "@supports"}
+
+// declarations sanitizes a list of CSS declarations, like style attributes.
+// Declarations that aren't safe are dropped, the others are kept as they are.
+func (s *sanitizer) declarations(css string) string {
+	var kept []string
+	for _, declaration := range strings.Split(cssComments.ReplaceAllString(css, ""), ";") {
+		property, value, ok := strings.Cut(declaration, ":")
+		if !ok {
+			continue
+		}
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.TrimSpace(value)
+
+		if !cssProperty.MatchString(property) || droppedProperties[property] || dangerousCSS.MatchString(value) {
+			continue
+		}
+		// Elements placed over the page could pass for the interface around it
+		if property == "position" && !isStaticPosition(value) {
+			continue
+		}
+
+		value, ok = s.cssURLs(value)
+		if !ok {
+			continue
+		}
+		kept = append(kept, property+": "+value)
+	}
+	return strings.Join(kept, "; ")
+}
+
+// isStaticPosition tells whether a position keeps elements in the flow
+func isStaticPosition(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(value, "!important")))
+	return value == "static" || value == "relative"
+}
+
+// cssURLs checks the URLs of a value like image sources, it returns false if
+// one of them is not allowed
+func (s *sanitizer) cssURLs(value string) (string, bool) {
+	ok := true
+	value = cssURL.ReplaceAllStringFunc(value, func(match string) string {
+		groups := cssURL.FindStringSubmatch(match)
+		image, allowed := s.imageURL(groups[1] + groups[2] + groups[3])
+		if !allowed || strings.ContainsAny(image, `"()<\\`) {
+			ok = false
+			return ""
+		}
+		return `url("` + image + `")`
+	})
+	return value, ok
+}
+
+// styleSheet sanitizes a style sheet, keeping the rules and the media and
+// feature queries. Rules with declarations left empty are dropped.
+func (s *sanitizer) styleSheet(css string) string {
+	css = cssComments.ReplaceAllString(css, "")
+	// Email style sheets are often wrapped in HTML comments
+	css = strings.NewReplacer("<!--", "", "-->", "").Replace(css)
+	return s.rules(css)
+}
+
+// rules sanitizes a list of rules
+func (s *sanitizer) rules(css string) string {
+	var out strings.Builder
+	for {
+		start := strings.IndexAny(css, "{;")
+		if start < 0 {
+			return out.String()
+		}
+		prelude := strings.TrimSpace(css[:start])
+
+		// At-rules without a block, like @import and @charset
+		if css[start] == ';' {
+			css = css[start+1:]
+			continue
+		}
+
+		end := matchingBrace(css, start)
+		block := css[start+1 : end]
+		if end < len(css) {
+			end++
+		}
+		css = css[end:]
+
+		if prelude == "" || strings.ContainsAny(prelude, `\<}`) {
+			continue
+		}
+
+		if strings.HasPrefix(prelude, "@") {
+			if isGroupingRule(prelude) {
+				if inner := s.rules(block); inner != "" {
+					out.WriteString(prelude + "{" + inner + "}")
+				}
+			}
+			continue
+		}
+
+		if declarations := s.declarations(block); declarations != "" {
+			out.WriteString(prelude + "{" + declarations + "}")
+		}
+	}
+}
+
+// matchingBrace returns the index of the brace closing the one at start, or
+// the end of css if it is not closed
+func matchingBrace(css string, start int) int {
+	depth := 0
+	for i := start; i < len(css); i++ {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(css)
+}
+
+// isGroupingRule tells whether an at-rule groups other rules
+func isGroupingRule(prelude string) bool {
+	name := strings.ToLower(prelude)
+	for _, rule := range groupingRules {
+		if strings.HasPrefix(name, rule) {
+			return true
+		}
+	}
+	return false
+}
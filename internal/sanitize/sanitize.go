@@ -0,0 +1,268 @@
+// internal/sanitize/sanitize.go
+package sanitize
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Options controls how the HTML body of an email is sanitized
+type Options struct {
+	// ContentURL returns the URL of the part of the email with a content ID,
+	// cid: references are dropped when it returns ""
+	ContentURL func(contentID string) string
+
+	// RemoteImages keeps images loaded from other servers, which senders
+	// use to track when emails are read
+	RemoteImages bool
+}
+
+// Elements kept, with the attributes allowed on them
+var allowedElements = map[string]bool{
+	"a": true, "abbr": true, "address": true, "article": true, "aside": true,
+	"b": true, "bdi": true, "bdo": true, "big": true, "blockquote": true,
+	"br": true, "caption": true, "center": true, "cite": true, "code": true,
+	"col": true, "colgroup": true, "dd": true, "del": true, "details": true,
+	"dfn": true, "div": true, "dl": true, "dt": true, "em": true,
+	"figcaption": true, "figure": true, "font": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "i": true, "img": true, "ins": true,
+	"kbd": true, "li": true, "main": true, "mark": true, "nav": true,
+	"ol": true, "p": true, "pre": true, "q": true, "s": true, "samp": true,
+	"section": true, "small": true, "span": true, "strike": true,
+	"strong": true, "sub": true, "summary": true, "sup": true, "table": true,
+	"tbody": true, "td": true, "tfoot": true, "th": true, "thead": true,
+	"time": true, "tr": true, "tt": true, "u": true, "ul": true, "var": true,
+	"wbr": true,
+}
+
+// Elements dropped along with their content. Other elements not allowed,
+// like forms, are dropped but their content is kept.
+var droppedElements = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "applet": true, "noembed": true, "noframes": true,
+	"template": true, "svg": true, "math": true, "title": true, "xmp": true,
+	"plaintext": true, "textarea": true, "select": true, "button": true,
+	"datalist": true, "option": true, "optgroup": true, "output": true,
+	"canvas": true, "audio": true, "video": true, "noscript": true,
+	"head": true,
+}
+
+// Elements without content nor end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "keygen": true, "link": true,
+	"meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// Attributes allowed on any kept element, those holding URLs are handled apart
+var allowedAttributes = map[string]bool{
+	"abbr": true, "align": true, "alt": true, "bgcolor": true, "border": true,
+	"cellpadding": true, "cellspacing": true, "class": true, "color": true,
+	"colspan": true, "datetime": true, "dir": true, "face": true,
+	"headers": true, "height": true, "hspace": true, "id": true, "lang": true,
+	"name": true, "noshade": true, "nowrap": true, "open": true,
+	"reversed": true, "rowspan": true, "rules": true, "scope": true,
+	"size": true, "span": true, "start": true, "style": true, "summary": true,
+	"title": true, "type": true, "valign": true, "value": true,
+	"vspace": true, "width": true,
+}
+
+// Inline images allowed as data URLs, SVG images can embed scripts
+var dataImage = regexp.MustCompile(`(?i)^data:image/(?:png|gif|jpe?g|webp|bmp);base64,[a-z0-9+/=\s]*$`)
+
+// HTML sanitizes the HTML body of an email, keeping an allowlist of elements
+// and attributes. Scripts, event handlers, forms, embedded content and CSS
+// that can run code or load resources are removed. It returns the content
+// of the body, along with the sanitized style sheets.
+//
+// The document is parsed as browsers do, so unclosed tags and comments or
+// misnested elements can't hide markup from the sanitizer.
+func HTML(document string, options Options) string {
+	root, err := html.Parse(strings.NewReader(strings.ToValidUTF8(document, "�")))
+	if err != nil {
+		return ""
+	}
+
+	s := &sanitizer{options: options}
+	s.writeStyleSheets(root)
+	s.writeChildren(root)
+	return s.out.String()
+}
+
+type sanitizer struct {
+	options Options
+	out     strings.Builder
+}
+
+// writeStyleSheets writes the style sheets of the head, where emails usually
+// put them
+func (s *sanitizer) writeStyleSheets(node *html.Node) {
+	for child := range node.Descendants() {
+		if child.Type == html.ElementNode && child.Data == "head" {
+			for style := range child.Descendants() {
+				if style.Type == html.ElementNode && style.Data == "style" && style.Namespace == "" {
+					s.writeStyleSheet(style)
+				}
+			}
+		}
+	}
+}
+
+// writeChildren writes the sanitized children of a node
+func (s *sanitizer) writeChildren(node *html.Node) {
+	for child := range node.ChildNodes() {
+		s.writeNode(child)
+	}
+}
+
+// writeNode writes a node if it's allowed, the content of elements not
+// allowed is kept unless they are dropped along with it
+func (s *sanitizer) writeNode(node *html.Node) {
+	switch node.Type {
+	case html.TextNode:
+		s.out.WriteString(html.EscapeString(node.Data))
+	case html.ElementNode:
+		// SVG and MathML content, foreign to the allowlist
+		if node.Namespace != "" || droppedElements[node.Data] {
+			return
+		}
+		if node.Data == "style" {
+			s.writeStyleSheet(node)
+			return
+		}
+		if !allowedElements[node.Data] {
+			s.writeChildren(node)
+			return
+		}
+
+		s.writeStartTag(node)
+		if !voidElements[node.Data] {
+			s.writeChildren(node)
+			s.out.WriteString("</" + node.Data + ">")
+		}
+	case html.DocumentNode:
+		s.writeChildren(node)
+	}
+}
+
+// writeStartTag writes a start tag with its allowed attributes
+func (s *sanitizer) writeStartTag(node *html.Node) {
+	s.out.WriteString("<" + node.Data)
+
+	for _, attr := range node.Attr {
+		value := attr.Val
+		switch {
+		case attr.Namespace != "":
+			continue
+		case attr.Key == "href" && node.Data == "a":
+			link, ok := s.linkURL(value)
+			if !ok {
+				continue
+			}
+			value = link
+			if !strings.HasPrefix(link, "#") {
+				s.out.WriteString(` target="_blank" rel="noopener noreferrer"`)
+			}
+		case attr.Key == "src" && node.Data == "img":
+			image, ok := s.imageURL(value)
+			if !ok {
+				continue
+			}
+			value = image
+		case attr.Key == "style":
+			value = s.declarations(value)
+			if value == "" {
+				continue
+			}
+		case !allowedAttributes[attr.Key]:
+			continue
+		}
+		s.out.WriteString(" " + attr.Key + `="` + html.EscapeString(value) + `"`)
+	}
+
+	s.out.WriteString(">")
+}
+
+// writeStyleSheet writes a style element with its sanitized style sheet
+func (s *sanitizer) writeStyleSheet(style *html.Node) {
+	var css strings.Builder
+	for child := range style.ChildNodes() {
+		if child.Type == html.TextNode {
+			css.WriteString(child.Data)
+		}
+	}
+
+	if sheet := s.styleSheet(css.String()); sheet != "" {
+		s.out.WriteString("<style>" + sheet + "</style>")
+	}
+}
+
+// linkURL returns the URL of a link if it's safe: fragments and web, mail
+// and phone links. Content IDs point to the parts of the email.
+func (s *sanitizer) linkURL(link string) (string, bool) {
+	link = cleanURL(link)
+	if strings.HasPrefix(link, "#") {
+		return link, true
+	}
+
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		return link, parsed.Host != ""
+	case "mailto", "tel":
+		return link, true
+	case "cid":
+		return s.contentURL(parsed.Opaque)
+	}
+	return "", false
+}
+
+// imageURL returns the URL an image is loaded from, if it's allowed
+func (s *sanitizer) imageURL(image string) (string, bool) {
+	image = cleanURL(image)
+	if dataImage.MatchString(image) {
+		return image, true
+	}
+
+	parsed, err := url.Parse(image)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		return image, s.options.RemoteImages && parsed.Host != ""
+	case "cid":
+		return s.contentURL(parsed.Opaque)
+	}
+	return "", false
+}
+
+// contentURL returns the URL of the part of the email with a content ID
+func (s *sanitizer) contentURL(contentID string) (string, bool) {
+	if s.options.ContentURL == nil {
+		return "", false
+	}
+	if unescaped, err := url.PathUnescape(contentID); err == nil {
+		contentID = unescaped
+	}
+	link := s.options.ContentURL(contentID)
+	return link, link != ""
+}
+
+// cleanURL removes the surrounding spaces and the tabs and line breaks of a
+// URL, which browsers ignore
+func cleanURL(link string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(link))
+}
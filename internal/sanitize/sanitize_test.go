@@ -0,0 +1,155 @@
+package sanitize
+
+import (
+	"strings"
+	"testing"
+)
+
+// contentURL maps content IDs to test URLs
+func contentURL(contentID string) string {
+	if contentID == "missing" {
+		return ""
+	}
+	return "/parts/" + contentID
+}
+
+func TestHTML(t *testing.T) {
+	for _, tt := range []struct {
+		name, in, want string
+	}{
+		// Markup
+		{"text", `<p>Hello <b>world</b> &amp; co</p>`, `<p>Hello <b>world</b> &amp; co</p>`},
+		{"document", `<html><head><title>t</title><style>.a{color:blue}</style></head><body><div class="a">x</div></body></html>`, `<style>.a{color: blue}</style><div class="a">x</div>`},
+		{"unclosed tags", `<p>unclosed <b>bold <i>italic`, `<p>unclosed <b>bold <i>italic</i></b></p>`},
+		{"misnested tags", `<b><i>x</b>y</i>`, `<b><i>x</i></b><i>y</i>`},
+		{"stray end tags", `</div></span>x`, `x`},
+		{"escaped attributes", `<p title="&quot;><script>">x</p>`, `<p title="&#34;&gt;&lt;script&gt;">x</p>`},
+		{"form", `<form action="https://example.com"><input name=a><button>go</button>text</form>`, `text`},
+
+		// Scripts and event handlers
+		{"script", `<script>alert(1)</script><p>after</p>`, `<p>after</p>`},
+		{"uppercase script", `<SCRIPT>alert(1)</SCRIPT>x`, `x`},
+		{"event handler", `<img src=x onerror=alert(1)>`, `<img>`},
+		{"event handlers", `<p onclick="alert(1)" onmouseover=alert(1) class="a">x</p>`, `<p class="a">x</p>`},
+		{"noscript", `<noscript><img src=x onerror=alert(1)></noscript>`, ``},
+		{"xmp", `<xmp><script>alert(1)</script></xmp>`, ``},
+		{"textarea", `<textarea></textarea><script>alert(1)</script>`, ``},
+		{"iframe", `<iframe src="https://example.com"></iframe>x`, `x`},
+
+		// Comments
+		{"comment", `<!-- <script>alert(1)</script> --><p>x</p>`, `<p>x</p>`},
+		{"unclosed comment", `<p>a<!-- unclosed comment <script>alert(1)</script>`, `<p>a</p>`},
+		{"bogus comment", `<p>a<! <img src=x onerror=alert(1)> -->b</p>`, `<p>a --&gt;b</p>`},
+
+		// Foreign content
+		{"svg", `<svg><script>alert(1)</script><foreignObject><p>x</p></foreignObject></svg>ok`, `ok`},
+		{"svg image", `<svg><image href="javascript:alert(1)"/></svg>`, ``},
+		{"math", `<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`, ``},
+		{"math link", `<math href="javascript:alert(1)"><mi>x</mi></math>y`, `y`},
+
+		// URLs
+		{"link", `<a href="https://example.com/">x</a>`, `<a target="_blank" rel="noopener noreferrer" href="https://example.com/">x</a>`},
+		{"fragment", `<a href="#top">x</a>`, `<a href="#top">x</a>`},
+		{"mailto", `<a href="mailto:alice@example.com">x</a>`, `<a target="_blank" rel="noopener noreferrer" href="mailto:alice@example.com">x</a>`},
+		{"relative link", `<a href="/login">x</a>`, `<a>x</a>`},
+		{"javascript", `<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"uppercase javascript", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a>x</a>`},
+		{"vbscript", `<a href="vbscript:msgbox(1)">x</a>`, `<a>x</a>`},
+		{"spaced javascript", "<a href=\" \tjava\nscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"control characters", "<a href=\"\x01javascript:alert(1)\">x</a>", `<a>x</a>`},
+		{"data link", `<a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`, `<a>x</a>`},
+		{"data image", `<img src="data:image/png;base64,iVBORw0KGgo=">`, `<img src="data:image/png;base64,iVBORw0KGgo=">`},
+		{"data svg image", `<img src="data:image/svg+xml;base64,PHN2Zz4=">`, `<img>`},
+		{"data html image", `<img src="data:text/html,<script>alert(1)</script>">`, `<img>`},
+		{"remote image", `<img src="https://tracker.example/p.gif" alt="a">`, `<img alt="a">`},
+		{"content image", `<img src="cid:logo@example.com">`, `<img src="/parts/logo@example.com">`},
+		{"missing content image", `<img src="cid:missing">`, `<img>`},
+
+		// Entity-encoded schemes
+		{"hex entity", `<a href="jav&#x61;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"decimal entities", `<a href="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">x</a>`, `<a>x</a>`},
+		{"padded entities", `<a href="&#0000106;&#0000097;vascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"entity without semicolon", `<a href="&#106avascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"named entities", `<a href="javascript&colon;alert(1)">x</a>`, `<a>x</a>`},
+		{"entity tab", `<a href="java&Tab;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"entity data image", `<img src="&#100;ata:text/html,x">`, `<img>`},
+
+		// Style sheets
+		{"style", `<style>p{color:red}</style><p>x</p>`, `<style>p{color: red}</style><p>x</p>`},
+		{"style breakout", `<style>p{color:red}</style><script>alert(1)</script></style><p>x</p>`, `<style>p{color: red}</style><p>x</p>`},
+		{"unclosed style", `<style>p{color:red}</ style><img src=x onerror=alert(1)>`, `<style>p{color: red}</style>`},
+		{"style in body", `<p>x</p><style>p{color:red}</style>`, `<p>x</p><style>p{color: red}</style>`},
+		{"style selector breakout", `<style>p</style ><script>alert(1)</script>{color:red}</style>`, `{color:red}`},
+		{"style comments", `<style><!-- p{color:red} --></style>`, `<style>p{color: red}</style>`},
+		{"style import", `<style>@import url(https://example.com/a.css); p{color:red}</style>`, `<style>p{color: red}</style>`},
+		{"style media", `<style>@media (max-width: 600px){p{color:red}}</style>`, `<style>@media (max-width: 600px){p{color: red}}</style>`},
+		{"style font face", `<style>@font-face{src:url(https://example.com/f.woff)}</style>`, ``},
+		{"style expression", `<style>p{width:expression(alert(1))}</style>`, ``},
+		{"style url", `<style>p{background:url(https://tracker.example/p.gif)}</style>`, ``},
+
+		// Style attributes
+		{"declarations", `<p style="color: red; FONT-WEIGHT: bold">x</p>`, `<p style="color: red; font-weight: bold">x</p>`},
+		{"expression", `<p style="width: expression(alert(1))">x</p>`, `<p>x</p>`},
+		{"entity expression", `<p style="color: red; width: expr&#101;ssion(alert(1))">x</p>`, `<p style="color: red">x</p>`},
+		{"escaped expression", `<p style="width: expr\65 ssion(alert(1))">x</p>`, `<p>x</p>`},
+		{"commented expression", `<p style="width: expr/**/ession(alert(1))">x</p>`, `<p>x</p>`},
+		{"behavior", `<p style="behavior: url(x.htc)">x</p>`, `<p>x</p>`},
+		{"binding", `<p style="-moz-binding: url(x.xml#x)">x</p>`, `<p>x</p>`},
+		{"javascript url", `<p style="background: url(javascript:alert(1)); color: red">x</p>`, `<p style="color: red">x</p>`},
+		{"remote url", `<p style="background: url('https://tracker.example/p.gif')">x</p>`, `<p>x</p>`},
+		{"escaped url", `<p style="background: u\72l(https://tracker.example/p.gif)">x</p>`, `<p>x</p>`},
+		{"content url", `<p style="background: url(cid:logo)">x</p>`, `<p style="background: url(&#34;/parts/logo&#34;)">x</p>`},
+		{"image set", `<p style="background: image-set('https://tracker.example/p.gif' 1x)">x</p>`, `<p>x</p>`},
+		{"fixed position", `<div style="position: fixed; top: 0">x</div>`, `<div style="top: 0">x</div>`},
+		{"relative position", `<div style="position: relative">x</div>`, `<div style="position: relative">x</div>`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTML(tt.in, Options{ContentURL: contentURL}); got != tt.want {
+				t.Errorf("HTML(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTMLRemoteImages(t *testing.T) {
+	for in, want := range map[string]string{
+		`<img src="https://example.com/a.png">`:                           `<img src="https://example.com/a.png">`,
+		`<img src="http://example.com/a.png">`:                            `<img src="http://example.com/a.png">`,
+		`<img src="https:///a.png">`:                                      `<img>`,
+		`<img src="javascript:alert(1)">`:                                 `<img>`,
+		`<p style="background: url(https://example.com/a.png)">x</p>`:     `<p style="background: url(&#34;https://example.com/a.png&#34;)">x</p>`,
+		`<p style="background: url('https://example.com/a\".png')">x</p>`: `<p>x</p>`,
+	} {
+		if got := HTML(in, Options{RemoteImages: true}); got != want {
+			t.Errorf("HTML(%q)\n got %q\nwant %q", in, got, want)
+		}
+	}
+}
+
+// Whatever the input, nothing able to run code makes it to the output
+func TestHTMLNoScript(t *testing.T) {
+	for _, in := range []string{
+		`<scr<script>ipt>alert(1)</script>`,
+		`<<script>script>alert(1)<</script>/script>`,
+		`<img """><script>alert(1)</script>">`,
+		`<a href="x" <script>alert(1)</script>>x</a>`,
+		`<div <img src=x onerror=alert(1)>>`,
+		`<title><img src=x onerror=alert(1)></title>`,
+		`<plaintext><script>alert(1)</script>`,
+		`<select><style></select><img src=x onerror=alert(1)></style>`,
+		`<table><td><svg><style><img src=x onerror=alert(1)>`,
+		`<template><script>alert(1)</script></template>`,
+		`<object data="javascript:alert(1)"></object>`,
+		`<base href="javascript:alert(1)//">`,
+		`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+		`<link rel="stylesheet" href="https://example.com/a.css">`,
+		`<p style="x:&#x5c;65xpression(alert(1))">`,
+	} {
+		got := strings.ToLower(HTML(in, Options{}))
+		for _, dangerous := range []string{"<script", "onerror", "javascript:", "expression", "<svg", "<base", "<meta", "<link", "<object"} {
+			if strings.Contains(got, dangerous) {
+				t.Errorf("HTML(%q) = %q, contains %q", in, got, dangerous)
+			}
+		}
+	}
+}
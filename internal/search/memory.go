@@ -0,0 +1,169 @@
+// internal/search/memory.go
+package search
+
+import (
+	"sync"
+	"time"
+)
+
+// How often expired documents are swept from a MemoryIndex
+const memorySweepInterval = time.Minute
+
+// MemoryIndex is an Index kept in the memory of the process, for single
+// instance deployments. Each instance only finds the mail it received.
+type MemoryIndex struct {
+	ttl time.Duration // Lifetime of documents, 0 for no expiration
+
+	mu        sync.Mutex
+	mailboxes map[string]*memoryMailbox
+	lastSweep time.Time
+}
+
+// memoryMailbox is the inverted index of a mailbox
+type memoryMailbox struct {
+	docs     map[string]*memoryDoc
+	postings map[string]map[string]bool // Token to document IDs
+}
+
+type memoryDoc struct {
+	tokens    Tokens
+	expiresAt time.Time // Zero for no expiration
+}
+
+// NewMemoryIndex creates an index whose documents expire after ttl, as the
+// messages they were built from
+func NewMemoryIndex(ttl time.Duration) *MemoryIndex {
+	return &MemoryIndex{
+		ttl:       ttl,
+		mailboxes: make(map[string]*memoryMailbox),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add indexes a message of a mailbox
+func (m *MemoryIndex) Add(mailbox string, doc *Document) error {
+	tokens := doc.Tokenize()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.lastSweep) > memorySweepInterval {
+		m.sweep(now)
+	}
+
+	box := m.mailboxes[mailbox]
+	if box == nil {
+		box = &memoryMailbox{
+			docs:     make(map[string]*memoryDoc),
+			postings: make(map[string]map[string]bool),
+		}
+		m.mailboxes[mailbox] = box
+	}
+	box.remove(doc.ID)
+
+	indexed := &memoryDoc{tokens: tokens}
+	if m.ttl > 0 {
+		indexed.expiresAt = now.Add(m.ttl)
+	}
+	box.docs[doc.ID] = indexed
+
+	for _, term := range tokens.Terms() {
+		if box.postings[term] == nil {
+			box.postings[term] = make(map[string]bool)
+		}
+		box.postings[term][doc.ID] = true
+	}
+	return nil
+}
+
+// Search returns the IDs of the messages of a mailbox matching a query
+func (m *MemoryIndex) Search(mailbox string, query *Query) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	box := m.mailboxes[mailbox]
+	if box == nil {
+		return nil, nil
+	}
+
+	// Candidates contain every term, the shortest posting list is walked
+	var shortest map[string]bool
+	terms := query.Terms()
+	for _, term := range terms {
+		postings := box.postings[term]
+		if len(postings) == 0 {
+			return nil, nil
+		}
+		if shortest == nil || len(postings) < len(shortest) {
+			shortest = postings
+		}
+	}
+
+	now := time.Now()
+	var ids []string
+	for id := range shortest {
+		doc := box.docs[id]
+		if !doc.expiresAt.IsZero() && now.After(doc.expiresAt) {
+			continue
+		}
+		if doc.tokens.Matches(query) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Remove removes a message from the index of a mailbox
+func (m *MemoryIndex) Remove(mailbox, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if box := m.mailboxes[mailbox]; box != nil {
+		box.remove(id)
+		if len(box.docs) == 0 {
+			delete(m.mailboxes, mailbox)
+		}
+	}
+	return nil
+}
+
+// Clear removes all the messages of a mailbox from the index
+func (m *MemoryIndex) Clear(mailbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.mailboxes, mailbox)
+	return nil
+}
+
+// sweep removes the expired documents, m.mu must be held
+func (m *MemoryIndex) sweep(now time.Time) {
+	m.lastSweep = now
+	for mailbox, box := range m.mailboxes {
+		for id, doc := range box.docs {
+			if !doc.expiresAt.IsZero() && now.After(doc.expiresAt) {
+				box.remove(id)
+			}
+		}
+		if len(box.docs) == 0 {
+			delete(m.mailboxes, mailbox)
+		}
+	}
+}
+
+// remove removes a document and its postings
+func (b *memoryMailbox) remove(id string) {
+	doc := b.docs[id]
+	if doc == nil {
+		return
+	}
+
+	for _, term := range doc.tokens.Terms() {
+		delete(b.postings[term], id)
+		if len(b.postings[term]) == 0 {
+			delete(b.postings, term)
+		}
+	}
+	delete(b.docs, id)
+}
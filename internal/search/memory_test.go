@@ -0,0 +1,116 @@
+package search
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// searchIDs runs a query, failing the test on errors
+func searchIDs(t *testing.T, index Index, mailbox, text string) []string {
+	t.Helper()
+
+	query, err := ParseQuery(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := index.Search(mailbox, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestMemoryIndex(t *testing.T) {
+	index := NewMemoryIndex(0)
+
+	for _, add := range []struct {
+		mailbox string
+		doc     *Document
+	}{
+		{"alice@example.com", &Document{ID: "1", Subject: "Your code", Body: "123456"}},
+		{"alice@example.com", &Document{ID: "2", Subject: "Your link", Body: "https://example.com/login"}},
+		{"alice@example.com", &Document{ID: "3", Subject: "Newsletter", Body: "your weekly code digest"}},
+		{"bob@example.com", &Document{ID: "4", Subject: "Your code", Body: "654321"}},
+	} {
+		if err := index.Add(add.mailbox, add.doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		mailbox, query string
+		want           []string
+	}{
+		{"alice@example.com", "your", []string{"1", "2", "3"}},
+		{"alice@example.com", "your code", []string{"1", "3"}},
+		{"alice@example.com", "your code 123456", []string{"1"}},
+		{"alice@example.com", "your code 654321", nil},
+		{"alice@example.com", `"your code"`, []string{"1"}},
+		{"alice@example.com", "subject:code", []string{"1"}},
+		{"bob@example.com", "your", []string{"4"}},
+		{"carol@example.com", "your", nil},
+	} {
+		if got := searchIDs(t, index, tt.mailbox, tt.query); !slices.Equal(got, tt.want) {
+			t.Errorf("%s %q: got %v, want %v", tt.mailbox, tt.query, got, tt.want)
+		}
+	}
+
+	// Reindexing a document replaces its terms
+	if err := index.Add("alice@example.com", &Document{ID: "1", Subject: "Edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, index, "alice@example.com", "123456"); got != nil {
+		t.Errorf("reindexed document still matches its old terms: %v", got)
+	}
+
+	// Removed documents are unindexed
+	if err := index.Remove("alice@example.com", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, index, "alice@example.com", "your"); !slices.Equal(got, []string{"2"}) {
+		t.Errorf("after removal: got %v, want [2]", got)
+	}
+
+	// Clearing a mailbox leaves the others as they are
+	if err := index.Clear("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, index, "alice@example.com", "your"); got != nil {
+		t.Errorf("after clearing: got %v", got)
+	}
+	if got := searchIDs(t, index, "bob@example.com", "your"); !slices.Equal(got, []string{"4"}) {
+		t.Errorf("bob@example.com after clearing alice@example.com: got %v, want [4]", got)
+	}
+}
+
+func TestMemoryIndexExpiry(t *testing.T) {
+	index := NewMemoryIndex(10 * time.Millisecond)
+
+	if err := index.Add("alice@example.com", &Document{ID: "1", Subject: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIDs(t, index, "alice@example.com", "hello"); !slices.Equal(got, []string{"1"}) {
+		t.Fatalf("got %v, want [1]", got)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if got := searchIDs(t, index, "alice@example.com", "hello"); got != nil {
+		t.Errorf("expired document matches: %v", got)
+	}
+
+	// Expired documents are swept on later additions
+	index.mu.Lock()
+	index.lastSweep = time.Now().Add(-2 * memorySweepInterval)
+	index.mu.Unlock()
+	if err := index.Add("bob@example.com", &Document{ID: "2", Subject: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if _, ok := index.mailboxes["alice@example.com"]; ok {
+		t.Error("expired mailbox not swept")
+	}
+}
@@ -0,0 +1,100 @@
+// internal/search/query.go
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Maximum number of clauses of a query
+const maxClauses = 32
+
+// ErrEmptyQuery is returned when a query has nothing to search for
+var ErrEmptyQuery = errors.New("empty query")
+
+// Query is a search query, messages match when they match all its clauses
+type Query struct {
+	Clauses []Clause
+}
+
+// Clause is a word or phrase, optionally restricted to a field. Words made
+// of several tokens, like addresses, are matched as phrases.
+type Clause struct {
+	Field  string // Empty for any field
+	Tokens []string
+}
+
+// Terms returns the distinct tokens of all the clauses
+func (q *Query) Terms() []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, clause := range q.Clauses {
+		for _, token := range clause.Tokens {
+			if !seen[token] {
+				seen[token] = true
+				terms = append(terms, token)
+			}
+		}
+	}
+	return terms
+}
+
+// ParseQuery parses a query made of words, "quoted phrases" and field
+// qualifiers, such as from:alice@example.com or subject:"reset your password".
+// Unknown qualifiers are searched as words.
+func ParseQuery(text string) (*Query, error) {
+	query := &Query{}
+
+	for rest := strings.TrimSpace(text); rest != ""; rest = strings.TrimSpace(rest) {
+		var field, value string
+		field, value, rest = nextClause(rest)
+
+		tokens := Tokenize(value)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		if len(query.Clauses) == maxClauses {
+			return nil, fmt.Errorf("too many terms, the maximum is %d", maxClauses)
+		}
+		query.Clauses = append(query.Clauses, Clause{Field: field, Tokens: tokens})
+	}
+
+	if len(query.Clauses) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	return query, nil
+}
+
+// nextClause reads the first clause of text, it returns its field, its value
+// and the rest of the text
+func nextClause(text string) (field, value, rest string) {
+	if name, after, ok := strings.Cut(text, ":"); ok && isField(name) {
+		field = strings.ToLower(name)
+		text = after
+	}
+
+	// An unterminated phrase runs to the end of the query
+	if strings.HasPrefix(text, `"`) {
+		value, rest, _ = strings.Cut(text[1:], `"`)
+		return field, value, rest
+	}
+
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end < 0 {
+		return field, text, ""
+	}
+	return field, text[:end], text[end:]
+}
+
+// isField tells whether name is a field qualifier
+func isField(name string) bool {
+	for _, field := range Fields {
+		if strings.EqualFold(name, field) {
+			return true
+		}
+	}
+	return false
+}
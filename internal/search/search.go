@@ -0,0 +1,122 @@
+// internal/search/search.go
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Fields of a document queries can be restricted to
+const (
+	FieldSubject = "subject"
+	FieldFrom    = "from"
+	FieldTo      = "to"
+	FieldBody    = "body"
+)
+
+// Fields lists the fields of a document
+var Fields = []string{FieldSubject, FieldFrom, FieldTo, FieldBody}
+
+// Maximum number of tokens indexed for a field, the rest of long bodies is
+// not searchable
+const maxFieldTokens = 20000
+
+// Document is the searchable content of a message
+type Document struct {
+	ID      string
+	Subject string
+	From    string // Address and display name of the sender
+	To      []string
+	Body    string // Decoded text of the message
+}
+
+// Index is a full-text index of the messages of each mailbox. Documents
+// expire along with the messages they were built from.
+type Index interface {
+	// Add indexes a message of a mailbox
+	Add(mailbox string, doc *Document) error
+	// Search returns the IDs of the messages of a mailbox matching a query
+	Search(mailbox string, query *Query) ([]string, error)
+	// Remove removes a message from the index of a mailbox
+	Remove(mailbox, id string) error
+	// Clear removes all the messages of a mailbox from the index
+	Clear(mailbox string) error
+}
+
+// Tokens holds the tokens of each field of a document
+type Tokens map[string][]string
+
+// Tokenize returns the tokens of each field of a document
+func (d *Document) Tokenize() Tokens {
+	return Tokens{
+		FieldSubject: Tokenize(d.Subject),
+		FieldFrom:    Tokenize(d.From),
+		FieldTo:      Tokenize(strings.Join(d.To, " ")),
+		FieldBody:    Tokenize(d.Body),
+	}
+}
+
+// Terms returns the distinct tokens of all the fields
+func (t Tokens) Terms() []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, field := range Fields {
+		for _, token := range t[field] {
+			if !seen[token] {
+				seen[token] = true
+				terms = append(terms, token)
+			}
+		}
+	}
+	return terms
+}
+
+// Matches tells whether the tokens match all the clauses of a query
+func (t Tokens) Matches(query *Query) bool {
+	for _, clause := range query.Clauses {
+		if !t.matchesClause(clause) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t Tokens) matchesClause(clause Clause) bool {
+	if clause.Field != "" {
+		return containsSequence(t[clause.Field], clause.Tokens)
+	}
+	for _, field := range Fields {
+		if containsSequence(t[field], clause.Tokens) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsSequence tells whether tokens contains sequence, contiguously
+func containsSequence(tokens, sequence []string) bool {
+	for i := 0; i+len(sequence) <= len(tokens); i++ {
+		match := true
+		for j, token := range sequence {
+			if tokens[i+j] != token {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokenize splits text into lowercase words made of letters and digits
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > maxFieldTokens {
+		words = words[:maxFieldTokens]
+	}
+	return words
+}
@@ -0,0 +1,104 @@
+package search
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"alice@example.com", []string{"alice", "example", "com"}},
+		{"Code: 123-456", []string{"code", "123", "456"}},
+		{"Ünïcode straße", []string{"ünïcode", "straße"}},
+		{"  \t\n ", nil},
+	} {
+		if got := Tokenize(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	// The rest of long fields isn't indexed
+	long := strings.Repeat("word ", maxFieldTokens+10)
+	if got := len(Tokenize(long)); got != maxFieldTokens {
+		t.Errorf("got %d tokens, want %d", got, maxFieldTokens)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		want []Clause
+		err  bool
+	}{
+		{"hello", []Clause{{Tokens: []string{"hello"}}}, false},
+		{"Hello world", []Clause{{Tokens: []string{"hello"}}, {Tokens: []string{"world"}}}, false},
+		{`"reset your password"`, []Clause{{Tokens: []string{"reset", "your", "password"}}}, false},
+		{"from:alice@example.com", []Clause{{Field: FieldFrom, Tokens: []string{"alice", "example", "com"}}}, false},
+		{`Subject:"your code" 1234`, []Clause{{Field: FieldSubject, Tokens: []string{"your", "code"}}, {Tokens: []string{"1234"}}}, false},
+		{"unknown:word", []Clause{{Tokens: []string{"unknown", "word"}}}, false},
+		{`"unterminated phrase`, []Clause{{Tokens: []string{"unterminated", "phrase"}}}, false},
+		{"", nil, true},
+		{"!!! ...", nil, true},
+		{strings.Repeat("word ", maxClauses+1), nil, true},
+	} {
+		query, err := ParseQuery(tt.text)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) succeeded, want an error", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.text, err)
+			continue
+		}
+		if !slices.EqualFunc(query.Clauses, tt.want, func(a, b Clause) bool {
+			return a.Field == b.Field && slices.Equal(a.Tokens, b.Tokens)
+		}) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.text, query.Clauses, tt.want)
+		}
+	}
+
+	if _, err := ParseQuery(" "); !errors.Is(err, ErrEmptyQuery) {
+		t.Errorf("got %v, want %v", err, ErrEmptyQuery)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tokens := (&Document{
+		Subject: "Your verification code",
+		From:    "Example <noreply@example.com>",
+		To:      []string{"alice@example.com"},
+		Body:    "Use 123456 to sign in.",
+	}).Tokenize()
+
+	for text, want := range map[string]bool{
+		"code":                     true,
+		"code 123456":              true,
+		"code 654321":              false,
+		`"sign in"`:                true,
+		`"in sign"`:                false,
+		"subject:code":             true,
+		"subject:123456":           false,
+		"body:123456":              true,
+		"from:noreply@example.com": true,
+		"to:alice@example.com":     true,
+		"to:noreply@example.com":   false,
+		"verification sign alice":  true,
+	} {
+		query, err := ParseQuery(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tokens.Matches(query); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", text, got, want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"strings"
 )
@@ -15,3 +17,12 @@ func GenerateHash(s ...string) string {
 	)
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
+
+// GenerateToken returns a random URL-safe token built from n random bytes
+func GenerateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
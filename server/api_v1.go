@@ -0,0 +1,297 @@
+// server/api_v1.go
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal/redis"
+	"github.com/michelangelomo/ephimail/internal/search"
+)
+
+const (
+	// Number of messages in a page when no limit is given
+	defaultPageSize = 50
+	// Maximum number of messages in a page
+	maxPageSize = 200
+)
+
+// Orders of a message listing
+const (
+	sortReceivedDesc = "received_desc"
+	sortReceivedAsc  = "received_asc"
+)
+
+// MessagePage is a page of message summaries, the next page is fetched with
+// next_cursor as cursor
+type MessagePage struct {
+	Messages   []*redis.MessageSummary `json:"messages"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+// MessageUpdate is the body of a message update
+type MessageUpdate struct {
+	Read *bool `json:"read"`
+}
+
+// messageFilter selects the messages of a listing
+type messageFilter struct {
+	from           string
+	subject        string
+	since          time.Time
+	until          time.Time
+	hasAttachments *bool
+	unread         bool
+}
+
+// RegisterV1Handlers registers the versioned API handlers. The unversioned
+// routes are kept as they are for existing scripts.
+func (w *WebServer) RegisterV1Handlers(router *mux.Router) {
+	router.HandleFunc("/api/v1/inbox/{email}/messages", w.listMessages).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages", w.clearInbox).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}", w.getMessage).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}", w.updateMessage).Methods("PATCH", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}", w.deleteMessage).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}/raw", w.getRawEmail).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}/links", w.getMessageLinks).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}/codes", w.getMessageCodes).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}/html", w.getMessageHTML).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}/attachments", w.listAttachments).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/messages/{id}/attachments/{n}", w.getAttachment).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1/inbox/{email}/search", w.searchMessages).Methods("GET", "OPTIONS")
+}
+
+// listMessages returns a page of the message summaries of a mailbox,
+// filtered and sorted by the query parameters
+func (w *WebServer) listMessages(rw http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+
+	if _, ok := w.accessMailbox(rw, r, email); !ok {
+		return
+	}
+
+	w.writeMessagePage(rw, r, email, nil)
+}
+
+// searchMessages returns a page of the summaries of the messages of a mailbox
+// matching the q query, which are filtered and sorted as in listMessages.
+// Encrypted messages are not indexed.
+func (w *WebServer) searchMessages(rw http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+
+	if _, ok := w.accessMailbox(rw, r, email); !ok {
+		return
+	}
+
+	if w.Search == nil {
+		http.Error(rw, "Search is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	query, err := search.ParseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid query: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	ids, err := w.Search.Search(email, query)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to search emails: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	found := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		found[id] = true
+	}
+
+	w.writeMessagePage(rw, r, email, func(summary *redis.MessageSummary) bool {
+		return found[summary.ID]
+	})
+}
+
+// writeMessagePage writes the page of message summaries selected by the
+// query parameters and by match, if set
+func (w *WebServer) writeMessagePage(rw http.ResponseWriter, r *http.Request, email string, match func(*redis.MessageSummary) bool) {
+	query := r.URL.Query()
+
+	limit := defaultPageSize
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPageSize {
+			http.Error(rw, fmt.Sprintf("Invalid limit, allowed values: 1 to %d", maxPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	desc := true
+	switch query.Get("sort") {
+	case "", sortReceivedDesc:
+	case sortReceivedAsc:
+		desc = false
+	default:
+		http.Error(rw, fmt.Sprintf("Invalid sort, allowed values: %s, %s", sortReceivedDesc, sortReceivedAsc), http.StatusBadRequest)
+		return
+	}
+
+	var after int64
+	if cursor := query.Get("cursor"); cursor != "" {
+		var err error
+		after, err = decodeCursor(cursor)
+		if err != nil {
+			http.Error(rw, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter, err := parseMessageFilter(query)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid filter: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// One more match than the limit tells whether there is a next page
+	page := MessagePage{Messages: []*redis.MessageSummary{}}
+	more := false
+	err = w.storage.ScanSummaries(email, after, desc, func(summary *redis.MessageSummary) bool {
+		if !filter.matches(summary) || (match != nil && !match(summary)) {
+			return true
+		}
+		if len(page.Messages) == limit {
+			more = true
+			return false
+		}
+		page.Messages = append(page.Messages, summary)
+		return true
+	})
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get emails: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if more {
+		page.NextCursor = encodeCursor(page.Messages[len(page.Messages)-1].Seq)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(page)
+}
+
+// updateMessage marks a message as read or unread
+func (w *WebServer) updateMessage(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, ok := w.accessMailbox(rw, r, vars["email"]); !ok {
+		return
+	}
+
+	var update MessageUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if update.Read == nil {
+		http.Error(rw, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	found, err := w.storage.SetMessageRead(vars["email"], vars["id"], *update.Read)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to update email: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(rw, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// parseMessageFilter reads the filters of a listing from the query
+func parseMessageFilter(query url.Values) (*messageFilter, error) {
+	filter := &messageFilter{
+		from:    strings.ToLower(query.Get("from")),
+		subject: strings.ToLower(query.Get("subject")),
+	}
+
+	var err error
+	if value := query.Get("since"); value != "" {
+		if filter.since, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, fmt.Errorf("since must be an RFC 3339 date")
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		if filter.until, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, fmt.Errorf("until must be an RFC 3339 date")
+		}
+	}
+
+	if value := query.Get("has_attachments"); value != "" {
+		hasAttachments, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("has_attachments must be true or false")
+		}
+		filter.hasAttachments = &hasAttachments
+	}
+
+	if value := query.Get("unread"); value != "" {
+		if filter.unread, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("unread must be true or false")
+		}
+	}
+
+	return filter, nil
+}
+
+// matches tells whether a message is selected by the filter. Encrypted
+// messages without plaintext metadata never match sender or subject filters.
+func (f *messageFilter) matches(summary *redis.MessageSummary) bool {
+	if f.from != "" && !strings.Contains(strings.ToLower(summary.From), f.from) {
+		return false
+	}
+	if f.subject != "" && (summary.Encrypted || !strings.Contains(strings.ToLower(summary.Subject), f.subject)) {
+		return false
+	}
+	if !f.since.IsZero() && summary.ReceivedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !summary.ReceivedAt.Before(f.until) {
+		return false
+	}
+	if f.hasAttachments != nil && summary.HasAttachments != *f.hasAttachments {
+		return false
+	}
+	if f.unread && summary.Read {
+		return false
+	}
+	return true
+}
+
+// encodeCursor returns the opaque cursor of a position in the mailbox index
+func encodeCursor(seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(seq, 10)))
+}
+
+// decodeCursor returns the position in the mailbox index of a cursor
+func decodeCursor(cursor string) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || seq < 1 {
+		return 0, fmt.Errorf("invalid cursor")
+	}
+	return seq, nil
+}
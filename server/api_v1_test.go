@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+func TestListMessages(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+	router := web.Router()
+
+	const email = "alice@example.com"
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// store stores a message received at start plus i minutes
+	var seqs []int64
+	store := func(i int, read bool) {
+		t.Helper()
+
+		message := &redis.Message{
+			Body:       fmt.Sprintf("message %d", i),
+			ReceivedAt: start.Add(time.Duration(i) * time.Minute),
+			Read:       read,
+		}
+		if _, err := storage.StoreMessage(email, message); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, message.Seq)
+	}
+	for i := range 25 {
+		store(i, i%2 == 1)
+	}
+
+	list := func(query url.Values) (int, MessagePage) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/inbox/"+email+"/messages?"+query.Encode(), nil)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var page MessagePage
+		if rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, page
+	}
+	pageSeqs := func(page MessagePage) []int64 {
+		var seqs []int64
+		for _, summary := range page.Messages {
+			seqs = append(seqs, summary.Seq)
+		}
+		return seqs
+	}
+
+	t.Run("cursor", func(t *testing.T) {
+		if cursor := encodeCursor(42); cursor != "NDI" {
+			t.Errorf("got cursor %s", cursor)
+		}
+		if seq, err := decodeCursor(encodeCursor(42)); err != nil || seq != 42 {
+			t.Errorf("got %d, %v", seq, err)
+		}
+
+		for _, cursor := range []string{"!", "NDI=", encodeCursor(0), encodeCursor(-1), "YWJj"} {
+			if code, _ := list(url.Values{"cursor": {cursor}}); code != http.StatusBadRequest {
+				t.Errorf("cursor %q: got status %d, want %d", cursor, code, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		if _, page := list(nil); len(page.Messages) != 25 || page.NextCursor != "" {
+			t.Errorf("got %d messages and cursor %q by default", len(page.Messages), page.NextCursor)
+		}
+		if code, page := list(url.Values{"limit": {strconv.Itoa(maxPageSize)}}); code != http.StatusOK || len(page.Messages) != 25 {
+			t.Errorf("limit %d: got status %d, %d messages", maxPageSize, code, len(page.Messages))
+		}
+		for _, limit := range []string{"0", "-1", strconv.Itoa(maxPageSize + 1), "ten"} {
+			if code, _ := list(url.Values{"limit": {limit}}); code != http.StatusBadRequest {
+				t.Errorf("limit %s: got status %d, want %d", limit, code, http.StatusBadRequest)
+			}
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		// Every other message is read, newest first
+		_, page := list(url.Values{"unread": {"true"}})
+		var want []int64
+		for i := len(seqs) - 1; i >= 0; i -= 2 {
+			want = append(want, seqs[i])
+		}
+		if got := pageSeqs(page); !slices.Equal(got, want) {
+			t.Errorf("unread: got %v, want %v", got, want)
+		}
+
+		_, page = list(url.Values{"since": {start.Add(20 * time.Minute).Format(time.RFC3339)}, "sort": {sortReceivedAsc}})
+		if got := pageSeqs(page); !slices.Equal(got, seqs[20:]) {
+			t.Errorf("since: got %v, want %v", got, seqs[20:])
+		}
+
+		_, page = list(url.Values{"since": {start.Add(20 * time.Minute).Format(time.RFC3339)}, "unread": {"true"}, "limit": {"2"}})
+		if got := pageSeqs(page); !slices.Equal(got, []int64{seqs[24], seqs[22]}) || page.NextCursor == "" {
+			t.Errorf("since and unread: got %v and cursor %q", got, page.NextCursor)
+		}
+
+		for _, query := range []url.Values{{"since": {"yesterday"}}, {"unread": {"maybe"}}, {"sort": {"size"}}} {
+			if code, _ := list(query); code != http.StatusBadRequest {
+				t.Errorf("%v: got status %d, want %d", query, code, http.StatusBadRequest)
+			}
+		}
+	})
+
+	// Pages are walked while messages keep arriving, the messages stored
+	// before the first page are listed exactly once
+	for _, sort := range []string{sortReceivedDesc, sortReceivedAsc} {
+		t.Run("paging "+sort, func(t *testing.T) {
+			existing := slices.Clone(seqs)
+
+			var listed []int64
+			query := url.Values{"limit": {"7"}, "sort": {sort}}
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatal("paging doesn't end")
+				}
+
+				code, page := list(query)
+				if code != http.StatusOK {
+					t.Fatalf("got status %d", code)
+				}
+				listed = append(listed, pageSeqs(page)...)
+				if page.NextCursor == "" {
+					break
+				}
+				query.Set("cursor", page.NextCursor)
+
+				store(len(seqs), false)
+			}
+
+			seen := make(map[int64]bool)
+			for _, seq := range listed {
+				if seen[seq] {
+					t.Errorf("message %d listed twice", seq)
+				}
+				seen[seq] = true
+			}
+			for _, seq := range existing {
+				if !seen[seq] {
+					t.Errorf("message %d not listed", seq)
+				}
+			}
+
+			// Oldest first, the messages arriving are listed too
+			if sort == sortReceivedAsc && !slices.Equal(listed, seqs) {
+				t.Errorf("listed %v, want %v", listed, seqs)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+// server/attachments.go
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal/message"
+)
+
+// listAttachments returns the attachments of a message. Messages of
+// passphrase protected mailboxes, and those stored before attachments were
+// listed, are parsed when requested.
+func (w *WebServer) listAttachments(rw http.ResponseWriter, r *http.Request) {
+	stored, ok := w.readableMessage(rw, r)
+	if !ok {
+		return
+	}
+
+	attachments := stored.Attachments
+	if attachments == nil {
+		attachments = message.Attachments(stored.Body)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(attachments)
+}
+
+// getAttachment downloads the attachment of a message at index n, with
+// support for range requests. Attachments are never rendered by browsers,
+// whatever their content type.
+func (w *WebServer) getAttachment(rw http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || index < 0 {
+		http.Error(rw, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	stored, ok := w.readableMessage(rw, r)
+	if !ok {
+		return
+	}
+
+	attachment, content, err := message.AttachmentContent(stored.Body, index)
+	if errors.Is(err, message.ErrAttachmentNotFound) {
+		http.Error(rw, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get attachment: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	filename := attachment.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("attachment-%d", index)
+	}
+
+	rw.Header().Set("Content-Type", attachment.ContentType)
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	rw.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set("ETag", strconv.Quote(attachment.SHA256))
+	rw.Header().Set("Cache-Control", "private, max-age=3600")
+
+	// Serves ranges and conditional requests
+	http.ServeContent(rw, r, filename, stored.VisibleReceivedAt(), bytes.NewReader(content))
+}
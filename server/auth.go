@@ -0,0 +1,280 @@
+// server/auth.go
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal"
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// ErrUnauthorized is returned when a request can't access a reserved mailbox
+var ErrUnauthorized = errors.New("owner token required")
+
+// ErrLocked is returned when a request can't unlock a passphrase protected mailbox
+var ErrLocked = errors.New("passphrase or session token required")
+
+// ErrTooManyAttempts is returned when too many wrong passphrases were sent for
+// a passphrase protected mailbox, until the attempt window ends
+var ErrTooManyAttempts = errors.New("too many wrong passphrases")
+
+const (
+	// Wrong passphrases accepted for a mailbox within unlockAttemptWindow
+	maxUnlockAttempts = 5
+	// Window counting wrong passphrases, from the first one
+	unlockAttemptWindow = 15 * time.Minute
+)
+
+// isValidMailbox tells whether email is a single email address. Glob
+// characters are refused, mailboxes are looked up by key patterns in redis.
+func isValidMailbox(email string) bool {
+	if strings.ContainsAny(email, `*?[]\`) {
+		return false
+	}
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Name == "" && address.Address == email
+}
+
+// Routes taking patterns of mailboxes, their handlers authorize patterns to
+// admins only
+var patternRoutes = map[string]bool{
+	"/api/inbox/{email}/events": true,
+}
+
+// validateMailbox is a middleware rejecting the requests whose email route
+// variable is not a valid mailbox, before any storage access
+func validateMailbox(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		email, ok := mux.Vars(r)["email"]
+		if !ok || isValidMailbox(email) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if route := mux.CurrentRoute(r); route != nil && isPattern(email) {
+			if template, err := route.GetPathTemplate(); err == nil && patternRoutes[template] {
+				next.ServeHTTP(rw, r)
+				return
+			}
+		}
+		http.Error(rw, "Invalid email address", http.StatusBadRequest)
+	})
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// linkSignature computes the signature of a mailbox link valid until expires.
+// The key is the owner token hash, so rotating the token invalidates old links.
+func linkSignature(reservation *redis.Reservation, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(reservation.OwnerTokenHash))
+	fmt.Fprintf(mac, "%s:%d", reservation.Email, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedLinkQuery returns the query parameters of a signed mailbox link
+func signedLinkQuery(reservation *redis.Reservation) url.Values {
+	expires := reservation.ExpiresAt.Unix()
+	return url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {linkSignature(reservation, expires)},
+	}
+}
+
+// verifySignedLink checks the expires and sig query parameters of a request
+func verifySignedLink(reservation *redis.Reservation, query url.Values) bool {
+	sig := query.Get("sig")
+	if sig == "" || reservation.OwnerTokenHash == "" {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(linkSignature(reservation, expires)))
+}
+
+// authorizeOwner checks that token, or the signed link in query, grants access
+// to the mailbox. Unreserved mailboxes are open to everyone.
+func (w *WebServer) authorizeOwner(email, token string, query url.Values) (*redis.Reservation, error) {
+	reservation, err := w.storage.GetReservation(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation: %w", err)
+	}
+
+	if reservation == nil {
+		return nil, nil
+	}
+
+	if reservation.VerifyOwnerToken(token) || verifySignedLink(reservation, query) {
+		return reservation, nil
+	}
+
+	return reservation, ErrUnauthorized
+}
+
+// authorizeMailbox checks that the request is allowed to access the mailbox,
+// writing an error response and returning false if it isn't
+func (w *WebServer) authorizeMailbox(rw http.ResponseWriter, r *http.Request, email string) (*redis.Reservation, bool) {
+	reservation, err := w.authorizeOwner(email, bearerToken(r), r.URL.Query())
+	if errors.Is(err, ErrUnauthorized) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="ephimail"`)
+		http.Error(rw, "Mailbox is reserved, owner token required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to check mailbox status: %s", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return reservation, true
+}
+
+// authorizeReservationOwner checks that the request carries the owner token
+// of a reserved mailbox, writing an error response and returning false if it
+// doesn't. Signed links only grant read access.
+func (w *WebServer) authorizeReservationOwner(rw http.ResponseWriter, r *http.Request, email string) (*redis.Reservation, bool) {
+	reservation, err := w.storage.GetReservation(email)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to check mailbox status: %s", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if reservation == nil {
+		http.Error(rw, "Reservation not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	if !reservation.VerifyOwnerToken(bearerToken(r)) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="ephimail"`)
+		http.Error(rw, "Owner token required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return reservation, true
+}
+
+// authorizeAdmin checks the admin token of a request, admin access is
+// disabled when no admin token is configured
+func (w *WebServer) authorizeAdmin(r *http.Request) bool {
+	return w.isAdminToken(bearerToken(r))
+}
+
+// isAdminToken checks a token against the admin token
+func (w *WebServer) isAdminToken(token string) bool {
+	if w.AdminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.AdminToken)) == 1
+}
+
+// unlockMailbox returns the private key of a passphrase protected mailbox,
+// unlocked with the session token or the passphrase sent with the request
+func (w *WebServer) unlockMailbox(r *http.Request, reservation *redis.Reservation) (*ecdh.PrivateKey, error) {
+	return w.unlockMailboxWith(reservation, r.Header.Get("X-Mailbox-Session"), r.Header.Get("X-Mailbox-Passphrase"))
+}
+
+// unlockMailboxWith returns the private key of a passphrase protected mailbox,
+// unlocked with the session token or else the passphrase
+func (w *WebServer) unlockMailboxWith(reservation *redis.Reservation, sessionToken, passphrase string) (*ecdh.PrivateKey, error) {
+	if sessionToken != "" {
+		storage, ok := w.storage.(*redis.RedisStorage)
+		if !ok {
+			return nil, fmt.Errorf("invalid storage type")
+		}
+
+		wrappedKey, err := storage.GetMailboxSession(reservation.Email, internal.GenerateHash(sessionToken))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get session: %w", err)
+		}
+		if wrappedKey == "" {
+			return nil, ErrLocked
+		}
+
+		privateKey, err := encryption.UnwrapSessionKey(wrappedKey, sessionToken)
+		if err != nil {
+			return nil, ErrLocked
+		}
+		return privateKey, nil
+	}
+
+	if passphrase != "" {
+		privateKey, err := w.unlockWithPassphrase(reservation, passphrase)
+		if errors.Is(err, encryption.ErrWrongPassphrase) {
+			return nil, ErrLocked
+		}
+		return privateKey, err
+	}
+
+	return nil, ErrLocked
+}
+
+// unlockWithPassphrase returns the private key of a passphrase protected
+// mailbox, counting wrong passphrases so that they can't be brute-forced. It
+// returns ErrTooManyAttempts without trying once too many were sent.
+func (w *WebServer) unlockWithPassphrase(reservation *redis.Reservation, passphrase string) (*ecdh.PrivateKey, error) {
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		return nil, fmt.Errorf("invalid storage type")
+	}
+
+	failures, _, err := storage.UnlockFailures(reservation.Email)
+	if err != nil {
+		return nil, err
+	}
+	if failures >= maxUnlockAttempts {
+		return nil, ErrTooManyAttempts
+	}
+
+	privateKey, err := reservation.PassphraseKey.Unlock(passphrase)
+	if errors.Is(err, encryption.ErrWrongPassphrase) {
+		if err := storage.RecordUnlockFailure(reservation.Email, unlockAttemptWindow); err != nil {
+			return nil, err
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if failures > 0 {
+		if err := storage.ResetUnlockFailures(reservation.Email); err != nil {
+			return nil, err
+		}
+	}
+	return privateKey, nil
+}
+
+// writeTooManyAttempts writes the response to a request refused with
+// ErrTooManyAttempts, telling when passphrases are accepted again
+func (w *WebServer) writeTooManyAttempts(rw http.ResponseWriter, email string) {
+	if storage, ok := w.storage.(*redis.RedisStorage); ok {
+		if _, retryAfter, err := storage.UnlockFailures(email); err == nil && retryAfter > 0 {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+		}
+	}
+	http.Error(rw, "Too many wrong passphrases, try again later", http.StatusTooManyRequests)
+}
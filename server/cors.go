@@ -3,6 +3,7 @@ package server
 
 import (
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 )
@@ -12,6 +13,7 @@ type CORSConfig struct {
 	AllowedOrigins []string
 	AllowedMethods []string
 	AllowedHeaders []string
+	ExposedHeaders []string // Response headers readable by scripts
 }
 
 // NewCORSConfig creates a new CORS configuration from environment
@@ -30,8 +32,9 @@ func NewCORSConfig() *CORSConfig {
 
 	return &CORSConfig{
 		AllowedOrigins: origins,
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", "X-Mailbox-Session", "X-Mailbox-Passphrase", "Last-Event-ID", "Range"},
+		ExposedHeaders: []string{"Content-Disposition", "Content-Range", "Accept-Ranges", "ETag"},
 	}
 }
 
@@ -39,16 +42,7 @@ func NewCORSConfig() *CORSConfig {
 func (c *CORSConfig) EnableCORS(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 
-	// Check if origin is allowed
-	allowed := false
-	for _, allowedOrigin := range c.AllowedOrigins {
-		if allowedOrigin == "*" || allowedOrigin == origin {
-			allowed = true
-			break
-		}
-	}
-
-	if allowed {
+	if c.IsAllowedOrigin(origin) {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 	} else if len(c.AllowedOrigins) > 0 {
 		// Use the first allowed origin as default
@@ -57,9 +51,43 @@ func (c *CORSConfig) EnableCORS(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
 	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
 	w.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
 }
 
+// IsAllowedOrigin tells whether an origin is allowed
+func (c *CORSConfig) IsAllowedOrigin(origin string) bool {
+	for _, allowedOrigin := range c.AllowedOrigins {
+		if allowedOrigin == "*" || allowedOrigin == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// FrameAncestors returns the sources allowed to embed the documents served,
+// the origins allowed by CORS
+func (c *CORSConfig) FrameAncestors() string {
+	return strings.Join(append([]string{"'self'"}, c.AllowedOrigins...), " ")
+}
+
+// CheckOrigin checks the origin of a WebSocket handshake. Browsers always send
+// it, requests without one come from other clients, which aren't subject to
+// the same-origin policy anyway.
+func (c *CORSConfig) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	// Same origin
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return c.IsAllowedOrigin(origin)
+}
+
 // CORSMiddleware returns a middleware that handles CORS
 func (c *CORSConfig) CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
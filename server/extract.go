@@ -0,0 +1,43 @@
+// server/extract.go
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/michelangelomo/ephimail/internal/extract"
+)
+
+// getMessageLinks returns the links found in a message
+func (w *WebServer) getMessageLinks(rw http.ResponseWriter, r *http.Request) {
+	w.writeExtracted(rw, r, func(result *extract.Result) interface{} {
+		return result.Links
+	})
+}
+
+// getMessageCodes returns the one-time codes, and the values of custom
+// extractors, found in a message
+func (w *WebServer) getMessageCodes(rw http.ResponseWriter, r *http.Request) {
+	w.writeExtracted(rw, r, func(result *extract.Result) interface{} {
+		return result.Codes
+	})
+}
+
+// writeExtracted writes the part selected by field of what was extracted
+// from a message. Messages of passphrase protected mailboxes, and those stored
+// before extraction, go through the extractors when requested.
+func (w *WebServer) writeExtracted(rw http.ResponseWriter, r *http.Request, field func(*extract.Result) interface{}) {
+	message, ok := w.readableMessage(rw, r)
+	if !ok {
+		return
+	}
+
+	result := message.Extracted
+	if result == nil {
+		result = w.Extractors.Extract(message.Body)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(field(result))
+}
@@ -0,0 +1,110 @@
+// server/html.go
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal/message"
+	"github.com/michelangelomo/ephimail/internal/sanitize"
+)
+
+// Wraps sanitized bodies, the document is meant to be shown in an iframe
+const htmlDocument = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="referrer" content="no-referrer">
+<style>body{margin:0;padding:8px;font-family:sans-serif;overflow-wrap:break-word}img{max-width:100%%;height:auto}pre{white-space:pre-wrap}</style>
+</head>
+<body>
+%s
+</body>
+</html>
+`
+
+// getMessageHTML returns the HTML body of a message sanitized, or its text
+// body if it has none. The document is served sandboxed, without scripts nor
+// forms, and remote images are blocked unless remote_images is true. Inline
+// parts referenced by cid: URLs are loaded from the attachment endpoint.
+func (w *WebServer) getMessageHTML(rw http.ResponseWriter, r *http.Request) {
+	remoteImages := false
+	if value := r.URL.Query().Get("remote_images"); value != "" {
+		var err error
+		if remoteImages, err = strconv.ParseBool(value); err != nil {
+			http.Error(rw, "Invalid remote_images, allowed values: true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stored, ok := w.readableMessage(rw, r)
+	if !ok {
+		return
+	}
+
+	text, document := message.Bodies(stored.Body)
+	var body string
+	if strings.TrimSpace(document) != "" {
+		body = sanitize.HTML(document, sanitize.Options{
+			ContentURL:   attachmentURLs(r, stored.Attachments, stored.Body),
+			RemoteImages: remoteImages,
+		})
+	} else {
+		body = "<pre>" + html.EscapeString(strings.ToValidUTF8(text, "�")) + "</pre>"
+	}
+
+	imageSources := "'self' data:"
+	if remoteImages {
+		imageSources += " https: http:"
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Content-Security-Policy", strings.Join([]string{
+		"default-src 'none'",
+		"img-src " + imageSources,
+		"style-src 'unsafe-inline'",
+		"form-action 'none'",
+		"base-uri 'none'",
+		"frame-ancestors " + w.corsConfig.FrameAncestors(),
+		// Links open in new windows, outside of the sandbox
+		"sandbox allow-popups allow-popups-to-escape-sandbox",
+	}, "; "))
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set("Referrer-Policy", "no-referrer")
+	rw.Header().Set("Cache-Control", "private, no-cache")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, htmlDocument, body)
+}
+
+// attachmentURLs returns the function mapping the content IDs of a message to
+// the URLs of its attachments. The signed link of the request, if any, is
+// passed on so that images of reserved mailboxes load.
+func attachmentURLs(r *http.Request, attachments []*message.Attachment, raw string) func(string) string {
+	return func(contentID string) string {
+		if attachments == nil {
+			attachments = message.Attachments(raw)
+		}
+
+		for _, attachment := range attachments {
+			if attachment.ContentID == "" || attachment.ContentID != contentID {
+				continue
+			}
+
+			vars := mux.Vars(r)
+			link := fmt.Sprintf("/api/v1/inbox/%s/messages/%s/attachments/%d",
+				url.PathEscape(vars["email"]), url.PathEscape(vars["id"]), attachment.Index)
+
+			query := r.URL.Query()
+			if query.Get("sig") != "" {
+				link += "?" + url.Values{"expires": {query.Get("expires")}, "sig": {query.Get("sig")}}.Encode()
+			}
+			return link
+		}
+		return ""
+	}
+}
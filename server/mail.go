@@ -10,28 +10,49 @@ import (
 	"time"
 
 	"github.com/emersion/go-smtp"
+	"github.com/michelangelomo/ephimail/internal/extract"
+	"github.com/michelangelomo/ephimail/internal/message"
 	"github.com/michelangelomo/ephimail/internal/redis"
+	"github.com/michelangelomo/ephimail/internal/search"
 	"github.com/urfave/cli/v2"
 )
 
+// DomainMode controls which recipients of a domain are accepted
+type DomainMode string
+
+const (
+	// DomainModeOpen accepts mail for any local part (catch-all)
+	DomainModeOpen DomainMode = "open"
+	// DomainModeReservedOnly accepts mail only for reserved mailboxes
+	DomainModeReservedOnly DomainMode = "reserved-only"
+)
+
 type MailServer struct {
 	Address        string
 	Port           int
 	AllowedDomains cli.StringSlice
+	DomainModes    cli.StringSlice
+	Webhooks       *WebhookDispatcher // Notified of each stored message if set
+	Search         search.Index       // Indexes the messages stored in clear if set
+	Extractors     *extract.Pipeline  // Finds codes and links in the messages stored in clear
 
 	storage redis.Storage
+	modes   map[string]DomainMode
 }
 
 func NewMailServer(storage redis.Storage) *MailServer {
 	return &MailServer{
-		storage: storage,
+		Extractors: extract.NewPipeline(),
+		storage:    storage,
 	}
 }
 
 func (m *MailServer) Run() {
 	b := &Backend{
-		allowed: m.isAllowed,
-		storage: m.storage,
+		allowed:    m.isAllowed,
+		storage:    m.storage,
+		search:     m.Search,
+		extractors: m.Extractors,
 	}
 
 	s := smtp.NewServer(b)
@@ -49,6 +70,34 @@ func (m *MailServer) Run() {
 	}
 }
 
+// LoadDomainModes parses the domain modes, given as "domain=mode" entries.
+// Domains without an entry are open.
+func (m *MailServer) LoadDomainModes() error {
+	m.modes = make(map[string]DomainMode)
+	for _, entry := range m.DomainModes.Value() {
+		domain, mode, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid domain mode %q, expected domain=mode", entry)
+		}
+
+		switch DomainMode(mode) {
+		case DomainModeOpen, DomainModeReservedOnly:
+			m.modes[domain] = DomainMode(mode)
+		default:
+			return fmt.Errorf("invalid mode %q for domain %s, allowed values: %s, %s", mode, domain, DomainModeOpen, DomainModeReservedOnly)
+		}
+	}
+	return nil
+}
+
+// domainMode returns the mode of a domain
+func (m MailServer) domainMode(domain string) DomainMode {
+	if mode, ok := m.modes[domain]; ok {
+		return mode
+	}
+	return DomainModeOpen
+}
+
 func (m MailServer) isAllowed(rcpt string) error {
 	// check if address is valid
 	address, err := mail.ParseAddress(rcpt)
@@ -60,16 +109,43 @@ func (m MailServer) isAllowed(rcpt string) error {
 
 	for _, d := range m.AllowedDomains.Value() {
 		if d == comp[1] {
-			return nil
+			return m.isDeliverable(address.Address, d)
 		}
 	}
 	return fmt.Errorf("%s is not allowed", comp[1])
 }
 
+// isDeliverable checks that the mailbox accepts mail according to its domain mode
+func (m MailServer) isDeliverable(address, domain string) error {
+	if m.domainMode(domain) != DomainModeReservedOnly {
+		return nil
+	}
+
+	reservation, err := m.storage.GetReservation(address)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Requested action aborted: local error in processing",
+		}
+	}
+
+	if reservation == nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Requested action not taken: mailbox unavailable",
+		}
+	}
+	return nil
+}
+
 // The Backend implements SMTP server methods.
 type Backend struct {
-	allowed func(string) error
-	storage redis.Storage
+	allowed    func(string) error
+	storage    redis.Storage
+	search     search.Index      // Indexes the messages stored in clear if set
+	extractors *extract.Pipeline // Finds codes and links in the messages stored in clear if set
 }
 
 // A Session is returned after successful login.
@@ -94,26 +170,44 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	return nil
 }
 
+// Rcpt sets the recipient of the mail, only once it is allowed
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.Recipient = to
-	if err := s.Backend.allowed(s.Recipient); err != nil {
+	if err := s.Backend.allowed(to); err != nil {
 		fmt.Printf("Recipient error: %v\n", err)
 		return err
 	}
+	s.Recipient = to
 	return nil
 }
 
+// errNoRecipient is returned for mail sent without an allowed recipient
+var errNoRecipient = &smtp.SMTPError{
+	Code:         503,
+	EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+	Message:      "Bad sequence of commands: no valid recipient",
+}
+
 func (s *Session) Data(r io.Reader) error {
+	if s.Recipient == "" {
+		return errNoRecipient
+	}
+
 	b, err := io.ReadAll(r)
 	if err != nil {
 		fmt.Printf("can't decode email: %v\n", err)
 		return fmt.Errorf("can't decode mail")
 	}
 
-	_, err = mail.ReadMessage(bytes.NewReader(b))
+	_, err = s.storeMessage(b)
+	return err
+}
+
+// storeMessage validates and stores an email in clear, it returns the stored message
+func (s *Session) storeMessage(b []byte) (*redis.Message, error) {
+	_, err := mail.ReadMessage(bytes.NewReader(b))
 	if err != nil {
 		fmt.Printf("can't decode email: %v\n", err)
-		return fmt.Errorf("can't decode mail")
+		return nil, fmt.Errorf("can't decode mail")
 	}
 
 	// is this useful? `To` field in headers is usually formatted as NAME <EMAIL> so it will never match the recipient
@@ -124,17 +218,36 @@ func (s *Session) Data(r io.Reader) error {
 	// }
 
 	// save on redis
-	err = s.Backend.storage.StoreEmail(
-		s.Recipient,
-		string(b),
-	)
+	stored := &redis.Message{
+		Body:       string(b),
+		Size:       len(b),
+		ReceivedAt: time.Now(),
+	}
+	headers, err := message.ParseHeaders(string(b))
+	if err == nil {
+		stored.From = headers.From
+		stored.FromDomain = headers.FromDomain
+		stored.Subject = headers.Subject
+	}
+	stored.HasAttachments = message.HasAttachments(string(b))
+	stored.Attachments = message.Attachments(string(b))
+	if s.Backend.extractors != nil {
+		stored.Extracted = s.Backend.extractors.Extract(string(b))
+	}
+	_, err = s.Backend.storage.StoreMessage(s.Recipient, stored)
 	if err != nil {
 		fmt.Printf("Error: %v", err)
+		return nil, err
 	}
-	return nil
+
+	indexMessage(s.Backend.search, s.Recipient, stored, headers)
+
+	return stored, nil
 }
 
-func (s *Session) Reset() {}
+func (s *Session) Reset() {
+	s.Recipient = ""
+}
 
 func (s *Session) Logout() error {
 	return nil
@@ -2,7 +2,6 @@
 package server
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -10,7 +9,10 @@ import (
 
 	"github.com/emersion/go-smtp"
 	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/extract"
+	"github.com/michelangelomo/ephimail/internal/message"
 	"github.com/michelangelomo/ephimail/internal/redis"
+	"github.com/michelangelomo/ephimail/internal/search"
 )
 
 // EncryptingBackend extends the Backend to handle encrypted emails
@@ -18,17 +20,21 @@ type EncryptingBackend struct {
 	Backend
 	storageWithEncryption *redis.RedisStorage
 	webSocketHub          *WebSocketHub
+	webhooks              *WebhookDispatcher
 }
 
 // NewEncryptingBackend creates a new encrypting backend
-func NewEncryptingBackend(allowed func(string) error, storage *redis.RedisStorage, hub *WebSocketHub) *EncryptingBackend {
+func NewEncryptingBackend(allowed func(string) error, storage *redis.RedisStorage, hub *WebSocketHub, webhooks *WebhookDispatcher, index search.Index, extractors *extract.Pipeline) *EncryptingBackend {
 	return &EncryptingBackend{
 		Backend: Backend{
-			allowed: allowed,
-			storage: storage,
+			allowed:    allowed,
+			storage:    storage,
+			search:     index,
+			extractors: extractors,
 		},
 		storageWithEncryption: storage,
 		webSocketHub:          hub,
+		webhooks:              webhooks,
 	}
 }
 
@@ -37,6 +43,7 @@ type EncryptingSession struct {
 	Session
 	storageWithEncryption *redis.RedisStorage
 	webSocketHub          *WebSocketHub
+	webhooks              *WebhookDispatcher
 }
 
 // NewSession creates a new session with encryption support
@@ -47,63 +54,154 @@ func (b *EncryptingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 		},
 		storageWithEncryption: b.storageWithEncryption,
 		webSocketHub:          b.webSocketHub,
+		webhooks:              b.webhooks,
 	}, nil
 }
 
 // Data handles incoming email data with encryption support
 func (s *EncryptingSession) Data(r io.Reader) error {
+	if s.Recipient == "" {
+		return errNoRecipient
+	}
+
 	// Read the email data
 	b, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
+	stored, err := s.store(b)
+	if err != nil {
+		return err
+	}
+
+	// Notify WebSocket clients if available
+	if s.webSocketHub != nil {
+		s.webSocketHub.NotifyNewEmail(s.Recipient, stored)
+	}
+
+	// Queue webhook deliveries, the message is stored whatever happens
+	if s.webhooks != nil {
+		if err := s.webhooks.Enqueue(s.Recipient, stored); err != nil {
+			log.Printf("Error queueing webhooks for %s: %v", s.Recipient, err)
+		}
+	}
+
+	return nil
+}
+
+// store encrypts the email as required by the reservation of the recipient
+// and stores it, it returns the stored message
+func (s *EncryptingSession) store(b []byte) (*redis.Message, error) {
 	// Check if the recipient's mailbox is reserved and encrypted
 	reservation, err := s.storageWithEncryption.GetReservation(s.Recipient)
 	if err != nil {
 		// Fall back to standard behavior if error occurs
-		return s.Session.Data(bytes.NewReader(b))
+		return s.Session.storeMessage(b)
+	}
+
+	// If mailbox is protected by passphrase, encrypt the email at rest.
+	// There is no fallback to clear text, the sender will retry.
+	if reservation != nil && reservation.PassphraseProtected {
+		encryptedBody, err := encryption.EncryptForMailbox(string(b), reservation.PassphraseKey.PublicKey)
+		if err != nil {
+			log.Printf("Error encrypting email for %s: %v", s.Recipient, err)
+			return nil, &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Requested action aborted: local error in processing",
+			}
+		}
+
+		encrypted := &redis.Message{
+			Body:       encryptedBody,
+			Size:       len(b),
+			ReceivedAt: time.Now(),
+			Encrypted:  true,
+			Algorithm:  encryption.AlgX25519AESGCM,
+		}
+		if _, err := s.Backend.storage.StoreMessage(s.Recipient, encrypted); err != nil {
+			return nil, err
+		}
+
+		return encrypted, nil
 	}
 
 	// If mailbox is reserved and uses encryption, encrypt the email
 	if reservation != nil && reservation.Encrypted && reservation.PublicKey != "" {
 		// Encrypt the email body with the recipient's public key
-		encryptedBody, err := encryption.EncryptWithSymmetricKey(string(b), reservation.PublicKey)
+		// There is no fallback to clear text either, the owner expects
+		// encrypted mail only
+		encrypted, err := encryptMessage(string(b), reservation)
 		if err != nil {
-			// If encryption fails, still deliver the email unencrypted
-			// This is a trade-off between security and reliability
-			return s.Session.Data(bytes.NewReader(b))
+			log.Printf("Error encrypting email for %s: %v", s.Recipient, err)
+			return nil, &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Requested action aborted: local error in processing",
+			}
 		}
 
 		// Save the encrypted email
-		err = s.Backend.storage.StoreEmail(s.Recipient, encryptedBody)
-		if err != nil {
-			return err
+		if _, err := s.Backend.storage.StoreMessage(s.Recipient, encrypted); err != nil {
+			return nil, err
 		}
 
-		// Notify WebSocket clients if available
-		if s.webSocketHub != nil {
-			// We'd extract a message ID here in a real implementation
-			s.webSocketHub.NotifyNewEmail(s.Recipient, "")
-		}
-
-		return nil
+		return encrypted, nil
 	}
 
 	// If not encrypted, use standard behavior
-	err = s.Session.Data(bytes.NewReader(b))
+	return s.Session.storeMessage(b)
+}
+
+// encryptMessage encrypts an email for the public key of a reservation.
+// Mailboxes keeping plaintext metadata also get the subject encrypted on its
+// own, and only the selected metadata is stored along with the message.
+func encryptMessage(raw string, reservation *redis.Reservation) (*redis.Message, error) {
+	body, err := encryption.EncryptEmail(raw, reservation.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The reception time is always kept to order and expire messages, it is
+	// only shown if selected like any other metadata
+	encrypted := &redis.Message{
+		Body:           body,
+		Encrypted:      true,
+		Algorithm:      encryption.AlgorithmFor(reservation.KeyType),
+		ReceivedAt:     time.Now(),
+		HideReceivedAt: !reservation.KeepsMetadata(redis.MetadataReceivedAt),
+	}
 
-	// Notify WebSocket clients after successful delivery
-	if err == nil && s.webSocketHub != nil {
-		s.webSocketHub.NotifyNewEmail(s.Recipient, "")
+	// Without metadata, nothing but the ciphertext is shown
+	if len(reservation.Metadata) == 0 {
+		return encrypted, nil
+	}
+
+	// Unparsable headers are left to the client, the message is still encrypted
+	headers, err := message.ParseHeaders(raw)
+	if err != nil {
+		headers = &message.Headers{}
+	}
+
+	encrypted.Subject, err = encryption.EncryptEmail(headers.Subject, reservation.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if reservation.KeepsMetadata(redis.MetadataSize) {
+		encrypted.Size = len(raw)
+	}
+	if reservation.KeepsMetadata(redis.MetadataFromDomain) {
+		encrypted.FromDomain = headers.FromDomain
 	}
 
-	return err
+	return encrypted, nil
 }
 
 // RunWithEncryption starts a mail server with encryption support
 func (m *MailServer) RunWithEncryption(storage *redis.RedisStorage, wsHub *WebSocketHub) {
-	b := NewEncryptingBackend(m.isAllowed, storage, wsHub)
+	b := NewEncryptingBackend(m.isAllowed, storage, wsHub, m.Webhooks, m.Search, m.Extractors)
 
 	s := smtp.NewServer(b)
 
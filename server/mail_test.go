@@ -0,0 +1,196 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/redis"
+	"github.com/urfave/cli/v2"
+)
+
+func TestRejectedRecipientGetsNoMail(t *testing.T) {
+	storage, _ := newTestStorage(t)
+
+	mailServer := NewMailServer(storage)
+	mailServer.AllowedDomains = *cli.NewStringSlice("open.com", "reserved.com")
+	mailServer.DomainModes = *cli.NewStringSlice("reserved.com=reserved-only")
+	if err := mailServer.LoadDomainModes(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.ReserveMailbox("bob@reserved.com", redis.OneHour, "", "", nil, "token", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewEncryptingBackend(mailServer.isAllowed, storage, nil, nil, nil, nil)
+	const body = "Subject: hello\r\n\r\nhello\r\n"
+
+	// A valid recipient followed by a rejected one
+	session, _ := backend.NewSession(nil)
+	if err := session.Rcpt("alice@open.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Rcpt("mallory@reserved.com", nil); err == nil {
+		t.Fatal("recipient of a reserved-only domain accepted")
+	}
+	if err := session.Data(strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only rejected recipients, then DATA anyway
+	session, _ = backend.NewSession(nil)
+	if err := session.Rcpt("mallory@reserved.com", nil); err == nil {
+		t.Fatal("recipient of a reserved-only domain accepted")
+	}
+	if err := session.Data(strings.NewReader(body)); err == nil {
+		t.Fatal("mail accepted without a valid recipient")
+	}
+
+	// Recipients don't outlive the transaction
+	session.Rcpt("alice@open.com", nil)
+	session.Reset()
+	if err := session.Data(strings.NewReader(body)); err == nil {
+		t.Fatal("mail accepted after a reset")
+	}
+
+	for to, want := range map[string]int{"alice@open.com": 1, "mallory@reserved.com": 0} {
+		emails, err := storage.RetrieveEmails(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(emails) != want {
+			t.Errorf("%s got %d emails, want %d", to, len(emails), want)
+		}
+	}
+}
+
+func TestHiddenReceivedAt(t *testing.T) {
+	storage, _ := newTestStorage(t)
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+	if _, err := storage.ReserveMailbox("bob@example.com", redis.OneHour, publicKey, encryption.KeyTypeX25519, []string{redis.MetadataSize}, "token", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewEncryptingBackend(func(string) error { return nil }, storage, nil, nil, nil, nil)
+	for _, subject := range []string{"first", "second"} {
+		session, _ := backend.NewSession(nil)
+		if err := session.Rcpt("bob@example.com", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Data(strings.NewReader("Subject: " + subject + "\r\n\r\nhello\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := storage.RetrieveMessages("bob@example.com")
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("got %d messages: %v", len(messages), err)
+	}
+
+	// Kept for ordering, newest first
+	if messages[0].ReceivedAt.IsZero() || messages[0].ReceivedAt.Before(messages[1].ReceivedAt) {
+		t.Errorf("messages not ordered by reception: %v, %v", messages[0].ReceivedAt, messages[1].ReceivedAt)
+	}
+
+	// But never shown
+	for _, value := range []interface{}{messages[0], messages[0].Summary()} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "received_at") {
+			t.Errorf("reception time shown: %s", data)
+		}
+	}
+}
+
+func TestEncryptionFailureIsTemporary(t *testing.T) {
+	storage, _ := newTestStorage(t)
+
+	// A key that stopped working after the reservation, mail must not be
+	// stored in clear instead
+	if _, err := storage.ReserveMailbox("bob@example.com", redis.OneHour, "not a key", encryption.KeyTypeRSA, nil, "token", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewEncryptingBackend(func(string) error { return nil }, storage, nil, nil, nil, nil)
+	session, _ := backend.NewSession(nil)
+	if err := session.Rcpt("bob@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := session.Data(strings.NewReader("Subject: secret\r\n\r\nhello\r\n")); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("got %v, want a 451 error", err)
+	}
+
+	if emails, err := storage.RetrieveEmails("bob@example.com"); err != nil || len(emails) != 0 {
+		t.Errorf("got %d emails stored, want none: %v", len(emails), err)
+	}
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+	const raw = "From: carol@sender.com\r\nSubject: secret\r\n\r\nhello\r\n"
+
+	tests := []struct {
+		name     string
+		metadata []string
+		shown    []string
+	}{
+		{"none", nil, nil},
+		{"size", []string{redis.MetadataSize}, []string{"size"}},
+		{"received_at", []string{redis.MetadataReceivedAt}, []string{"received_at"}},
+		{"from_domain", []string{redis.MetadataFromDomain}, []string{"from_domain"}},
+		{"all", redis.MetadataFields, []string{"size", "received_at", "from_domain"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := encryptMessage(raw, &redis.Reservation{
+				PublicKey: publicKey,
+				KeyType:   encryption.KeyTypeX25519,
+				Encrypted: true,
+				Metadata:  tt.metadata,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := json.Marshal(encrypted.Summary())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fields map[string]interface{}
+			json.Unmarshal(data, &fields)
+
+			// Keeping no metadata shows no more than any selection
+			for _, field := range []string{"size", "received_at", "from_domain"} {
+				_, got := fields[field]
+				want := slices.Contains(tt.shown, field)
+				if got != want {
+					t.Errorf("%s shown: %v, want %v in %s", field, got, want, data)
+				}
+			}
+			if strings.Contains(string(data), "secret") || strings.Contains(string(data), "carol") {
+				t.Errorf("plaintext shown: %s", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// server/openapi.go
+package server
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// OpenAPI document of the HTTP API, every route of the routers must be
+// described in it
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Page listing the operations of the OpenAPI document
+//
+//go:embed docs.html
+var docsPage []byte
+
+// RegisterDocsHandlers registers the handlers serving the API documentation
+func (w *WebServer) RegisterDocsHandlers(router *mux.Router) {
+	router.HandleFunc("/api/openapi.json", w.getOpenAPISpec).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/docs", w.getDocs).Methods("GET", "OPTIONS")
+}
+
+// getOpenAPISpec returns the OpenAPI document
+func (w *WebServer) getOpenAPISpec(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(openAPISpec)
+}
+
+// getDocs returns the documentation page
+func (w *WebServer) getDocs(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(docsPage)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Routes serving the frontend rather than the API
+var staticRoutes = map[string]bool{
+	"/":      true,
+	"/dist/": true,
+}
+
+// openAPIOperations returns the methods of each path of the OpenAPI document
+func openAPIOperations(t *testing.T) map[string]map[string]bool {
+	t.Helper()
+
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("invalid OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("expected an OpenAPI 3 document, got version %q", spec.OpenAPI)
+	}
+
+	operations := make(map[string]map[string]bool)
+	for path, item := range spec.Paths {
+		operations[path] = make(map[string]bool)
+		for method := range item {
+			operations[path][strings.ToUpper(method)] = true
+		}
+	}
+	return operations
+}
+
+// routeOperations returns the methods of each path template of a router,
+// routes matching any method are taken as GET
+func routeOperations(t *testing.T, router *mux.Router) map[string]map[string]bool {
+	t.Helper()
+
+	operations := make(map[string]map[string]bool)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || staticRoutes[path] {
+			return nil
+		}
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+
+		if operations[path] == nil {
+			operations[path] = make(map[string]bool)
+		}
+		for _, method := range methods {
+			if method != http.MethodOptions {
+				operations[path][method] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return operations
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	spec := openAPIOperations(t)
+
+	routers := map[string]*mux.Router{
+		"WebServer":              NewWebServer(nil, nil).Router(),
+		"WebServerWithWebSocket": NewWebServerWithWebSocket(nil, nil).Router(),
+	}
+	for name, router := range routers {
+		for path, methods := range routeOperations(t, router) {
+			for method := range methods {
+				if !spec[path][method] {
+					t.Errorf("%s: %s %s is missing from openapi.json", name, method, path)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenAPIDescribesRoutes(t *testing.T) {
+	routes := routeOperations(t, NewWebServerWithWebSocket(nil, nil).Router())
+
+	for path, methods := range openAPIOperations(t) {
+		for method := range methods {
+			if !routes[path][method] {
+				t.Errorf("%s %s is described in openapi.json but not routed", method, path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	router := NewWebServerWithWebSocket(nil, nil).Router()
+
+	for path, contentType := range map[string]string{
+		"/api/openapi.json": "application/json",
+		"/api/docs":         "text/html",
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", path, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, contentType) {
+			t.Errorf("%s: expected content type %s, got %s", path, contentType, got)
+		}
+	}
+}
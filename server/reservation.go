@@ -3,44 +3,74 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal"
+	"github.com/michelangelomo/ephimail/internal/encryption"
 	"github.com/michelangelomo/ephimail/internal/redis"
 )
 
 const (
-	reservationEnabled bool = false
+	// Lifetime of the sessions of passphrase protected mailboxes
+	mailboxSessionTTL = time.Hour
 )
 
 // ReservationRequest represents the request to reserve a mailbox
 type ReservationRequest struct {
-	Email     string `json:"email"`
-	Duration  string `json:"duration"`
-	PublicKey string `json:"public_key,omitempty"`
+	Email      string `json:"email"`
+	Duration   string `json:"duration"`
+	PublicKey  string `json:"public_key,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"` // Encrypts mail at rest, alternative to public_key
+
+	// Metadata kept in plaintext when encrypting with public_key, any of
+	// received_at, size and from_domain
+	Metadata []string `json:"metadata,omitempty"`
 }
 
 // ReservationResponse represents the response for a mailbox reservation
 type ReservationResponse struct {
-	Email      string    `json:"email"`
-	ExpiresAt  time.Time `json:"expires_at"`
-	Encrypted  bool      `json:"encrypted"`
-	ReservedAt time.Time `json:"reserved_at"`
-	URL        string    `json:"url,omitempty"`
+	Email       string    `json:"email"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Encrypted   bool      `json:"encrypted"`
+	KeyType     string    `json:"key_type,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // Fingerprint of the public key, as found in envelopes
+	Metadata    []string  `json:"metadata,omitempty"`
+	ReservedAt  time.Time `json:"reserved_at"`
+	URL         string    `json:"url,omitempty"`
+	OwnerToken  string    `json:"owner_token,omitempty"`
+
+	PassphraseProtected bool `json:"passphrase_protected"`
+}
+
+// UnlockRequest represents the request to unlock a passphrase protected mailbox
+type UnlockRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// UnlockResponse represents a session of a passphrase protected mailbox
+type UnlockResponse struct {
+	SessionToken string    `json:"session_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
 }
 
 // RegisterReservationHandlers registers the reservation handlers
 func (w *WebServer) RegisterReservationHandlers(router *mux.Router) {
 	router.HandleFunc("/api/inbox/reserve", w.reserveMailbox).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/inbox/{email}/reservation", w.getReservation).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/inbox/{email}/reservation", w.updateReservation).Methods("PATCH", "OPTIONS")
 	router.HandleFunc("/api/inbox/{email}/reservation", w.deleteReservation).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/inbox/{email}/unlock", w.unlockReservation).Methods("POST", "OPTIONS")
 }
 
 // reserveMailbox handles the reservation of a mailbox
 func (w *WebServer) reserveMailbox(rw http.ResponseWriter, r *http.Request) {
-	if !reservationEnabled {
+	if !w.EnableReservations {
 		http.Error(rw, "Mailbox reservation is disabled", http.StatusNotImplemented)
 		return
 	}
@@ -59,15 +89,43 @@ func (w *WebServer) reserveMailbox(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, domain, _ := strings.Cut(req.Email, "@")
+	if !isValidMailbox(req.Email) || !w.isAllowedDomain(domain) {
+		http.Error(rw, "Invalid email, a mailbox of an allowed domain is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.PublicKey != "" && req.Passphrase != "" {
+		http.Error(rw, "Public key and passphrase are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+
+	// Check the public key and detect its type
+	var keyType string
+	if req.PublicKey != "" {
+		keyType, err = encryption.DetectKeyType(req.PublicKey)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid public key: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Plaintext metadata only makes sense along with a key producing envelopes,
+	// PGP/MIME messages are meant to be opened as a whole by mail clients
+	if len(req.Metadata) > 0 {
+		if keyType != encryption.KeyTypeRSA && keyType != encryption.KeyTypeX25519 {
+			http.Error(rw, "Metadata requires an RSA or X25519 public key", http.StatusBadRequest)
+			return
+		}
+		if err := validateMetadata(req.Metadata); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid metadata: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Check if duration is valid
-	var duration time.Duration
-	switch req.Duration {
-	case "1h":
-		duration = 1 * time.Hour
-	case "24h":
-		duration = 24 * time.Hour
-	case "168h":
-		duration = 168 * time.Hour
+	switch redis.ReservationDuration(req.Duration) {
+	case redis.OneHour, redis.OneDay, redis.OneWeek:
 	default:
 		http.Error(rw, "Invalid duration. Allowed values: 1h, 24h, 168h", http.StatusBadRequest)
 		return
@@ -92,62 +150,67 @@ func (w *WebServer) reserveMailbox(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create reservation key
-	key := fmt.Sprintf("reservation:%s", req.Email)
-
-	// Set reservation data
-	now := time.Now()
-	expiresAt := now.Add(duration)
-	encrypted := req.PublicKey != ""
+	// Generate the owner token, only its hash is stored
+	ownerToken, err := internal.GenerateToken(32)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to generate owner token: %s", err), http.StatusInternalServerError)
+		return
+	}
 
-	// Store reservation in Redis
-	err = storage.Client.HSet(
-		storage.GetContext(),
-		key,
-		map[string]interface{}{
-			"email":      req.Email,
-			"expires_at": expiresAt.Unix(),
-			"public_key": req.PublicKey,
-			"encrypted":  encrypted,
-			"created_at": now.Unix(),
-		},
-	).Err()
+	// Generate the mailbox key sealed with the passphrase
+	var passphraseKey *encryption.PassphraseKey
+	if req.Passphrase != "" {
+		passphraseKey, err = encryption.NewPassphraseKey(req.Passphrase)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Failed to generate mailbox key: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
 
+	// Concurrent reservations can pass the check above, only one is created
+	reservation, err := storage.ReserveMailbox(req.Email, redis.ReservationDuration(req.Duration), req.PublicKey, keyType, req.Metadata, ownerToken, passphraseKey)
+	if errors.Is(err, redis.ErrMailboxReserved) {
+		http.Error(rw, "Mailbox is already reserved", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Failed to reserve mailbox: %s", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Set key expiration
-	err = storage.Client.Expire(
-		storage.GetContext(),
-		key,
-		duration,
-	).Err()
+	// Webhooks created while the mailbox was open would leak its mail
+	if _, err := storage.DeleteMailboxWebhooks(reservation.Email); err != nil {
+		log.Printf("Error deleting webhooks of %s: %v", reservation.Email, err)
+	}
 
-	if err != nil {
-		http.Error(rw, fmt.Sprintf("Failed to set reservation expiration: %s", err), http.StatusInternalServerError)
-		return
+	// Subscriptions made while the mailbox was open would too
+	if w.hub != nil {
+		w.hub.ReauthorizeSubscriptions(reservation.Email)
 	}
 
 	// Create response
 	resp := ReservationResponse{
-		Email:      req.Email,
-		ExpiresAt:  expiresAt,
-		Encrypted:  encrypted,
-		ReservedAt: now,
+		Email:       reservation.Email,
+		ExpiresAt:   reservation.ExpiresAt,
+		Encrypted:   reservation.Encrypted,
+		KeyType:     reservation.KeyType,
+		Fingerprint: reservation.Fingerprint(),
+		Metadata:    reservation.Metadata,
+		ReservedAt:  reservation.ReservedAt,
+		OwnerToken:  ownerToken,
+
+		PassphraseProtected: reservation.PassphraseProtected,
 	}
 
-	// If encrypted, create URL with private key placeholder
+	// Build a signed link, if encrypted add the private key placeholder
 	scheme := "http"
 	if r.TLS != nil {
 		scheme = "https"
 	}
 
-	if encrypted {
-		resp.URL = fmt.Sprintf("%s://%s/inbox/%s#private_key_goes_here", scheme, r.Host, req.Email)
-	} else {
-		resp.URL = fmt.Sprintf("%s://%s/inbox/%s", scheme, r.Host, req.Email)
+	resp.URL = fmt.Sprintf("%s://%s/inbox/%s?%s", scheme, r.Host, req.Email, signedLinkQuery(reservation).Encode())
+	if reservation.Encrypted {
+		resp.URL += "#private_key_goes_here"
 	}
 
 	// Return response
@@ -156,6 +219,20 @@ func (w *WebServer) reserveMailbox(rw http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(rw).Encode(resp)
 }
 
+// validateMetadata checks that only known metadata is kept in plaintext
+func validateMetadata(metadata []string) error {
+	for _, field := range metadata {
+		known := false
+		for _, f := range redis.MetadataFields {
+			known = known || f == field
+		}
+		if !known {
+			return fmt.Errorf("unknown field %q, allowed values: %s", field, strings.Join(redis.MetadataFields, ", "))
+		}
+	}
+	return nil
+}
+
 // isMailboxReserved checks if a mailbox is reserved
 func (w *WebServer) isMailboxReserved(email string) (bool, error) {
 	storage, ok := w.storage.(*redis.RedisStorage)
@@ -174,7 +251,7 @@ func (w *WebServer) isMailboxReserved(email string) (bool, error) {
 
 // getReservation handles getting a mailbox reservation
 func (w *WebServer) getReservation(rw http.ResponseWriter, r *http.Request) {
-	if !reservationEnabled {
+	if !w.EnableReservations {
 		http.Error(rw, "Mailbox reservation is disabled", http.StatusNotImplemented)
 		return
 	}
@@ -182,39 +259,28 @@ func (w *WebServer) getReservation(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	email := vars["email"]
 
-	// Check if mailbox is reserved
-	storage, ok := w.storage.(*redis.RedisStorage)
-	if !ok {
-		http.Error(rw, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	key := fmt.Sprintf("reservation:%s", email)
-	data, err := storage.Client.HGetAll(storage.GetContext(), key).Result()
+	reservation, err := w.storage.GetReservation(email)
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("Failed to get reservation: %s", err), http.StatusInternalServerError)
 		return
 	}
 
-	if len(data) == 0 {
+	if reservation == nil {
 		http.Error(rw, "Reservation not found", http.StatusNotFound)
 		return
 	}
 
-	// Parse data
-	encrypted := data["encrypted"] == "1" || data["encrypted"] == "true"
-	expiresAtUnix, err := storage.Client.HGet(storage.GetContext(), key, "expires_at").Int64()
-	if err != nil {
-		http.Error(rw, fmt.Sprintf("Invalid expiration timestamp: %s", err), http.StatusInternalServerError)
-		return
-	}
-
 	// Create response
 	resp := ReservationResponse{
-		Email:      email,
-		ExpiresAt:  time.Unix(expiresAtUnix, 0),
-		Encrypted:  encrypted,
-		ReservedAt: time.Now(), // This would ideally come from the stored data
+		Email:       reservation.Email,
+		ExpiresAt:   reservation.ExpiresAt,
+		Encrypted:   reservation.Encrypted,
+		KeyType:     reservation.KeyType,
+		Fingerprint: reservation.Fingerprint(),
+		Metadata:    reservation.Metadata,
+		ReservedAt:  reservation.ReservedAt,
+
+		PassphraseProtected: reservation.PassphraseProtected,
 	}
 
 	// Return reservation
@@ -225,7 +291,7 @@ func (w *WebServer) getReservation(rw http.ResponseWriter, r *http.Request) {
 
 // deleteReservation handles deleting a mailbox reservation
 func (w *WebServer) deleteReservation(rw http.ResponseWriter, r *http.Request) {
-	if !reservationEnabled {
+	if !w.EnableReservations {
 		http.Error(rw, "Mailbox reservation is disabled", http.StatusNotImplemented)
 		return
 	}
@@ -239,6 +305,11 @@ func (w *WebServer) deleteReservation(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only the owner can release a reservation
+	if _, ok := w.authorizeReservationOwner(rw, r, email); !ok {
+		return
+	}
+
 	key := fmt.Sprintf("reservation:%s", email)
 	deleted, err := storage.Client.Del(storage.GetContext(), key).Result()
 	if err != nil {
@@ -251,5 +322,212 @@ func (w *WebServer) deleteReservation(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if w.hub != nil {
+		w.hub.NotifyReservationDeleted(email, reservationReleased)
+	}
+
 	rw.WriteHeader(http.StatusNoContent)
 }
+
+// ReservationUpdateRequest represents the request to update a mailbox reservation
+type ReservationUpdateRequest struct {
+	Extend    string  `json:"extend,omitempty"`     // Duration to add to the expiry, e.g. "24h"
+	PublicKey *string `json:"public_key,omitempty"` // Replaces the public key, empty disables encryption
+	Transfer  bool    `json:"transfer,omitempty"`   // Issues a new owner token, revoking the current one
+}
+
+// updateReservation handles extending, rotating the key and transferring a reservation
+func (w *WebServer) updateReservation(rw http.ResponseWriter, r *http.Request) {
+	if !w.EnableReservations {
+		http.Error(rw, "Mailbox reservation is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	vars := mux.Vars(r)
+	email := vars["email"]
+
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Parse request
+	var req ReservationUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Every update is up to the owner, signed links are read-only
+	reservation, ok := w.authorizeReservationOwner(rw, r, email)
+	if !ok {
+		return
+	}
+
+	// Extend the expiry, never past the maximum reservation time from now
+	if req.Extend != "" {
+		extend, err := time.ParseDuration(req.Extend)
+		if err != nil || extend <= 0 {
+			http.Error(rw, "Invalid extend duration", http.StatusBadRequest)
+			return
+		}
+
+		expiresAt := reservation.ExpiresAt.Add(extend)
+		maxExpiresAt := time.Now().Add(time.Duration(w.MaxReservationDays) * 24 * time.Hour)
+		if expiresAt.After(maxExpiresAt) {
+			expiresAt = maxExpiresAt
+		}
+		reservation.ExpiresAt = expiresAt
+	}
+
+	// Rotate the public key, messages already stored keep the previous encryption
+	if req.PublicKey != nil {
+		if reservation.PassphraseProtected {
+			http.Error(rw, "Passphrase protected mailboxes can't use a public key", http.StatusBadRequest)
+			return
+		}
+		keyType := ""
+		if *req.PublicKey != "" {
+			var err error
+			keyType, err = encryption.DetectKeyType(*req.PublicKey)
+			if err != nil {
+				http.Error(rw, fmt.Sprintf("Invalid public key: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		reservation.PublicKey = *req.PublicKey
+		reservation.KeyType = keyType
+		reservation.Encrypted = reservation.PublicKey != ""
+
+		// OpenPGP keys encrypt the whole message
+		if keyType != encryption.KeyTypeRSA && keyType != encryption.KeyTypeX25519 {
+			reservation.Metadata = nil
+		}
+	}
+
+	resp := ReservationResponse{}
+
+	// Transfer ownership by issuing a new owner token
+	if req.Transfer {
+		ownerToken, err := internal.GenerateToken(32)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("Failed to generate owner token: %s", err), http.StatusInternalServerError)
+			return
+		}
+		reservation.SetOwnerToken(ownerToken)
+		resp.OwnerToken = ownerToken
+	}
+
+	if err := storage.SaveReservation(reservation); err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to update reservation: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The webhooks and subscriptions of the previous owner stop with its token
+	if req.Transfer {
+		if _, err := storage.DeleteMailboxWebhooks(reservation.Email); err != nil {
+			log.Printf("Error deleting webhooks of %s: %v", reservation.Email, err)
+		}
+		if w.hub != nil {
+			w.hub.ReauthorizeSubscriptions(reservation.Email)
+		}
+	}
+
+	resp.Email = reservation.Email
+	resp.ExpiresAt = reservation.ExpiresAt
+	resp.Encrypted = reservation.Encrypted
+	resp.KeyType = reservation.KeyType
+	resp.Fingerprint = reservation.Fingerprint()
+	resp.Metadata = reservation.Metadata
+	resp.ReservedAt = reservation.ReservedAt
+	resp.PassphraseProtected = reservation.PassphraseProtected
+
+	// Return reservation
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// unlockReservation exchanges the passphrase of a protected mailbox for a
+// session token, so clients don't have to send the passphrase on every request
+func (w *WebServer) unlockReservation(rw http.ResponseWriter, r *http.Request) {
+	if !w.EnableReservations {
+		http.Error(rw, "Mailbox reservation is disabled", http.StatusNotImplemented)
+		return
+	}
+
+	vars := mux.Vars(r)
+	email := vars["email"]
+
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Parse request
+	var req UnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Passphrase == "" {
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := w.storage.GetReservation(email)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get reservation: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if reservation == nil || !reservation.PassphraseProtected {
+		http.Error(rw, "Mailbox is not passphrase protected", http.StatusNotFound)
+		return
+	}
+
+	privateKey, err := w.unlockWithPassphrase(reservation, req.Passphrase)
+	if errors.Is(err, ErrTooManyAttempts) {
+		w.writeTooManyAttempts(rw, email)
+		return
+	}
+	if errors.Is(err, encryption.ErrWrongPassphrase) {
+		http.Error(rw, "Wrong passphrase", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to unlock mailbox: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Seal the mailbox key with a new session token
+	sessionToken, err := internal.GenerateToken(32)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to generate session token: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	wrappedKey, err := encryption.WrapSessionKey(privateKey, sessionToken)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to create session: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Sessions never outlive the reservation
+	expiresAt := time.Now().Add(mailboxSessionTTL)
+	if expiresAt.After(reservation.ExpiresAt) {
+		expiresAt = reservation.ExpiresAt
+	}
+
+	err = storage.StoreMailboxSession(email, internal.GenerateHash(sessionToken), wrappedKey, time.Until(expiresAt))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to create session: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(UnlockResponse{
+		SessionToken: sessionToken,
+		ExpiresAt:    expiresAt,
+	})
+}
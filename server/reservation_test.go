@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// reserve reserves a mailbox for an hour through the API
+func reserve(t *testing.T, web *WebServer, email string) ReservationResponse {
+	t.Helper()
+
+	body := `{"email":"` + email + `","duration":"1h"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/inbox/reserve", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	web.Router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK && rec.Code != http.StatusCreated {
+		t.Fatalf("reserving %s: got status %d: %s", email, rec.Code, rec.Body)
+	}
+
+	var resp ReservationResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestReservationsEnabled(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+
+	post := func(email string) int {
+		body := `{"email":"` + email + `","duration":"1h"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/inbox/reserve", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if got := post("alice@example.com"); got != http.StatusNotImplemented {
+		t.Fatalf("reservations disabled: got status %d, want %d", got, http.StatusNotImplemented)
+	}
+
+	web.EnableReservations = true
+	for _, email := range []string{"*@example.com", "alice@example.co?", "alice@other.com", "alice"} {
+		if got := post(email); got != http.StatusBadRequest {
+			t.Errorf("reserving %s: got status %d, want %d", email, got, http.StatusBadRequest)
+		}
+	}
+
+	if resp := reserve(t, web, "alice@example.com"); resp.OwnerToken == "" {
+		t.Error("no owner token issued")
+	}
+	if reservation, err := storage.GetReservation("alice@example.com"); err != nil || reservation == nil {
+		t.Errorf("alice@example.com not reserved: %v", err)
+	}
+}
+
+func TestSignedLinksAreReadOnly(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+	web.EnableReservations = true
+
+	owner := reserve(t, web, "alice@example.com")
+	reservation, err := storage.GetReservation("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := "?" + signedLinkQuery(reservation).Encode()
+
+	send := func(method, query, token, body string) int {
+		req := httptest.NewRequest(method, "/api/inbox/alice@example.com/reservation"+query, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A signed link reads the reservation, and nothing more
+	if got := send(http.MethodGet, link, "", ""); got != http.StatusOK {
+		t.Errorf("GET with a signed link: got status %d, want %d", got, http.StatusOK)
+	}
+	for _, body := range []string{`{"transfer":true}`, `{"extend":"1h"}`, `{"public_key":""}`} {
+		if got := send(http.MethodPatch, link, "", body); got != http.StatusUnauthorized {
+			t.Errorf("PATCH %s with a signed link: got status %d, want %d", body, got, http.StatusUnauthorized)
+		}
+	}
+	if got := send(http.MethodDelete, link, "", ""); got != http.StatusUnauthorized {
+		t.Errorf("DELETE with a signed link: got status %d, want %d", got, http.StatusUnauthorized)
+	}
+
+	after, err := storage.GetReservation("alice@example.com")
+	if err != nil || after == nil || !after.VerifyOwnerToken(owner.OwnerToken) || !after.ExpiresAt.Equal(reservation.ExpiresAt) {
+		t.Fatalf("reservation changed through a signed link: %+v %v", after, err)
+	}
+
+	// The owner token does it all
+	if got := send(http.MethodPatch, "", owner.OwnerToken, `{"transfer":true}`); got != http.StatusOK {
+		t.Errorf("PATCH with the owner token: got status %d, want %d", got, http.StatusOK)
+	}
+	if got := send(http.MethodDelete, "", owner.OwnerToken, ""); got != http.StatusUnauthorized {
+		t.Errorf("DELETE with the transferred token: got status %d, want %d", got, http.StatusUnauthorized)
+	}
+}
+
+func TestConcurrentReservations(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+	web.EnableReservations = true
+
+	const attempts = 10
+	var wg sync.WaitGroup
+	codes := make([]int, attempts)
+	tokens := make([]string, attempts)
+	for i := range attempts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/api/inbox/reserve", strings.NewReader(`{"email":"alice@example.com","duration":"1h"}`))
+			rec := httptest.NewRecorder()
+			web.Router().ServeHTTP(rec, req)
+			codes[i] = rec.Code
+
+			var resp ReservationResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			tokens[i] = resp.OwnerToken
+		}()
+	}
+	wg.Wait()
+
+	reservation, err := storage.GetReservation("alice@example.com")
+	if err != nil || reservation == nil {
+		t.Fatalf("alice@example.com not reserved: %v", err)
+	}
+
+	// Exactly one caller owns the mailbox, the others are told it's taken
+	owners := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			owners++
+			if !reservation.VerifyOwnerToken(tokens[i]) {
+				t.Error("owner token of a successful reservation was overwritten")
+			}
+		case http.StatusConflict:
+		default:
+			t.Errorf("got status %d, want %d or %d", code, http.StatusOK, http.StatusConflict)
+		}
+	}
+	if owners != 1 {
+		t.Errorf("got %d owners, want 1", owners)
+	}
+
+	if _, err := storage.ReserveMailbox("alice@example.com", redis.OneHour, "", "", nil, "token", nil); !errors.Is(err, redis.ErrMailboxReserved) {
+		t.Errorf("got %v, want ErrMailboxReserved", err)
+	}
+}
+
+func TestExtendReservation(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+	web.EnableReservations = true
+	web.MaxReservationDays = 2
+
+	extend := func(email, token, body string) (int, ReservationResponse) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/inbox/"+email+"/reservation", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+
+		var resp ReservationResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	owner := reserve(t, web, "alice@example.com")
+
+	code, resp := extend("alice@example.com", owner.OwnerToken, `{"extend":"24h"}`)
+	if code != http.StatusOK || resp.ExpiresAt.Unix() != owner.ExpiresAt.Add(24*time.Hour).Unix() {
+		t.Errorf("extending by a day: got status %d and expiry %s, want %s", code, resp.ExpiresAt, owner.ExpiresAt.Add(24*time.Hour))
+	}
+
+	// Extensions never go past the maximum reservation time from now
+	code, resp = extend("alice@example.com", owner.OwnerToken, `{"extend":"1000h"}`)
+	if max := time.Now().Add(48 * time.Hour); code != http.StatusOK || resp.ExpiresAt.After(max) || resp.ExpiresAt.Before(max.Add(-time.Minute)) {
+		t.Errorf("extending past the maximum: got status %d and expiry %s, want about %s", code, resp.ExpiresAt, max)
+	}
+	capped := resp.ExpiresAt
+
+	for _, body := range []string{`{"extend":"-1h"}`, `{"extend":"0s"}`, `{"extend":"soon"}`} {
+		if code, _ := extend("alice@example.com", owner.OwnerToken, body); code != http.StatusBadRequest {
+			t.Errorf("extending with %s: got status %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+
+	// Only the owner can extend
+	for _, token := range []string{"", "not-the-owner-token"} {
+		if code, _ := extend("alice@example.com", token, `{"extend":"1h"}`); code != http.StatusUnauthorized {
+			t.Errorf("extending with token %q: got status %d, want %d", token, code, http.StatusUnauthorized)
+		}
+	}
+	if reservation, err := storage.GetReservation("alice@example.com"); err != nil || reservation.ExpiresAt.Unix() != capped.Unix() {
+		t.Errorf("reservation changed by a non-owner: %+v %v", reservation, err)
+	}
+
+	// Expired reservations are gone, they can't be brought back
+	mr.FastForward(49 * time.Hour)
+	if code, _ := extend("alice@example.com", owner.OwnerToken, `{"extend":"1h"}`); code != http.StatusNotFound {
+		t.Errorf("extending an expired reservation: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if reservation, err := storage.GetReservation("alice@example.com"); err != nil || reservation != nil {
+		t.Errorf("expired reservation restored: %+v %v", reservation, err)
+	}
+}
+
+func TestUnlockReservation(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+	web.EnableReservations = true
+
+	req := httptest.NewRequest(http.MethodPost, "/api/inbox/reserve", strings.NewReader(`{"email":"alice@example.com","duration":"1h","passphrase":"correct horse"}`))
+	rec := httptest.NewRecorder()
+	web.Router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("reserving: got status %d: %s", rec.Code, rec.Body)
+	}
+
+	unlock := func(passphrase string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/inbox/alice@example.com/unlock", strings.NewReader(`{"passphrase":"`+passphrase+`"}`))
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+		return rec
+	}
+	inbox := func(header, value string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/inbox/alice@example.com/messages", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The passphrase is exchanged for a session token opening the mailbox
+	rec = unlock("correct horse")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unlocking: got status %d: %s", rec.Code, rec.Body)
+	}
+	var session UnlockResponse
+	if err := json.NewDecoder(rec.Body).Decode(&session); err != nil || session.SessionToken == "" {
+		t.Fatalf("no session token: %v", err)
+	}
+	if got := inbox("X-Mailbox-Session", session.SessionToken); got != http.StatusOK {
+		t.Errorf("reading with the session token: got status %d, want %d", got, http.StatusOK)
+	}
+	for _, header := range []string{"", "X-Mailbox-Session"} {
+		if got := inbox(header, "not-a-session"); got != http.StatusUnauthorized {
+			t.Errorf("reading with %q: got status %d, want %d", header, got, http.StatusUnauthorized)
+		}
+	}
+
+	// Wrong passphrases are counted, sent to the unlock endpoint or along with requests
+	for i := range maxUnlockAttempts {
+		if i%2 == 0 {
+			if rec := unlock("wrong horse"); rec.Code != http.StatusUnauthorized {
+				t.Errorf("unlocking with a wrong passphrase: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+		} else if got := inbox("X-Mailbox-Passphrase", "wrong horse"); got != http.StatusUnauthorized {
+			t.Errorf("reading with a wrong passphrase: got status %d, want %d", got, http.StatusUnauthorized)
+		}
+	}
+
+	// Then even the right passphrase is refused until the window ends
+	rec = unlock("correct horse")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("unlocking after too many attempts: got status %d and Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if got := inbox("X-Mailbox-Passphrase", "correct horse"); got != http.StatusTooManyRequests {
+		t.Errorf("reading after too many attempts: got status %d, want %d", got, http.StatusTooManyRequests)
+	}
+
+	// Open sessions are not affected
+	if got := inbox("X-Mailbox-Session", session.SessionToken); got != http.StatusOK {
+		t.Errorf("reading with the session token: got status %d, want %d", got, http.StatusOK)
+	}
+
+	mr.FastForward(unlockAttemptWindow)
+	if rec := unlock("correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("unlocking after the window: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
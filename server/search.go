@@ -0,0 +1,76 @@
+// server/search.go
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/michelangelomo/ephimail/internal/message"
+	"github.com/michelangelomo/ephimail/internal/redis"
+	"github.com/michelangelomo/ephimail/internal/search"
+)
+
+// Backends of the search index
+const (
+	SearchBackendRedis  = "redis"  // Stored in redis, shared by all the instances
+	SearchBackendMemory = "memory" // Kept in memory, for single instance deployments
+	SearchBackendNone   = "none"   // Search disabled
+)
+
+// NewSearchIndex creates the search index of a backend, it returns nil if
+// search is disabled
+func NewSearchIndex(backend string, storage *redis.RedisStorage) (search.Index, error) {
+	switch backend {
+	case SearchBackendRedis:
+		return redis.NewSearchIndex(storage), nil
+	case SearchBackendMemory:
+		return search.NewMemoryIndex(storage.EmailTTL), nil
+	case SearchBackendNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid search backend %q, allowed values: %s, %s, %s", backend, SearchBackendRedis, SearchBackendMemory, SearchBackendNone)
+	}
+}
+
+// indexMessage adds a message stored in clear to the search index, encrypted
+// messages are never indexed
+func indexMessage(index search.Index, to string, stored *redis.Message, headers *message.Headers) {
+	if index == nil || stored.Encrypted {
+		return
+	}
+
+	doc := &search.Document{
+		ID:   stored.ID,
+		Body: message.TextBody(stored.Body),
+	}
+	if headers != nil {
+		doc.Subject = headers.Subject
+		doc.From = strings.TrimSpace(headers.FromName + " " + headers.From)
+		doc.To = headers.To
+	}
+
+	if err := index.Add(to, doc); err != nil {
+		log.Printf("Error indexing message %s of %s: %v", stored.ID, to, err)
+	}
+}
+
+// unindexMessage removes a deleted message from the search index
+func (w *WebServer) unindexMessage(email, id string) {
+	if w.Search == nil {
+		return
+	}
+	if err := w.Search.Remove(email, id); err != nil {
+		log.Printf("Error removing message %s of %s from the search index: %v", id, email, err)
+	}
+}
+
+// unindexMailbox removes the messages of a cleared mailbox from the search index
+func (w *WebServer) unindexMailbox(email string) {
+	if w.Search == nil {
+		return
+	}
+	if err := w.Search.Clear(email); err != nil {
+		log.Printf("Error clearing the search index of %s: %v", email, err)
+	}
+}
@@ -0,0 +1,156 @@
+// server/sse.go
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// How often a comment is sent to keep idle event streams open through proxies
+const sseHeartbeatInterval = 15 * time.Second
+
+// streamEvents streams the events of a mailbox as Server-Sent Events, the
+// same events WebSocket subscribers get. new_email events carry the sequence
+// number of the message as event ID, a client reconnecting with Last-Event-ID
+// first gets the messages it missed.
+func (w *WebServerWithWebSocket) streamEvents(rw http.ResponseWriter, r *http.Request) {
+	email := mux.Vars(r)["email"]
+
+	// Patterns go through the same checks as WebSocket subscriptions, only
+	// admins may stream them
+	if isPattern(email) {
+		err := w.wsHub.authorizeSubscription(email, bearerToken(r))
+		if errors.Is(err, errInvalidPattern) {
+			http.Error(rw, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="ephimail"`)
+			http.Error(rw, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+	} else if _, ok := w.authorizeMailbox(rw, r, email); !ok {
+		// EventSource can't send headers, reserved mailboxes use the signed link
+		return
+	}
+
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Event streams are hub clients without a connection, subscribe before
+	// replaying so that no message falls in between
+	client := newWebSocketClient(w.wsHub, nil)
+	client.reauthorize = func(email string) error {
+		if isPattern(email) {
+			return w.wsHub.authorizeSubscription(email, bearerToken(r))
+		}
+		_, err := w.authorizeOwner(email, bearerToken(r), r.URL.Query())
+		return err
+	}
+	w.wsHub.Register(client)
+	defer w.wsHub.Unregister(client)
+	if err := w.wsHub.Subscribe(client, email); err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to subscribe: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Replay the messages stored since the last event the client saw
+	var lastSeq int64
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" && !isPattern(email) {
+		seq, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			seq = 0
+		}
+
+		messages, err := storage.RetrieveMessagesSince(email, seq)
+		if err != nil {
+			log.Printf("Error replaying events of %s: %v", email, err)
+		}
+
+		for _, message := range messages {
+			data, _ := json.Marshal(newEmailPayload(email, message))
+			if err := writeEvent(rw, "new_email", message.Seq, data); err != nil {
+				return
+			}
+			lastSeq = message.Seq
+		}
+		flusher.Flush()
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(rw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-client.done:
+			// Disconnected by the hub
+			return
+		case data := <-client.send:
+
+			var event struct {
+				Type    string          `json:"type"`
+				Payload json.RawMessage `json:"payload"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				continue
+			}
+
+			var payload struct {
+				Seq int64 `json:"seq"`
+			}
+			json.Unmarshal(event.Payload, &payload)
+
+			// Already replayed
+			if payload.Seq > 0 && payload.Seq <= lastSeq {
+				continue
+			}
+
+			if err := writeEvent(rw, event.Type, payload.Seq, event.Payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeEvent writes a Server-Sent Event, id is left out if zero
+func writeEvent(rw http.ResponseWriter, eventType string, id int64, data []byte) error {
+	if id > 0 {
+		if _, err := fmt.Fprintf(rw, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", eventType, data)
+	return err
+}
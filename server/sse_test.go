@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+func TestStreamEventsPatterns(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServerWithWebSocket(storage, []string{"example.com"})
+	web.AdminToken = "admin"
+	router := web.Router()
+
+	stream := func(email, token string) int {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		req := httptest.NewRequest(http.MethodGet, "/api/inbox/"+url.PathEscape(email)+"/events", nil).WithContext(ctx)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, tt := range []struct {
+		email string
+		token string
+		want  int
+	}{
+		{"*", "", http.StatusUnauthorized},
+		{"*@example.com", "", http.StatusUnauthorized},
+		{"*@example.com", "wrong", http.StatusUnauthorized},
+		{"[", "admin", http.StatusBadRequest},
+		{`alice\@example.com`, "", http.StatusBadRequest},
+		{"*@example.com", "admin", http.StatusOK},
+		{"alice@example.com", "", http.StatusOK},
+	} {
+		if got := stream(tt.email, tt.token); got != tt.want {
+			t.Errorf("events of %q with token %q: got status %d, want %d", tt.email, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestStreamEventsReplay(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServerWithWebSocket(storage, []string{"example.com"})
+	web.wsHub.pubsub = nil // Events stay in process, the hub isn't running
+	server := httptest.NewServer(web.Router())
+	defer server.Close()
+
+	const email = "alice@example.com"
+	var messages []*redis.Message
+	for i := range 3 {
+		message := &redis.Message{Body: fmt.Sprintf("message %d", i), ReceivedAt: time.Now()}
+		if _, err := storage.StoreMessage(email, message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/inbox/"+email+"/events", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(messages[0].Seq))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	// ids returns the IDs of the next n events of the stream
+	reader := bufio.NewReader(resp.Body)
+	ids := func(n int) []string {
+		var ids []string
+		for len(ids) < n {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("got ids %v: %v", ids, err)
+			}
+			if id, ok := strings.CutPrefix(line, "id: "); ok {
+				ids = append(ids, strings.TrimSpace(id))
+			}
+		}
+		return ids
+	}
+
+	// Only the messages after the last event are replayed
+	want := fmt.Sprint([]int64{messages[1].Seq, messages[2].Seq})
+	if got := ids(2); fmt.Sprint(got) != want {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+
+	// Live events already replayed are skipped
+	web.wsHub.NotifyNewEmail(email, messages[2])
+	message := &redis.Message{Body: "message 3", ReceivedAt: time.Now()}
+	if _, err := storage.StoreMessage(email, message); err != nil {
+		t.Fatal(err)
+	}
+	web.wsHub.NotifyNewEmail(email, message)
+
+	if got := ids(1); got[0] != fmt.Sprint(message.Seq) {
+		t.Errorf("got event %s, want %d", got[0], message.Seq)
+	}
+}
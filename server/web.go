@@ -2,27 +2,40 @@
 package server
 
 import (
+	"crypto/ecdh"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/extract"
 	"github.com/michelangelomo/ephimail/internal/redis"
+	"github.com/michelangelomo/ephimail/internal/search"
 )
 
 type WebServer struct {
-	Address    string
-	Port       int
-	storage    redis.Storage
-	domains    []string
-	corsConfig *CORSConfig
+	Address            string
+	Port               int
+	MaxReservationDays int
+	AdminToken         string // Grants access to domain and global resources, disabled if empty
+	EnableReservations bool   // Serves the reservation endpoints, they answer 501 Not Implemented otherwise
+	storage            redis.Storage
+	domains            []string
+	Search             search.Index      // Full-text index of the messages, search is disabled if nil
+	Extractors         *extract.Pipeline // Finds codes and links in messages stored before extraction or encrypted at rest
+	corsConfig         *CORSConfig
+	hub                *WebSocketHub // Notified of mailbox changes if set
 }
 
 func NewWebServer(storage redis.Storage, domains []string) *WebServer {
 	return &WebServer{
-		storage:    storage,
-		domains:    domains,
-		corsConfig: NewCORSConfig(),
+		MaxReservationDays: 7,
+		Extractors:         extract.NewPipeline(),
+		storage:            storage,
+		domains:            domains,
+		corsConfig:         NewCORSConfig(),
 	}
 }
 
@@ -31,10 +44,21 @@ func (w *WebServer) SetAllowedDomains(domains []string) {
 }
 
 func (w *WebServer) Run() error {
+	fmt.Println("starting web server on", w.Address, w.Port)
+	server := &http.Server{
+		Handler: w.Router(),
+		Addr:    fmt.Sprintf("%s:%d", w.Address, w.Port),
+	}
+	return server.ListenAndServe()
+}
+
+// Router returns the router of the web server
+func (w *WebServer) Router() *mux.Router {
 	m := mux.NewRouter()
 
 	// Apply CORS middleware to all routes
 	m.Use(w.corsConfig.CORSMiddleware)
+	m.Use(validateMailbox)
 
 	// Register API routes
 	m.HandleFunc("/domains", func(rw http.ResponseWriter, r *http.Request) {
@@ -43,24 +67,25 @@ func (w *WebServer) Run() error {
 		json.NewEncoder(rw).Encode(w.domains)
 	})
 
-	m.HandleFunc("/inbox/{email}", func(rw http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
+	m.HandleFunc("/inbox/{email}", w.getInbox)
+	m.HandleFunc("/api/inbox/{email}/messages", w.getMessages).Methods("GET", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages", w.clearInbox).Methods("DELETE", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages/{id}", w.getMessage).Methods("GET", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages/{id}", w.deleteMessage).Methods("DELETE", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages/{id}/raw", w.getRawEmail).Methods("GET", "OPTIONS")
 
-		emails, err := w.storage.RetrieveEmails(vars["email"])
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			fmt.Println(err)
-			return
-		}
-
-		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusOK)
-		json.NewEncoder(rw).Encode(emails)
-	})
+	// Register versioned API handlers
+	w.RegisterV1Handlers(m)
 
 	// Register reservation handlers
 	w.RegisterReservationHandlers(m)
 
+	// Register webhook handlers
+	w.RegisterWebhookHandlers(m)
+
+	// Register API documentation handlers
+	w.RegisterDocsHandlers(m)
+
 	// Serve static files
 	staticPath := "./frontend/dist"
 	staticFileDirectory := http.Dir(staticPath)
@@ -72,10 +97,271 @@ func (w *WebServer) Run() error {
 		http.ServeFile(w, r, staticPath+"/index.html")
 	})
 
-	fmt.Println("starting web server on", w.Address, w.Port)
-	server := &http.Server{
-		Handler: m,
-		Addr:    fmt.Sprintf("%s:%d", w.Address, w.Port),
+	return m
+}
+
+// accessMailbox checks that the request can read the mailbox, writing an error
+// response and returning false if it can't. Passphrase protected mailboxes are
+// unlocked by the passphrase or a session token and their private key is
+// returned, any other reserved mailbox requires its owner token.
+func (w *WebServer) accessMailbox(rw http.ResponseWriter, r *http.Request, email string) (*ecdh.PrivateKey, bool) {
+	reservation, err := w.storage.GetReservation(email)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to check mailbox status: %s", err), http.StatusInternalServerError)
+		return nil, false
 	}
-	return server.ListenAndServe()
+
+	if reservation == nil || !reservation.PassphraseProtected {
+		_, ok := w.authorizeMailbox(rw, r, email)
+		return nil, ok
+	}
+
+	privateKey, err := w.unlockMailbox(r, reservation)
+	if errors.Is(err, ErrTooManyAttempts) {
+		w.writeTooManyAttempts(rw, email)
+		return nil, false
+	}
+	if errors.Is(err, ErrLocked) {
+		http.Error(rw, "Mailbox is locked, passphrase or session token required", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to unlock mailbox: %s", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return privateKey, true
+}
+
+// decryptEmail decrypts an email of a passphrase protected mailbox. Mail
+// received before the reservation is stored in clear and returned as is.
+func decryptEmail(body string, privateKey *ecdh.PrivateKey) string {
+	if privateKey == nil {
+		return body
+	}
+	if decrypted, err := encryption.DecryptFromMailbox(body, privateKey); err == nil {
+		return decrypted
+	}
+	return body
+}
+
+// getInbox returns all the emails of a mailbox
+func (w *WebServer) getInbox(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	privateKey, ok := w.accessMailbox(rw, r, vars["email"])
+	if !ok {
+		return
+	}
+
+	emails, err := w.storage.RetrieveEmails(vars["email"])
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Println(err)
+		return
+	}
+
+	for key, body := range emails {
+		emails[key] = decryptEmail(body, privateKey)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(emails)
+}
+
+// getMessages returns all the emails of a mailbox with their metadata, newest
+// first. With summary=true bodies are left out, clients of mailboxes keeping
+// plaintext metadata then fetch and decrypt each message when it's opened.
+func (w *WebServer) getMessages(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	privateKey, ok := w.accessMailbox(rw, r, vars["email"])
+	if !ok {
+		return
+	}
+
+	messages, err := w.storage.RetrieveMessages(vars["email"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get emails: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	summary := r.URL.Query().Get("summary") == "true"
+	for _, message := range messages {
+		if summary {
+			message.Body = ""
+			continue
+		}
+		decryptMessage(message, privateKey)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(messages)
+}
+
+// getMessage returns a single email of a mailbox with its metadata
+func (w *WebServer) getMessage(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	privateKey, ok := w.accessMailbox(rw, r, vars["email"])
+	if !ok {
+		return
+	}
+
+	message, err := w.storage.RetrieveMessage(vars["email"], vars["id"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get email: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if message == nil {
+		http.Error(rw, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	if err := w.markRead(vars["email"], message); err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to update email: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	decryptMessage(message, privateKey)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(message)
+}
+
+// markRead marks a message as read when it's first fetched
+func (w *WebServer) markRead(email string, message *redis.Message) error {
+	if message.Read {
+		return nil
+	}
+	if _, err := w.storage.SetMessageRead(email, message.ID, true); err != nil {
+		return err
+	}
+	message.Read = true
+	return nil
+}
+
+// deleteMessage deletes a single email of a mailbox
+func (w *WebServer) deleteMessage(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, ok := w.authorizeMailbox(rw, r, vars["email"]); !ok {
+		return
+	}
+
+	deleted, err := w.storage.DeleteMessage(vars["email"], vars["id"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to delete email: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !deleted {
+		http.Error(rw, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	w.unindexMessage(vars["email"], vars["id"])
+
+	if w.hub != nil {
+		w.hub.NotifyEmailDeleted(vars["email"], vars["id"])
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// clearInbox deletes all the emails of a mailbox
+func (w *WebServer) clearInbox(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if _, ok := w.authorizeMailbox(rw, r, vars["email"]); !ok {
+		return
+	}
+
+	deleted, err := w.storage.ClearMailbox(vars["email"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to clear inbox: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.unindexMailbox(vars["email"])
+
+	if w.hub != nil {
+		w.hub.NotifyInboxCleared(vars["email"], deleted)
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// decryptMessage decrypts a message of a passphrase protected mailbox in place
+func decryptMessage(message *redis.Message, privateKey *ecdh.PrivateKey) {
+	if privateKey == nil {
+		return
+	}
+	if decrypted, err := encryption.DecryptFromMailbox(message.Body, privateKey); err == nil {
+		message.Body = decrypted
+		message.Encrypted = false
+	}
+}
+
+// readableMessage returns a message of a mailbox in clear, decrypting messages
+// of passphrase protected mailboxes. It writes an error response and returns
+// false if the message can't be read, end-to-end encrypted messages are only
+// readable by clients.
+func (w *WebServer) readableMessage(rw http.ResponseWriter, r *http.Request) (*redis.Message, bool) {
+	vars := mux.Vars(r)
+
+	privateKey, ok := w.accessMailbox(rw, r, vars["email"])
+	if !ok {
+		return nil, false
+	}
+
+	message, err := w.storage.RetrieveMessage(vars["email"], vars["id"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get email: %s", err), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if message == nil {
+		http.Error(rw, "Email not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	decryptMessage(message, privateKey)
+	if message.Encrypted {
+		http.Error(rw, "Email is end-to-end encrypted", http.StatusUnprocessableEntity)
+		return nil, false
+	}
+
+	return message, true
+}
+
+// getRawEmail downloads a single email as an .eml file, PGP/MIME messages of
+// mailboxes reserved with an OpenPGP key open in any standard mail client
+func (w *WebServer) getRawEmail(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	privateKey, ok := w.accessMailbox(rw, r, vars["email"])
+	if !ok {
+		return
+	}
+
+	body, err := w.storage.RetrieveEmail(vars["email"], vars["id"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get email: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if body == "" {
+		http.Error(rw, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "message/rfc822")
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", vars["id"]+".eml"))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(decryptEmail(body, privateKey)))
 }
@@ -4,13 +4,24 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/michelangelomo/ephimail/internal/redis"
 )
 
+const (
+	// How often reservations are checked for upcoming expiry
+	reservationWatchInterval = time.Minute
+	// How long before expiry subscribers are warned
+	reservationExpiryWarning = 15 * time.Minute
+	// How often mailbox indexes are swept for expired messages
+	messageSweepInterval = time.Minute
+)
+
 // WebServerWithWebSocket extends WebServer with WebSocket capabilities
 type WebServerWithWebSocket struct {
 	*WebServer
@@ -19,10 +30,35 @@ type WebServerWithWebSocket struct {
 
 // NewWebServerWithWebSocket creates a new web server with WebSocket support
 func NewWebServerWithWebSocket(storage redis.Storage, domains []string) *WebServerWithWebSocket {
-	return &WebServerWithWebSocket{
+	w := &WebServerWithWebSocket{
 		WebServer: NewWebServer(storage, domains),
 		wsHub:     NewWebSocketHub(),
 	}
+
+	// Browsers may only connect from the origins allowed to call the API
+	w.wsHub.checkOrigin = w.corsConfig.CheckOrigin
+
+	// Subscriptions to reserved mailboxes require the owner token
+	w.wsHub.authorize = func(email, token string) error {
+		_, err := w.authorizeOwner(email, token, nil)
+		return err
+	}
+
+	// Domain and pattern subscriptions require the admin token
+	w.wsHub.authorizeAdmin = w.isAdminToken
+
+	// Handlers notify subscribers of the changes they make
+	w.WebServer.hub = w.wsHub
+
+	// Clients can browse their inboxes over the socket
+	w.wsHub.commands = w.WebServer
+
+	// Mail may be received by another instance, events go through redis
+	if redisStorage, ok := storage.(*redis.RedisStorage); ok {
+		w.wsHub.pubsub = redisStorage
+	}
+
+	return w
 }
 
 // Run starts the web server with WebSocket support
@@ -30,11 +66,28 @@ func (w *WebServerWithWebSocket) Run() error {
 	// Start WebSocket hub
 	go w.wsHub.Run()
 
-	// Create router
+	// Warn subscribers about reservations about to expire
+	go w.watchReservations()
+
+	// Notify subscribers of expired messages
+	go w.watchExpiredMessages()
+
+	server := &http.Server{
+		Handler: w.Router(),
+		Addr:    fmt.Sprintf("%s:%d", w.Address, w.Port),
+	}
+
+	return server.ListenAndServe()
+}
+
+// Router returns the router of the web server, with the WebSocket and event
+// stream endpoints
+func (w *WebServerWithWebSocket) Router() *mux.Router {
 	m := mux.NewRouter()
 
 	// Apply CORS middleware to all routes
 	m.Use(w.corsConfig.CORSMiddleware)
+	m.Use(validateMailbox)
 
 	// Add WebSocket endpoint
 	m.HandleFunc("/ws", func(rw http.ResponseWriter, r *http.Request) {
@@ -68,23 +121,27 @@ func (w *WebServerWithWebSocket) Run() error {
 		json.NewEncoder(rw).Encode(w.domains)
 	})
 
-	m.HandleFunc("/inbox/{email}", func(rw http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
+	m.HandleFunc("/inbox/{email}", w.getInbox)
+	m.HandleFunc("/api/inbox/{email}/messages", w.getMessages).Methods("GET", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages", w.clearInbox).Methods("DELETE", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages/{id}", w.getMessage).Methods("GET", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages/{id}", w.deleteMessage).Methods("DELETE", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/messages/{id}/raw", w.getRawEmail).Methods("GET", "OPTIONS")
+	m.HandleFunc("/api/inbox/{email}/events", w.streamEvents).Methods("GET", "OPTIONS")
+	m.HandleFunc("/api/metrics/websocket", w.getWebSocketMetrics).Methods("GET", "OPTIONS")
 
-		emails, err := w.storage.RetrieveEmails(vars["email"])
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusOK)
-		json.NewEncoder(rw).Encode(emails)
-	})
+	// Register versioned API handlers
+	w.RegisterV1Handlers(m)
 
 	// Register reservation handlers
 	w.RegisterReservationHandlers(m)
 
+	// Register webhook handlers
+	w.RegisterWebhookHandlers(m)
+
+	// Register API documentation handlers
+	w.RegisterDocsHandlers(m)
+
 	// Serve static files
 	staticPath := "./frontend/dist"
 	staticFileDirectory := http.Dir(staticPath)
@@ -96,12 +153,95 @@ func (w *WebServerWithWebSocket) Run() error {
 		http.ServeFile(w, r, staticPath+"/index.html")
 	})
 
-	server := &http.Server{
-		Handler: m,
-		Addr:    fmt.Sprintf("%s:%d", w.Address, w.Port),
+	return m
+}
+
+// watchReservations periodically looks for reservations about to expire and
+// notifies their subscribers once per expiry, so the UI can prompt for renewal
+func (w *WebServerWithWebSocket) watchReservations() {
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		return
 	}
 
-	return server.ListenAndServe()
+	// Expiry already notified for each mailbox
+	notified := make(map[string]time.Time)
+
+	ticker := time.NewTicker(reservationWatchInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reservations, err := storage.ListReservations()
+		if err != nil {
+			log.Printf("Error listing reservations: %v", err)
+			continue
+		}
+
+		active := make(map[string]time.Time, len(reservations))
+		for _, reservation := range reservations {
+			active[reservation.Email] = reservation.ExpiresAt
+
+			if time.Until(reservation.ExpiresAt) > reservationExpiryWarning {
+				continue
+			}
+			if expiresAt, ok := notified[reservation.Email]; ok && expiresAt.Equal(reservation.ExpiresAt) {
+				continue
+			}
+
+			w.wsHub.NotifyReservationExpiring(reservation.Email, reservation.ExpiresAt)
+			notified[reservation.Email] = reservation.ExpiresAt
+		}
+
+		// Forget reservations that are gone, the ones that weren't released
+		// by their owner expired
+		for email, expiresAt := range notified {
+			if _, ok := active[email]; !ok {
+				if !time.Now().Before(expiresAt) {
+					w.wsHub.NotifyReservationDeleted(email, reservationExpired)
+				}
+				delete(notified, email)
+			}
+		}
+	}
+}
+
+// watchExpiredMessages periodically notifies subscribers of the messages that
+// reached their TTL
+func (w *WebServerWithWebSocket) watchExpiredMessages() {
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(messageSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := storage.SweepExpiredMessages()
+		if err != nil {
+			log.Printf("Error sweeping expired messages: %v", err)
+		}
+
+		for email, ids := range expired {
+			for _, id := range ids {
+				w.wsHub.NotifyEmailExpired(email, id)
+			}
+		}
+	}
+}
+
+// getWebSocketMetrics returns the activity of the WebSocket hub of this
+// instance, to admins only
+func (w *WebServerWithWebSocket) getWebSocketMetrics(rw http.ResponseWriter, r *http.Request) {
+	if !w.authorizeAdmin(r) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="ephimail"`)
+		http.Error(rw, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(w.wsHub.Metrics())
 }
 
 // GetWebSocketHub returns the WebSocket hub
@@ -110,8 +250,8 @@ func (w *WebServerWithWebSocket) GetWebSocketHub() *WebSocketHub {
 }
 
 // NotifyNewEmail notifies WebSocket clients about a new email
-func (w *WebServerWithWebSocket) NotifyNewEmail(to, messageID string) {
-	w.wsHub.NotifyNewEmail(to, messageID)
+func (w *WebServerWithWebSocket) NotifyNewEmail(to string, message *redis.Message) {
+	w.wsHub.NotifyNewEmail(to, message)
 }
 
 // MailServerWithWebSocket extends MailServer with WebSocket notifications
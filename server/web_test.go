@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// newTestStorage returns a storage backed by an in-memory redis
+func newTestStorage(t *testing.T) (*redis.RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	storage := redis.NewStorage()
+	storage.Address = mr.Host()
+	storage.Port, _ = strconv.Atoi(mr.Port())
+	storage.Connect()
+	return storage, mr
+}
+
+func TestIsValidMailbox(t *testing.T) {
+	for email, valid := range map[string]bool{
+		"alice@example.com":                  true,
+		"alice+tag@example.com":              true,
+		"*":                                  false,
+		"*@example.com":                      false,
+		"alice@example.co*":                  false,
+		"alice?@example.com":                 false,
+		"[ab]lice@example.com":               false,
+		`alice\@example.com`:                 false,
+		"alice":                              false,
+		"Alice <alice@example.com>":          false,
+		"alice@example.com, bob@example.com": false,
+	} {
+		if got := isValidMailbox(email); got != valid {
+			t.Errorf("isValidMailbox(%q) = %v, want %v", email, got, valid)
+		}
+	}
+}
+
+func TestClearInboxWildcard(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+
+	for _, to := range []string{"alice@example.com", "bob@example.com"} {
+		if err := storage.StoreEmail(to, "Subject: hello\r\n\r\nhello\r\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := storage.ReserveMailbox("bob@example.com", redis.OneHour, "", "", nil, "token", nil); err != nil {
+		t.Fatal(err)
+	}
+	keys := len(mr.Keys())
+
+	for _, email := range []string{"*", "*@example.com", "bob@example.co?"} {
+		req := httptest.NewRequest(http.MethodDelete, "/api/inbox/"+url.PathEscape(email)+"/messages", nil)
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("DELETE %s: got status %d, want %d", email, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if len(mr.Keys()) != keys {
+		t.Fatalf("wildcard requests deleted keys: %v", mr.Keys())
+	}
+
+	// Even past the router, patterns never reach other mailboxes
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/", nil), map[string]string{"email": "*"})
+	web.clearInbox(httptest.NewRecorder(), req)
+	if len(mr.Keys()) != keys {
+		t.Fatalf("clearing * deleted keys: %v", mr.Keys())
+	}
+
+	// Clearing a mailbox leaves the others as they are
+	req = httptest.NewRequest(http.MethodDelete, "/api/inbox/alice@example.com/messages", nil)
+	rec := httptest.NewRecorder()
+	web.Router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	emails, err := storage.RetrieveEmails("alice@example.com")
+	if err != nil || len(emails) != 0 {
+		t.Errorf("alice@example.com not cleared: %v %v", emails, err)
+	}
+	emails, err = storage.RetrieveEmails("bob@example.com")
+	if err != nil || len(emails) != 1 {
+		t.Errorf("bob@example.com cleared: %v %v", emails, err)
+	}
+	if reservation, err := storage.GetReservation("bob@example.com"); err != nil || reservation == nil {
+		t.Errorf("reservation of bob@example.com deleted: %v", err)
+	}
+}
+
+func TestGetInboxWildcard(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+
+	if err := storage.StoreEmail("bob@example.com", "Subject: secret\r\n\r\nsecret\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.ReserveMailbox("bob@example.com", redis.OneHour, "", "", nil, "token", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range []string{"bob@example.co*", "*@example.com", "b?b@example.com", "[b]ob@example.com"} {
+		req := httptest.NewRequest(http.MethodGet, "/inbox/"+url.PathEscape(email), nil)
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /inbox/%s: got status %d, want %d", email, rec.Code, http.StatusBadRequest)
+		}
+
+		// Storage only matches mailboxes literally
+		emails, err := storage.RetrieveEmails(email)
+		if err != nil || len(emails) != 0 {
+			t.Errorf("RetrieveEmails(%q) = %v, %v", email, emails, err)
+		}
+	}
+
+	// The reserved mailbox itself still requires its owner token
+	req := httptest.NewRequest(http.MethodGet, "/inbox/bob@example.com", nil)
+	rec := httptest.NewRecorder()
+	web.Router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	req.Header.Set("Authorization", "Bearer token")
+	rec = httptest.NewRecorder()
+	web.Router().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("got status %d, body %s", rec.Code, rec.Body)
+	}
+}
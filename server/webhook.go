@@ -0,0 +1,524 @@
+// server/webhook.go
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/michelangelomo/ephimail/internal"
+	"github.com/michelangelomo/ephimail/internal/message"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// Event posted to webhooks when a message is stored
+const webhookEventReceived = "email.received"
+
+const (
+	// How often the queue is polled for due deliveries
+	webhookPollInterval = time.Second
+	// Deliveries attempted at once by a dispatcher
+	webhookBatchSize = 10
+	// Timeout of a single delivery attempt
+	webhookTimeout = 10 * time.Second
+	// How long a claimed delivery is hidden from other dispatchers
+	webhookLease = time.Minute
+	// Attempts before a delivery is given up
+	webhookMaxAttempts = 8
+	// Delay before the first retry, doubled on each attempt up to webhookMaxBackoff
+	webhookBackoff    = 10 * time.Second
+	webhookMaxBackoff = time.Hour
+)
+
+// WebhookPayload is the JSON body posted to webhooks
+type WebhookPayload struct {
+	Event   string         `json:"event"`
+	Mailbox string         `json:"mailbox"`
+	Message WebhookMessage `json:"message"`
+	Raw     string         `json:"raw,omitempty"` // Stored message, still encrypted for encrypted mailboxes
+}
+
+// WebhookMessage is the metadata of a message posted to webhooks. Encrypted
+// messages only carry the metadata their mailbox keeps in plaintext.
+type WebhookMessage struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+	Size       int       `json:"size,omitempty"`
+	Encrypted  bool      `json:"encrypted"`
+	Algorithm  string    `json:"algorithm,omitempty"`
+	From       string    `json:"from,omitempty"`
+	FromDomain string    `json:"from_domain,omitempty"`
+	To         []string  `json:"to,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	Date       time.Time `json:"date,omitzero"`
+}
+
+// WebhookRequest represents the request to create a webhook
+type WebhookRequest struct {
+	Scope      string `json:"scope"`            // mailbox, domain or global
+	Target     string `json:"target,omitempty"` // Mailbox or domain
+	URL        string `json:"url"`
+	IncludeRaw bool   `json:"include_raw,omitempty"`
+}
+
+// WebhookResponse represents a webhook, the secret is only returned on creation
+type WebhookResponse struct {
+	*redis.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookDispatcher queues the messages stored for webhooks and delivers them.
+// The queue lives in redis, so pending deliveries survive restarts and any
+// number of dispatchers can share it.
+type WebhookDispatcher struct {
+	storage *redis.RedisStorage
+	client  *http.Client
+}
+
+// NewWebhookDispatcher creates a new webhook dispatcher, deliveries only reach
+// public addresses
+func NewWebhookDispatcher(storage *redis.RedisStorage) *WebhookDispatcher {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: webhookDialControl,
+	}
+
+	return &WebhookDispatcher{
+		storage: storage,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: webhookTimeout,
+			},
+		},
+	}
+}
+
+// Ranges webhooks can't be delivered to besides the loopback, private,
+// link-local and multicast ones
+var webhookBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// isPublicAddr reports whether webhooks may be delivered to an address
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsUnspecified() || addr.IsLoopback() || addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range webhookBlockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl rejects connections to non-public addresses. It runs
+// once the host is resolved, so names resolving to private addresses and
+// redirects are blocked too.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid webhook address %s: %w", address, err)
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", addrPort.Addr())
+	}
+	return nil
+}
+
+// isPublicHost reports whether the host of a webhook URL may be public, names
+// are checked once resolved when delivering
+func isPublicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return isPublicAddr(addr)
+	}
+	return true
+}
+
+// Enqueue queues a delivery of a stored message for each matching webhook
+func (d *WebhookDispatcher) Enqueue(email string, stored *redis.Message) error {
+	webhooks, err := d.storage.MatchWebhooks(email)
+	if err != nil {
+		return fmt.Errorf("failed to match webhooks: %w", err)
+	}
+
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	payload := WebhookPayload{
+		Event:   webhookEventReceived,
+		Mailbox: email,
+		Message: WebhookMessage{
+			ID:         stored.ID,
+			ReceivedAt: stored.VisibleReceivedAt(),
+			Size:       stored.Size,
+			Encrypted:  stored.Encrypted,
+			Algorithm:  stored.Algorithm,
+			FromDomain: stored.FromDomain,
+		},
+	}
+
+	if !stored.Encrypted {
+		if headers, err := message.ParseHeaders(stored.Body); err == nil {
+			payload.Message.From = headers.From
+			payload.Message.FromDomain = headers.FromDomain
+			payload.Message.To = headers.To
+			payload.Message.Subject = headers.Subject
+			payload.Message.Date = headers.Date
+		}
+	}
+
+	for _, webhook := range webhooks {
+		payload.Raw = ""
+		if webhook.IncludeRaw {
+			payload.Raw = stored.Body
+		}
+
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+
+		id, err := internal.GenerateToken(16)
+		if err != nil {
+			return err
+		}
+
+		err = d.storage.EnqueueDelivery(&redis.WebhookDelivery{
+			ID:        id,
+			WebhookID: webhook.ID,
+			Event:     webhookEventReceived,
+			Payload:   string(data),
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run delivers the queued payloads until the process exits
+func (d *WebhookDispatcher) Run() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deliveries, err := d.storage.ClaimDeliveries(webhookBatchSize, webhookLease)
+		if err != nil {
+			log.Printf("Error claiming webhook deliveries: %v", err)
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			go func(delivery *redis.WebhookDelivery) {
+				defer wg.Done()
+				d.deliver(delivery)
+			}(delivery)
+		}
+		wg.Wait()
+	}
+}
+
+// deliver attempts a delivery and records its outcome
+func (d *WebhookDispatcher) deliver(delivery *redis.WebhookDelivery) {
+	webhook, err := d.storage.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		log.Printf("Error getting webhook %s: %v", delivery.WebhookID, err)
+		return
+	}
+
+	delivery.Attempts++
+
+	if webhook == nil {
+		delivery.Status = redis.DeliveryFailed
+		delivery.LastError = "webhook deleted"
+	} else if err := d.post(webhook, delivery); err != nil {
+		delivery.LastError = err.Error()
+		delivery.Status = redis.DeliveryPending
+		delivery.NextAttemptAt = time.Now().Add(webhookRetryDelay(delivery.Attempts))
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = redis.DeliveryFailed
+		}
+	} else {
+		delivery.Status = redis.DeliveryDelivered
+		delivery.LastError = ""
+	}
+
+	if err := d.storage.SaveDelivery(delivery); err != nil {
+		log.Printf("Error saving webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// post sends the payload of a delivery, signed as described by webhookSignature
+func (d *WebhookDispatcher) post(webhook *redis.Webhook, delivery *redis.WebhookDelivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ephimail-webhook")
+	req.Header.Set("X-Ephimail-Event", delivery.Event)
+	req.Header.Set("X-Ephimail-Delivery", delivery.ID)
+	req.Header.Set("X-Ephimail-Timestamp", timestamp)
+	req.Header.Set("X-Ephimail-Signature", "sha256="+webhookSignature(webhook.Secret, timestamp, delivery.Payload))
+
+	delivery.ResponseCode = 0
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	delivery.ResponseCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature computes the hex HMAC-SHA256 of "timestamp.payload" keyed
+// by the webhook secret. Receivers recompute it and should reject old timestamps.
+func webhookSignature(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s.%s", timestamp, payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookRetryDelay returns the delay before the next attempt of a delivery
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxBackoff {
+		delay = webhookMaxBackoff
+	}
+	return delay
+}
+
+// RegisterWebhookHandlers registers the webhook handlers
+func (w *WebServer) RegisterWebhookHandlers(router *mux.Router) {
+	router.HandleFunc("/api/webhooks", w.createWebhook).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/webhooks/{id}", w.getWebhook).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/webhooks/{id}", w.deleteWebhook).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/api/webhooks/{id}/deliveries", w.getWebhookDeliveries).Methods("GET", "OPTIONS")
+}
+
+// authorizeWebhook checks that the request can manage webhooks of a scope,
+// writing an error response and returning false if it can't. Mailbox webhooks
+// follow the mailbox access rules, others require the admin token.
+func (w *WebServer) authorizeWebhook(rw http.ResponseWriter, r *http.Request, scope, target string) bool {
+	if scope == redis.WebhookScopeMailbox {
+		_, ok := w.authorizeMailbox(rw, r, target)
+		return ok
+	}
+
+	if !w.authorizeAdmin(r) {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="ephimail"`)
+		http.Error(rw, "Admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// isAllowedDomain checks if the server accepts mail for domain
+func (w *WebServer) isAllowedDomain(domain string) bool {
+	for _, d := range w.domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// createWebhook handles the creation of a webhook
+func (w *WebServer) createWebhook(rw http.ResponseWriter, r *http.Request) {
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Parse request
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate request
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(rw, "Invalid URL, an absolute http or https URL is required", http.StatusBadRequest)
+		return
+	}
+	if !isPublicHost(target.Hostname()) {
+		http.Error(rw, "Invalid URL, the host must be public", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Scope {
+	case redis.WebhookScopeMailbox:
+		_, domain, _ := strings.Cut(req.Target, "@")
+		if !isValidMailbox(req.Target) || !w.isAllowedDomain(domain) {
+			http.Error(rw, "Invalid target, a mailbox of an allowed domain is required", http.StatusBadRequest)
+			return
+		}
+	case redis.WebhookScopeDomain:
+		if !w.isAllowedDomain(req.Target) {
+			http.Error(rw, "Invalid target, an allowed domain is required", http.StatusBadRequest)
+			return
+		}
+	case redis.WebhookScopeGlobal:
+		req.Target = ""
+	default:
+		http.Error(rw, "Invalid scope. Allowed values: mailbox, domain, global", http.StatusBadRequest)
+		return
+	}
+
+	if !w.authorizeWebhook(rw, r, req.Scope, req.Target) {
+		return
+	}
+
+	id, err := internal.GenerateToken(16)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to generate webhook ID: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := internal.GenerateToken(32)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to generate webhook secret: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	webhook := &redis.Webhook{
+		ID:         id,
+		Scope:      req.Scope,
+		Target:     req.Target,
+		URL:        req.URL,
+		Secret:     secret,
+		IncludeRaw: req.IncludeRaw,
+		CreatedAt:  time.Now(),
+	}
+
+	if err := storage.SaveWebhook(webhook); err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to create webhook: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(WebhookResponse{
+		Webhook: webhook,
+		Secret:  secret,
+	})
+}
+
+// findWebhook returns the webhook of the request if the request can manage
+// it, writing an error response and returning nil otherwise
+func (w *WebServer) findWebhook(rw http.ResponseWriter, r *http.Request) (*redis.RedisStorage, *redis.Webhook) {
+	storage, ok := w.storage.(*redis.RedisStorage)
+	if !ok {
+		http.Error(rw, "Internal server error", http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	webhook, err := storage.GetWebhook(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get webhook: %s", err), http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	if webhook == nil {
+		http.Error(rw, "Webhook not found", http.StatusNotFound)
+		return nil, nil
+	}
+
+	if !w.authorizeWebhook(rw, r, webhook.Scope, webhook.Target) {
+		return nil, nil
+	}
+
+	return storage, webhook
+}
+
+// getWebhook handles getting a webhook
+func (w *WebServer) getWebhook(rw http.ResponseWriter, r *http.Request) {
+	_, webhook := w.findWebhook(rw, r)
+	if webhook == nil {
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(WebhookResponse{Webhook: webhook})
+}
+
+// deleteWebhook handles deleting a webhook
+func (w *WebServer) deleteWebhook(rw http.ResponseWriter, r *http.Request) {
+	storage, webhook := w.findWebhook(rw, r)
+	if webhook == nil {
+		return
+	}
+
+	if err := storage.DeleteWebhook(webhook); err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to delete webhook: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// getWebhookDeliveries returns the delivery log of a webhook, newest first
+func (w *WebServer) getWebhookDeliveries(rw http.ResponseWriter, r *http.Request) {
+	storage, webhook := w.findWebhook(rw, r)
+	if webhook == nil {
+		return
+	}
+
+	deliveries, err := storage.ListDeliveries(webhook.ID)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to get deliveries: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(deliveries)
+}
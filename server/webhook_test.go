@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal/encryption"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+func TestWebhookDeliveryStorage(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	keyring, err := encryption.NewKeyring(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Keyring = keyring
+	storage.EmailTTL = time.Hour
+
+	delivery := &redis.WebhookDelivery{
+		ID:        "delivery",
+		WebhookID: "webhook",
+		Event:     webhookEventReceived,
+		Payload:   `{"subject":"secret"}`,
+		CreatedAt: time.Now(),
+	}
+	if err := storage.EnqueueDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	// Payloads are sealed at rest and kept no longer than emails
+	if stored := mr.HGet("webhook:delivery:delivery", "payload"); stored == "" || strings.Contains(stored, "secret") {
+		t.Errorf("payload stored as %q", stored)
+	}
+	for _, key := range []string{"webhook:delivery:delivery", "webhook:log:webhook"} {
+		if ttl := mr.TTL(key); ttl <= 0 || ttl > storage.EmailTTL {
+			t.Errorf("%s expires in %s, want at most %s", key, ttl, storage.EmailTTL)
+		}
+	}
+
+	// Saving an attempt leaves the payload as it was
+	delivery.Attempts++
+	delivery.Status = redis.DeliveryDelivered
+	if err := storage.SaveDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	got, err := storage.GetDelivery(delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Payload != delivery.Payload || got.Status != redis.DeliveryDelivered {
+		t.Errorf("got delivery %+v", got)
+	}
+	if ttl := mr.TTL("webhook:delivery:delivery"); ttl <= 0 || ttl > storage.EmailTTL {
+		t.Errorf("saved delivery expires in %s", ttl)
+	}
+
+	// A delivery saved once expired doesn't outlive its retention
+	mr.FastForward(2 * time.Hour)
+	if err := storage.SaveDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL("webhook:delivery:delivery"); ttl <= 0 || ttl > storage.EmailTTL {
+		t.Errorf("delivery saved after expiry expires in %s", ttl)
+	}
+}
+
+func TestWebhookTargets(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.215.14":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"::ffff:10.0.0.1": false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != public {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", addr, got, public)
+		}
+	}
+
+	// Deliveries never reach private addresses, whatever the host resolves to
+	var hits int
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer receiver.Close()
+
+	storage, _ := newTestStorage(t)
+	dispatcher := NewWebhookDispatcher(storage)
+	for _, target := range []string{receiver.URL, strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)} {
+		err := dispatcher.post(&redis.Webhook{URL: target}, &redis.WebhookDelivery{Payload: "{}"})
+		if err == nil {
+			t.Errorf("delivered to %s", target)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("receiver got %d requests", hits)
+	}
+
+	// Nor can webhooks be created for them
+	web := NewWebServer(storage, []string{"example.com"})
+	for _, target := range []string{"http://127.0.0.1/hook", "http://localhost:8080/hook", "http://[::1]/hook", "http://169.254.169.254/latest"} {
+		body := `{"scope":"mailbox","target":"alice@example.com","url":"` + target + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("webhook to %s: got status %d, want %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestWebhookMailboxTargets(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServer(storage, []string{"example.com"})
+
+	for target, want := range map[string]int{
+		"alice@example.com":                  http.StatusCreated,
+		"*@example.com":                      http.StatusBadRequest,
+		"al?ce@example.com":                  http.StatusBadRequest,
+		"@example.com":                       http.StatusBadRequest,
+		"Alice <alice@example.com>":          http.StatusBadRequest,
+		"alice@example.com@example.com":      http.StatusBadRequest,
+		"alice@example.org":                  http.StatusBadRequest,
+		"alice@example.com, bob@example.com": http.StatusBadRequest,
+	} {
+		body, _ := json.Marshal(WebhookRequest{Scope: redis.WebhookScopeMailbox, Target: target, URL: "https://example.org/hook"})
+		req := httptest.NewRequest(http.MethodPost, "/api/webhooks", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		web.Router().ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("webhook for %q: got status %d, want %d", target, rec.Code, want)
+		}
+	}
+}
+
+func TestDeleteMailboxWebhooks(t *testing.T) {
+	storage, _ := newTestStorage(t)
+
+	for _, webhook := range []*redis.Webhook{
+		{ID: "alice", Scope: redis.WebhookScopeMailbox, Target: "alice@example.com", URL: "https://example.org/alice"},
+		{ID: "bob", Scope: redis.WebhookScopeMailbox, Target: "bob@example.com", URL: "https://example.org/bob"},
+		{ID: "domain", Scope: redis.WebhookScopeDomain, Target: "example.com", URL: "https://example.org/domain"},
+	} {
+		if err := storage.SaveWebhook(webhook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if deleted, err := storage.DeleteMailboxWebhooks("alice@example.com"); err != nil || deleted != 1 {
+		t.Fatalf("deleted %d webhooks: %v", deleted, err)
+	}
+
+	for email, want := range map[string]int{"alice@example.com": 1, "bob@example.com": 2} {
+		webhooks, err := storage.MatchWebhooks(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(webhooks) != want {
+			t.Errorf("%s matches %d webhooks, want %d", email, len(webhooks), want)
+		}
+	}
+}
@@ -2,292 +2,528 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"net/http"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/michelangelomo/ephimail/internal/redis"
 )
 
-// WebSocketHub manages all active WebSocket connections
+// WebSocketHub manages all active WebSocket connections. Subscriptions are
+// sharded by email address so that events of different mailboxes don't
+// contend on the same lock. Locks are always taken client first, then shard.
 type WebSocketHub struct {
 	// Registered clients
-	clients map[*WebSocketClient]bool
+	clients    map[*WebSocketClient]bool
+	clientLock sync.Mutex
 
-	// Inbound messages from clients
-	broadcast chan []byte
+	// Mapping of email addresses to clients
+	shards [hubShards]hubShard
 
-	// Register requests from clients
-	register chan *WebSocketClient
+	// Mapping of domain and pattern subscriptions to clients
+	patterns    map[string]map[*WebSocketClient]bool
+	patternLock sync.RWMutex
 
-	// Unregister requests from clients
-	unregister chan *WebSocketClient
+	// Checks the origin of WebSocket handshakes, nil only allows the same
+	// origin
+	checkOrigin func(r *http.Request) bool
 
-	// Mapping of email addresses to clients
-	subscriptions map[string][]*WebSocketClient
-	subLock       sync.RWMutex
-}
+	// Checks the owner token of a subscription, nil allows everything
+	authorize func(email, token string) error
+
+	// Checks the admin token of domain and pattern subscriptions, nil refuses
+	// them
+	authorizeAdmin func(token string) bool
 
-// WebSocketClient represents a connected client
-type WebSocketClient struct {
-	hub *WebSocketHub
+	// Serves the inbox commands of clients, unavailable if nil
+	commands mailboxCommands
 
-	// The websocket connection
-	conn *websocket.Conn
+	// Carries events between instances, so that mail received by any of them
+	// reaches the clients of all the others, and replays missed messages from
+	// the mailbox indexes. Events stay in process and aren't replayed if nil.
+	pubsub *redis.RedisStorage
+
+	metrics hubMetrics
+}
+
+// hubShard holds the subscriptions of the email addresses hashed to it
+type hubShard struct {
+	sync.RWMutex
+	subscriptions map[string]map[*WebSocketClient]bool
+}
 
-	// Buffered channel of outbound messages
-	send chan []byte
+// hubMetrics counts the activity of a hub
+type hubMetrics struct {
+	clients       atomic.Int64
+	subscriptions atomic.Int64
+	events        atomic.Uint64
+	delivered     atomic.Uint64
+	slowConsumers atomic.Uint64
+}
 
-	// Email address this client is subscribed to
-	email string
+// HubMetrics is a snapshot of the activity of a hub
+type HubMetrics struct {
+	// Connected clients, WebSocket and event streams
+	Clients int64 `json:"clients"`
+	// Subscriptions to email addresses and patterns
+	Subscriptions int64 `json:"subscriptions"`
+	// Events dispatched to the clients of this instance
+	Events uint64 `json:"events"`
+	// Messages queued to clients, events and replies
+	Delivered uint64 `json:"delivered"`
+	// Clients disconnected because their queue was full
+	SlowConsumers uint64 `json:"slow_consumers"`
 }
 
-// WebSocketMessage represents a message sent over WebSocket
-type WebSocketMessage struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload"`
+// Reasons of a reservation_deleted event
+const (
+	reservationReleased = "released"
+	reservationExpired  = "expired"
+)
+
+const (
+	// Number of shards the subscriptions are spread over
+	hubShards = 64
+	// Number of messages queued for a client, a client falling further behind
+	// is disconnected rather than silently missing events
+	clientQueueSize = 256
+	// Maximum number of mailboxes and patterns a client can subscribe to
+	maxClientSubscriptions = 100
+	// How long a replayed event may wait for room in the client queue
+	replayWait = 10 * time.Second
+)
+
+var (
+	errTooManySubscriptions = fmt.Errorf("too many subscriptions, at most %d allowed", maxClientSubscriptions)
+	errAdminRequired        = errors.New("admin token required for domain and pattern subscriptions")
+	errClientClosed         = errors.New("client disconnected")
+	errInvalidPattern       = errors.New("invalid pattern")
+)
+
+// hubEvent is an event published to all the instances
+type hubEvent struct {
+	Email   string          `json:"email"`
+	Message json.RawMessage `json:"message,omitempty"`
+
+	// Set to check the subscriptions to the mailbox again, see
+	// ReauthorizeSubscriptions
+	Reauthorize bool `json:"reauthorize,omitempty"`
 }
 
 // NewWebSocketHub creates a new WebSocket hub
 func NewWebSocketHub() *WebSocketHub {
-	return &WebSocketHub{
-		broadcast:     make(chan []byte, 256),
-		register:      make(chan *WebSocketClient),
-		unregister:    make(chan *WebSocketClient),
-		clients:       make(map[*WebSocketClient]bool),
-		subscriptions: make(map[string][]*WebSocketClient),
+	h := &WebSocketHub{
+		clients:  make(map[*WebSocketClient]bool),
+		patterns: make(map[string]map[*WebSocketClient]bool),
 	}
+	for i := range h.shards {
+		h.shards[i].subscriptions = make(map[string]map[*WebSocketClient]bool)
+	}
+	return h
 }
 
-// Run starts the WebSocket hub
+// Run starts the WebSocket hub, it receives the events published by the other
+// instances
 func (h *WebSocketHub) Run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-
-				// Remove from subscriptions
-				if client.email != "" {
-					h.subLock.Lock()
-					clients := h.subscriptions[client.email]
-					for i, c := range clients {
-						if c == client {
-							h.subscriptions[client.email] = append(clients[:i], clients[i+1:]...)
-							break
-						}
-					}
-					if len(h.subscriptions[client.email]) == 0 {
-						delete(h.subscriptions, client.email)
-					}
-					h.subLock.Unlock()
-				}
-			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
-			}
-		}
+	if h.pubsub != nil {
+		h.receiveEvents()
+	}
+}
+
+// Metrics returns a snapshot of the activity of the hub
+func (h *WebSocketHub) Metrics() HubMetrics {
+	return HubMetrics{
+		Clients:       h.metrics.clients.Load(),
+		Subscriptions: h.metrics.subscriptions.Load(),
+		Events:        h.metrics.events.Load(),
+		Delivered:     h.metrics.delivered.Load(),
+		SlowConsumers: h.metrics.slowConsumers.Load(),
 	}
 }
 
-// Subscribe subscribes a client to an email address
-func (h *WebSocketHub) Subscribe(client *WebSocketClient, email string) {
-	h.subLock.Lock()
-	defer h.subLock.Unlock()
+// Register adds a client to the hub
+func (h *WebSocketHub) Register(client *WebSocketClient) {
+	h.clientLock.Lock()
+	defer h.clientLock.Unlock()
+
+	h.clients[client] = true
+	h.metrics.clients.Add(1)
+}
 
-	// Unsubscribe from previous email if any
-	if client.email != "" && client.email != email {
-		clients := h.subscriptions[client.email]
-		for i, c := range clients {
-			if c == client {
-				h.subscriptions[client.email] = append(clients[:i], clients[i+1:]...)
-				break
-			}
+// Unregister removes a client and all its subscriptions from the hub and
+// closes it. It may be called several times, from any goroutine.
+func (h *WebSocketHub) Unregister(client *WebSocketClient) {
+	client.closeOnce.Do(func() {
+		client.mu.Lock()
+		client.closed = true
+		for email := range client.subscriptions {
+			h.removeSubscription(client, email)
 		}
-		if len(h.subscriptions[client.email]) == 0 {
-			delete(h.subscriptions, client.email)
+		client.subscriptions = nil
+		client.replaying = nil
+		client.mu.Unlock()
+
+		h.clientLock.Lock()
+		if h.clients[client] {
+			delete(h.clients, client)
+			h.metrics.clients.Add(-1)
 		}
+		h.clientLock.Unlock()
+
+		close(client.done)
+	})
+}
+
+// disconnectSlow disconnects a client that doesn't keep up with its events
+func (h *WebSocketHub) disconnectSlow(client *WebSocketClient) {
+	if client.slow.CompareAndSwap(false, true) {
+		h.metrics.slowConsumers.Add(1)
+		log.Printf("Disconnecting slow WebSocket client")
+	}
+	h.Unregister(client)
+}
+
+// shard returns the shard holding the subscriptions of an email address
+func (h *WebSocketHub) shard(email string) *hubShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(email))
+	return &h.shards[hash.Sum32()%hubShards]
+}
+
+// isPattern tells whether a subscription is a pattern, such as *@example.com
+// for a whole domain, rather than an email address
+func isPattern(subscription string) bool {
+	return strings.ContainsAny(subscription, "*?[")
+}
+
+// Subscribe subscribes a client to an email address or a pattern
+func (h *WebSocketHub) Subscribe(client *WebSocketClient, email string) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return errClientClosed
+	}
+	if client.subscriptions[email] {
+		return nil
+	}
+	if len(client.subscriptions) >= maxClientSubscriptions {
+		return errTooManySubscriptions
 	}
 
-	// Subscribe to new email
-	client.email = email
-	if _, ok := h.subscriptions[email]; !ok {
-		h.subscriptions[email] = make([]*WebSocketClient, 0)
+	if client.subscriptions == nil {
+		client.subscriptions = make(map[string]bool)
 	}
-	h.subscriptions[email] = append(h.subscriptions[email], client)
+	client.subscriptions[email] = true
+	h.addSubscription(client, email)
+
+	return nil
 }
 
-// NotifyNewEmail notifies all clients subscribed to an email address about a new email
-func (h *WebSocketHub) NotifyNewEmail(email, messageID string) {
-	h.subLock.RLock()
-	defer h.subLock.RUnlock()
+// Unsubscribe unsubscribes a client from an email address or a pattern, it
+// returns false if the client wasn't subscribed
+func (h *WebSocketHub) Unsubscribe(client *WebSocketClient, email string) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
 
-	clients, ok := h.subscriptions[email]
-	if !ok {
-		return
+	if !client.subscriptions[email] {
+		return false
 	}
+	delete(client.subscriptions, email)
+	h.removeSubscription(client, email)
 
-	// Create JSON message
-	payload := map[string]string{
-		"email": email,
+	return true
+}
+
+// UnsubscribeAll unsubscribes a client from all its subscriptions
+func (h *WebSocketHub) UnsubscribeAll(client *WebSocketClient) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for email := range client.subscriptions {
+		delete(client.subscriptions, email)
+		h.removeSubscription(client, email)
 	}
+}
 
-	if messageID != "" {
-		payload["message_id"] = messageID
+// Subscriptions returns the email addresses and patterns a client is
+// subscribed to, sorted
+func (h *WebSocketHub) Subscriptions(client *WebSocketClient) []string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	subscriptions := make([]string, 0, len(client.subscriptions))
+	for email := range client.subscriptions {
+		subscriptions = append(subscriptions, email)
 	}
+	sort.Strings(subscriptions)
 
-	msgData, err := json.Marshal(WebSocketMessage{
-		Type:    "new_email",
-		Payload: payload,
-	})
+	return subscriptions
+}
 
-	if err != nil {
-		log.Printf("Error creating WebSocket message: %v", err)
-		return
+// addSubscription adds a client to the subscribers of an email address or a
+// pattern, the client lock must be held
+func (h *WebSocketHub) addSubscription(client *WebSocketClient, email string) {
+	if isPattern(email) {
+		h.patternLock.Lock()
+		defer h.patternLock.Unlock()
+		addSubscriber(h.patterns, email, client)
+	} else {
+		shard := h.shard(email)
+		shard.Lock()
+		defer shard.Unlock()
+		addSubscriber(shard.subscriptions, email, client)
 	}
+	h.metrics.subscriptions.Add(1)
+}
 
-	// Send message to all subscribed clients
-	for _, client := range clients {
-		select {
-		case client.send <- msgData:
-		default:
-			// If channel is full, just continue
-		}
+// removeSubscription removes a client from the subscribers of an email
+// address or a pattern, the client lock must be held
+func (h *WebSocketHub) removeSubscription(client *WebSocketClient, email string) {
+	if isPattern(email) {
+		h.patternLock.Lock()
+		defer h.patternLock.Unlock()
+		removeSubscriber(h.patterns, email, client)
+	} else {
+		shard := h.shard(email)
+		shard.Lock()
+		defer shard.Unlock()
+		removeSubscriber(shard.subscriptions, email, client)
 	}
+	h.metrics.subscriptions.Add(-1)
 }
 
-// Upgrader configuration
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins in development
-	},
+func addSubscriber(subscriptions map[string]map[*WebSocketClient]bool, email string, client *WebSocketClient) {
+	if _, ok := subscriptions[email]; !ok {
+		subscriptions[email] = make(map[*WebSocketClient]bool)
+	}
+	subscriptions[email][client] = true
 }
 
-// ServeWs handles WebSocket requests from clients
-func ServeWs(hub *WebSocketHub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
+func removeSubscriber(subscriptions map[string]map[*WebSocketClient]bool, email string, client *WebSocketClient) {
+	delete(subscriptions[email], client)
+	if len(subscriptions[email]) == 0 {
+		delete(subscriptions, email)
+	}
+}
+
+// NotifyNewEmail notifies all clients subscribed to an email address about a new email
+func (h *WebSocketHub) NotifyNewEmail(email string, message *redis.Message) {
+	h.Notify(email, "new_email", newEmailPayload(email, message))
+}
+
+// newEmailPayload returns the payload of a new_email event, with the summary
+// of the message so clients don't have to fetch the inbox again
+func newEmailPayload(email string, message *redis.Message) map[string]interface{} {
+	payload := map[string]interface{}{
+		"email":      email,
+		"message_id": message.ID,
+		"summary":    message.Summary(),
 	}
 
-	client := &WebSocketClient{
-		hub:  hub,
-		conn: conn,
-		send: make(chan []byte, 256),
+	if message.Seq > 0 {
+		payload["seq"] = message.Seq
 	}
 
-	client.hub.register <- client
+	return payload
+}
 
-	// Start goroutines for reading and writing
-	go client.readPump()
-	go client.writePump()
+// NotifyEmailDeleted notifies the clients subscribed to an email address that
+// a message was deleted
+func (h *WebSocketHub) NotifyEmailDeleted(email, messageID string) {
+	h.Notify(email, "email_deleted", map[string]interface{}{
+		"email":      email,
+		"message_id": messageID,
+	})
 }
 
-// readPump reads messages from the WebSocket connection
-func (c *WebSocketClient) readPump() {
-	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
-	}()
+// NotifyEmailExpired notifies the clients subscribed to an email address that
+// a message reached its TTL
+func (h *WebSocketHub) NotifyEmailExpired(email, messageID string) {
+	h.Notify(email, "email_expired", map[string]interface{}{
+		"email":      email,
+		"message_id": messageID,
+	})
+}
 
-	c.conn.SetReadLimit(512)
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
+// NotifyInboxCleared notifies the clients subscribed to an email address that
+// all its messages were deleted
+func (h *WebSocketHub) NotifyInboxCleared(email string, deleted int) {
+	h.Notify(email, "inbox_cleared", map[string]interface{}{
+		"email":   email,
+		"deleted": deleted,
+	})
+}
+
+// NotifyReservationExpiring warns the clients subscribed to a reserved mailbox
+// that the reservation is about to expire. Every instance watches the
+// reservations, so the warning is only sent to local clients.
+func (h *WebSocketHub) NotifyReservationExpiring(email string, expiresAt time.Time) {
+	h.notifyLocal(email, "reservation_expiring", map[string]interface{}{
+		"email":      email,
+		"expires_at": expiresAt,
 	})
+}
+
+// NotifyReservationDeleted notifies the clients subscribed to a mailbox that
+// its reservation was released by the owner, or expired
+func (h *WebSocketHub) NotifyReservationDeleted(email, reason string) {
+	payload := map[string]interface{}{
+		"email":  email,
+		"reason": reason,
+	}
+
+	// Every instance watches the reservations expire
+	if reason == reservationExpired {
+		h.notifyLocal(email, "reservation_deleted", payload)
+		return
+	}
+	h.Notify(email, "reservation_deleted", payload)
+}
 
-	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			}
-			break
+// ReauthorizeSubscriptions checks the subscriptions to a mailbox again, on
+// every instance, once its reservation changed hands. Subscriptions are
+// otherwise only authorized when made.
+func (h *WebSocketHub) ReauthorizeSubscriptions(email string) {
+	if h.pubsub != nil {
+		event, _ := json.Marshal(hubEvent{Email: email, Reauthorize: true})
+		err := h.pubsub.PublishEvent(event)
+		if err == nil {
+			return
 		}
+		log.Printf("Error publishing event, reauthorizing local clients only: %v", err)
+	}
+
+	h.reauthorize(email)
+}
 
-		// Parse the message
-		var msg struct {
-			Type    string `json:"type"`
-			Payload struct {
-				Email string `json:"email"`
-			} `json:"payload"`
+// reauthorize drops the subscriptions to a mailbox of the local clients whose
+// credentials no longer grant access. WebSocket clients are told with a
+// subscription_revoked event, event streams are closed.
+func (h *WebSocketHub) reauthorize(email string) {
+	shard := h.shard(email)
+	shard.RLock()
+	clients := make([]*WebSocketClient, 0, len(shard.subscriptions[email]))
+	for client := range shard.subscriptions[email] {
+		clients = append(clients, client)
+	}
+	shard.RUnlock()
+
+	for _, client := range clients {
+		if err := client.authorizeSubscription(email); err == nil {
+			continue
 		}
 
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Error parsing WebSocket message: %v", err)
+		if client.conn == nil {
+			h.Unregister(client)
 			continue
 		}
 
-		// Handle message based on type
-		switch msg.Type {
-		case "subscribe":
-			if msg.Payload.Email != "" {
-				c.hub.Subscribe(c, msg.Payload.Email)
-				log.Printf("Client subscribed to %s", msg.Payload.Email)
-			}
-		case "unsubscribe":
-			if msg.Payload.Email != "" && msg.Payload.Email == c.email {
-				c.email = ""
-				// The client will be removed from subscriptions in the unregister handler
-			}
+		if h.Unsubscribe(client, email) {
+			client.forgetCredentials([]string{email})
+			client.reply("subscription_revoked", "", map[string]interface{}{
+				"email":         email,
+				"subscriptions": h.Subscriptions(client),
+			})
+		}
+	}
+}
+
+// notifyLocal sends an event to the clients of this instance only
+func (h *WebSocketHub) notifyLocal(email, eventType string, payload map[string]interface{}) {
+	msgData, err := json.Marshal(WebSocketMessage{
+		Type:    eventType,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("Error creating WebSocket message: %v", err)
+		return
+	}
+
+	h.dispatch(email, msgData)
+}
+
+// Notify sends an event to all clients subscribed to an email address, on
+// every instance
+func (h *WebSocketHub) Notify(email, eventType string, payload map[string]interface{}) {
+	// Create JSON message
+	msgData, err := json.Marshal(WebSocketMessage{
+		Type:    eventType,
+		Payload: payload,
+	})
+
+	if err != nil {
+		log.Printf("Error creating WebSocket message: %v", err)
+		return
+	}
+
+	if h.pubsub != nil {
+		event, _ := json.Marshal(hubEvent{Email: email, Message: msgData})
+		err := h.pubsub.PublishEvent(event)
+		if err == nil {
+			return
+		}
+		log.Printf("Error publishing event, notifying local clients only: %v", err)
+	}
+
+	h.dispatch(email, msgData)
+}
+
+// receiveEvents dispatches the events published by all the instances
+func (h *WebSocketHub) receiveEvents() {
+	for data := range h.pubsub.SubscribeEvents(context.Background()) {
+		var event hubEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Printf("Error parsing published event: %v", err)
+			continue
+		}
+		if event.Reauthorize {
+			h.reauthorize(event.Email)
+			continue
 		}
+		h.dispatch(event.Email, event.Message)
 	}
 }
 
-// writePump writes messages to the WebSocket connection
-func (c *WebSocketClient) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
-				return
-			}
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
+// dispatch sends a message to the local clients subscribed to an email address
+func (h *WebSocketHub) dispatch(email string, msgData []byte) {
+	h.metrics.events.Add(1)
+
+	// A client subscribed to both the address and a matching pattern gets
+	// the message once
+	recipients := make(map[*WebSocketClient]bool)
+
+	shard := h.shard(email)
+	shard.RLock()
+	for client := range shard.subscriptions[email] {
+		recipients[client] = true
+	}
+	shard.RUnlock()
+
+	h.patternLock.RLock()
+	for pattern, clients := range h.patterns {
+		if matched, _ := path.Match(pattern, email); !matched {
+			continue
+		}
+		for client := range clients {
+			recipients[client] = true
 		}
 	}
+	h.patternLock.RUnlock()
+
+	// Send message to all subscribed clients, no lock is held so that
+	// clients can be disconnected
+	for client := range recipients {
+		client.deliver(email, msgData)
+	}
 }
@@ -0,0 +1,450 @@
+// server/websocket_client.go
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// WebSocketClient represents a connected client, a WebSocket connection or
+// an event stream
+type WebSocketClient struct {
+	hub *WebSocketHub
+
+	// The websocket connection, nil for event streams
+	conn *websocket.Conn
+
+	// Bounded queue of outbound messages. It is never closed, done is closed
+	// once the client is unregistered.
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Whether the client was disconnected for falling behind
+	slow atomic.Bool
+
+	// Guards the fields below
+	mu sync.Mutex
+
+	// Email addresses and patterns this client is subscribed to
+	subscriptions map[string]bool
+
+	// Live events of the mailboxes being replayed, delivered once the replay
+	// is over
+	replaying map[string][][]byte
+
+	// Credentials presented when subscribing to each mailbox
+	credentials map[string]mailboxCredentials
+
+	// Checks again that an event stream may access its mailbox, WebSocket
+	// clients use their credentials instead
+	reauthorize func(email string) error
+
+	// Set once the client is unregistered
+	closed bool
+}
+
+// WebSocketMessage represents a message sent over WebSocket, replies to a
+// client request carry its ID
+type WebSocketMessage struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Payload interface{} `json:"payload"`
+}
+
+// newWebSocketClient creates a client of the hub, conn is nil for event
+// streams
+func newWebSocketClient(hub *WebSocketHub, conn *websocket.Conn) *WebSocketClient {
+	return &WebSocketClient{
+		hub:  hub,
+		conn: conn,
+		send: make(chan []byte, clientQueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+// ServeWs handles WebSocket requests from clients
+func ServeWs(hub *WebSocketHub, w http.ResponseWriter, r *http.Request) {
+	// Clients asking for protocols must support the current one
+	if protocols := websocket.Subprotocols(r); len(protocols) > 0 && !slices.Contains(protocols, webSocketProtocol) {
+		http.Error(w, fmt.Sprintf("Unsupported WebSocket protocol, supported: %s", webSocketProtocol), http.StatusBadRequest)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    []string{webSocketProtocol},
+		CheckOrigin:     hub.checkOrigin,
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket handshake from %s refused: %v", r.Header.Get("Origin"), err)
+		return
+	}
+
+	client := newWebSocketClient(hub, conn)
+	hub.Register(client)
+
+	if conn.Subprotocol() == webSocketProtocol {
+		client.hello()
+	}
+
+	// Start goroutines for reading and writing
+	go client.readPump()
+	go client.writePump()
+}
+
+// readPump reads messages from the WebSocket connection
+func (c *WebSocketClient) readPump() {
+	defer func() {
+		c.hub.Unregister(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxCommandSize)
+	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			break
+		}
+
+		var cmd webSocketCommand
+		if err := json.Unmarshal(message, &cmd); err != nil {
+			c.replyError("", &WebSocketError{
+				Code:    errCodeInvalidMessage,
+				Message: "invalid JSON message",
+			})
+			continue
+		}
+
+		c.handle(&cmd)
+	}
+}
+
+// subscribe subscribes the client to all the email addresses and patterns of
+// a request, or to none of them if any is refused. With a since cursor, the
+// messages of the addresses stored after that sequence number are replayed
+// before live events, patterns are not replayed.
+func (c *WebSocketClient) subscribe(id string, emails []string, creds mailboxCredentials, since *int64) {
+	if len(emails) == 0 {
+		c.replyError(id, &WebSocketError{
+			Command: "subscribe",
+			Code:    errCodeInvalidRequest,
+			Message: "email required",
+		})
+		return
+	}
+
+	refused := make(map[string]*WebSocketError)
+	for _, email := range emails {
+		if err := c.hub.authorizeSubscription(email, creds.Token); err != nil {
+			refused[email] = newWebSocketError("", err)
+		}
+	}
+
+	if len(refused) > 0 {
+		c.replyError(id, &WebSocketError{
+			Command: "subscribe",
+			Code:    errCodeForbidden,
+			Message: "subscription refused",
+			Refused: refused,
+		})
+		return
+	}
+
+	// Live events are held back from the subscription on, so that none
+	// falls between the replay and live delivery
+	var replay []string
+	if since != nil && c.hub.pubsub != nil {
+		for _, email := range emails {
+			if !isPattern(email) {
+				replay = append(replay, email)
+			}
+		}
+	}
+	for _, email := range replay {
+		c.startReplay(email)
+	}
+
+	var subscribed []string
+	for _, email := range emails {
+		if c.isSubscribed(email) {
+			continue
+		}
+		if err := c.hub.Subscribe(c, email); err != nil {
+			for _, email := range subscribed {
+				c.hub.Unsubscribe(c, email)
+			}
+			for _, email := range replay {
+				c.endReplay(email, 0)
+			}
+			c.replyError(id, newWebSocketError("subscribe", err))
+			return
+		}
+		subscribed = append(subscribed, email)
+	}
+
+	// Later commands on the mailboxes use the same credentials
+	c.rememberCredentials(emails, creds)
+
+	missed := make(map[string][]*redis.Message, len(replay))
+	for _, email := range replay {
+		messages, err := c.hub.pubsub.RetrieveMessagesSince(email, *since)
+		if err != nil {
+			log.Printf("Error replaying events of %s: %v", email, err)
+		}
+		missed[email] = messages
+	}
+
+	log.Printf("Client subscribed to %s", strings.Join(emails, ", "))
+	payload := map[string]interface{}{
+		"command":       "subscribe",
+		"subscriptions": c.hub.Subscriptions(c),
+	}
+	if len(replay) > 0 {
+		replayed := make(map[string]int, len(missed))
+		for email, messages := range missed {
+			replayed[email] = len(messages)
+		}
+		payload["replayed"] = replayed
+	}
+	c.reply("ack", id, payload)
+
+	for _, email := range replay {
+		var lastSeq int64
+		for _, message := range missed[email] {
+			msgData, err := json.Marshal(WebSocketMessage{
+				Type:    "new_email",
+				Payload: newEmailPayload(email, message),
+			})
+			if err != nil {
+				continue
+			}
+
+			select {
+			case c.send <- msgData:
+				c.hub.metrics.delivered.Add(1)
+				lastSeq = message.Seq
+			case <-c.done:
+				return
+			case <-time.After(replayWait):
+				c.hub.disconnectSlow(c)
+				return
+			}
+		}
+		c.endReplay(email, lastSeq)
+	}
+}
+
+// startReplay holds back the live events of a mailbox
+func (c *WebSocketClient) startReplay(email string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if c.replaying == nil {
+		c.replaying = make(map[string][][]byte)
+	}
+	c.replaying[email] = [][]byte{}
+}
+
+// endReplay delivers the live events held back during the replay of a
+// mailbox, except the messages already replayed up to lastSeq
+func (c *WebSocketClient) endReplay(email string, lastSeq int64) {
+	c.mu.Lock()
+
+	full := false
+	for _, msgData := range c.replaying[email] {
+		var event struct {
+			Payload struct {
+				Seq int64 `json:"seq"`
+			} `json:"payload"`
+		}
+		json.Unmarshal(msgData, &event)
+
+		// Already replayed
+		if event.Payload.Seq > 0 && event.Payload.Seq <= lastSeq {
+			continue
+		}
+
+		if !c.trySend(msgData) {
+			full = true
+			break
+		}
+	}
+	delete(c.replaying, email)
+	c.mu.Unlock()
+
+	if full {
+		c.hub.disconnectSlow(c)
+	}
+}
+
+// unsubscribe unsubscribes the client from the email addresses and patterns
+// of a request, or from everything if there are none
+func (c *WebSocketClient) unsubscribe(id string, emails []string) {
+	if len(emails) == 0 {
+		c.hub.UnsubscribeAll(c)
+	}
+	c.forgetCredentials(emails)
+
+	var unknown []string
+	for _, email := range emails {
+		if !c.hub.Unsubscribe(c, email) {
+			unknown = append(unknown, email)
+		}
+	}
+
+	payload := map[string]interface{}{
+		"command":       "unsubscribe",
+		"subscriptions": c.hub.Subscriptions(c),
+	}
+	if len(unknown) > 0 {
+		payload["not_subscribed"] = unknown
+	}
+
+	c.reply("ack", id, payload)
+}
+
+// authorizeSubscription checks that token grants a subscription to an email
+// address or a pattern, patterns are reserved to admins
+func (h *WebSocketHub) authorizeSubscription(email, token string) error {
+	if isPattern(email) {
+		if _, err := path.Match(email, ""); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidPattern, err)
+		}
+		if h.authorizeAdmin == nil || !h.authorizeAdmin(token) {
+			return errAdminRequired
+		}
+		return nil
+	}
+
+	// Admins can subscribe to any mailbox
+	if h.authorize == nil || (h.authorizeAdmin != nil && h.authorizeAdmin(token)) {
+		return nil
+	}
+	return h.authorize(email, token)
+}
+
+// authorizeSubscription checks again that the client may be subscribed to a
+// mailbox, with the credentials it subscribed with
+func (c *WebSocketClient) authorizeSubscription(email string) error {
+	if c.reauthorize != nil {
+		return c.reauthorize(email)
+	}
+	return c.hub.authorizeSubscription(email, c.rememberedCredentials(email).Token)
+}
+
+// reply sends a message to the client only
+func (c *WebSocketClient) reply(msgType, id string, payload map[string]interface{}) {
+	msgData, err := json.Marshal(WebSocketMessage{
+		Type:    msgType,
+		ID:      id,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("Error creating WebSocket message: %v", err)
+		return
+	}
+
+	if !c.trySend(msgData) {
+		c.hub.disconnectSlow(c)
+	}
+}
+
+// deliver queues an event of a mailbox, or holds it back if the mailbox is
+// being replayed. A client whose queue is full is disconnected.
+func (c *WebSocketClient) deliver(email string, msgData []byte) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if events, ok := c.replaying[email]; ok {
+		if len(events) < clientQueueSize {
+			c.replaying[email] = append(events, msgData)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		c.hub.disconnectSlow(c)
+		return
+	}
+	c.mu.Unlock()
+
+	if !c.trySend(msgData) {
+		c.hub.disconnectSlow(c)
+	}
+}
+
+// trySend queues a message without waiting, it returns false if the queue is
+// full
+func (c *WebSocketClient) trySend(msgData []byte) bool {
+	select {
+	case c.send <- msgData:
+		c.hub.metrics.delivered.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+// writePump writes messages to the WebSocket connection
+func (c *WebSocketClient) writePump() {
+	ticker := time.NewTicker(54 * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+			// One message per frame, clients parse each frame as JSON
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-c.done:
+			// The hub unregistered the client, slow clients are told to
+			// come back later
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			closeMessage := []byte{}
+			if c.slow.Load() {
+				closeMessage = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer")
+			}
+			c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
+			return
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
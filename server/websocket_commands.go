@@ -0,0 +1,347 @@
+// server/websocket_commands.go
+package server
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// Version of the WebSocket protocol, negotiated with Sec-WebSocket-Protocol.
+// Clients that don't ask for a protocol get the same commands, without the
+// hello frame.
+const webSocketProtocol = "ephimail.v1"
+
+// Maximum size of a command sent by a client
+const maxCommandSize = 32 << 10
+
+// Commands clients can send
+var webSocketCommands = []string{"subscribe", "unsubscribe", "list", "get", "delete", "ping"}
+
+// Codes of the error frames
+const (
+	errCodeInvalidMessage = "invalid_message"
+	errCodeUnknownCommand = "unknown_command"
+	errCodeInvalidRequest = "invalid_request"
+	errCodeUnauthorized   = "unauthorized"
+	errCodeLocked         = "locked"
+	errCodeForbidden      = "forbidden"
+	errCodeNotFound       = "not_found"
+	errCodeLimitExceeded  = "limit_exceeded"
+	errCodeUnavailable    = "unavailable"
+	errCodeInternal       = "internal_error"
+)
+
+var errMessageNotFound = errors.New("email not found")
+
+// WebSocketError is the payload of an error frame
+type WebSocketError struct {
+	Command string `json:"command,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// Reasons of the refused subscriptions, by email address or pattern
+	Refused map[string]*WebSocketError `json:"refused,omitempty"`
+}
+
+// newWebSocketError returns the error frame payload of an error
+func newWebSocketError(command string, err error) *WebSocketError {
+	code := errCodeInternal
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		code = errCodeUnauthorized
+	case errors.Is(err, ErrLocked):
+		code = errCodeLocked
+	case errors.Is(err, errAdminRequired):
+		code = errCodeForbidden
+	case errors.Is(err, errTooManySubscriptions):
+		code = errCodeLimitExceeded
+	case errors.Is(err, errInvalidPattern):
+		code = errCodeInvalidRequest
+	case errors.Is(err, errMessageNotFound):
+		code = errCodeNotFound
+	}
+
+	if code == errCodeInternal {
+		log.Printf("Error running WebSocket command %s: %v", command, err)
+	}
+
+	return &WebSocketError{
+		Command: command,
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+// mailboxCredentials are the credentials of a mailbox sent with a command:
+// the owner token, or a session token for passphrase protected mailboxes
+type mailboxCredentials struct {
+	Token   string `json:"token,omitempty"`
+	Session string `json:"session,omitempty"`
+}
+
+// webSocketCommand is a command sent by a client, replies carry its ID
+type webSocketCommand struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Payload struct {
+		mailboxCredentials
+
+		Email     string   `json:"email"`
+		Emails    []string `json:"emails,omitempty"`
+		MessageID string   `json:"message_id,omitempty"`
+		Since     *int64   `json:"since,omitempty"`
+	} `json:"payload"`
+}
+
+// mailboxCommands serves the inbox commands of WebSocket clients
+type mailboxCommands interface {
+	listMailbox(email string, creds mailboxCredentials) ([]*redis.MessageSummary, error)
+	readMessage(email, id string, creds mailboxCredentials) (*redis.Message, error)
+	removeMessage(email, id string, creds mailboxCredentials) error
+}
+
+// hello tells a client that negotiated the protocol what it can do
+func (c *WebSocketClient) hello() {
+	c.reply("hello", "", map[string]interface{}{
+		"protocol": webSocketProtocol,
+		"commands": webSocketCommands,
+	})
+}
+
+// handle runs a command of the client
+func (c *WebSocketClient) handle(cmd *webSocketCommand) {
+	emails := cmd.Payload.Emails
+	if cmd.Payload.Email != "" {
+		emails = append(emails, cmd.Payload.Email)
+	}
+
+	switch cmd.Type {
+	case "subscribe":
+		c.subscribe(cmd.ID, emails, cmd.Payload.mailboxCredentials, cmd.Payload.Since)
+	case "unsubscribe":
+		c.unsubscribe(cmd.ID, emails)
+	case "list", "get", "delete":
+		c.runMailboxCommand(cmd)
+	case "ping":
+		c.reply("ack", cmd.ID, map[string]interface{}{
+			"command": "ping",
+			"time":    time.Now(),
+		})
+	default:
+		c.replyError(cmd.ID, &WebSocketError{
+			Command: cmd.Type,
+			Code:    errCodeUnknownCommand,
+			Message: fmt.Sprintf("unknown command %q", cmd.Type),
+		})
+	}
+}
+
+// runMailboxCommand runs a command on the messages of a mailbox, with the
+// credentials of the command or else the ones of the subscription
+func (c *WebSocketClient) runMailboxCommand(cmd *webSocketCommand) {
+	email := cmd.Payload.Email
+	if email == "" || isPattern(email) {
+		c.replyError(cmd.ID, &WebSocketError{
+			Command: cmd.Type,
+			Code:    errCodeInvalidRequest,
+			Message: "email address required",
+		})
+		return
+	}
+	if cmd.Type != "list" && cmd.Payload.MessageID == "" {
+		c.replyError(cmd.ID, &WebSocketError{
+			Command: cmd.Type,
+			Code:    errCodeInvalidRequest,
+			Message: "message_id required",
+		})
+		return
+	}
+
+	commands := c.hub.commands
+	if commands == nil {
+		c.replyError(cmd.ID, &WebSocketError{
+			Command: cmd.Type,
+			Code:    errCodeUnavailable,
+			Message: "mailbox commands unavailable",
+		})
+		return
+	}
+
+	creds := cmd.Payload.mailboxCredentials
+	if creds == (mailboxCredentials{}) {
+		creds = c.rememberedCredentials(email)
+	}
+
+	payload := map[string]interface{}{
+		"command": cmd.Type,
+		"email":   email,
+	}
+
+	var err error
+	switch cmd.Type {
+	case "list":
+		payload["messages"], err = commands.listMailbox(email, creds)
+	case "get":
+		payload["message"], err = commands.readMessage(email, cmd.Payload.MessageID, creds)
+	case "delete":
+		err = commands.removeMessage(email, cmd.Payload.MessageID, creds)
+		payload["message_id"] = cmd.Payload.MessageID
+	}
+
+	if err != nil {
+		c.replyError(cmd.ID, newWebSocketError(cmd.Type, err))
+		return
+	}
+
+	c.reply("ack", cmd.ID, payload)
+}
+
+// replyError sends an error frame to the client
+func (c *WebSocketClient) replyError(id string, wsErr *WebSocketError) {
+	msgData, err := json.Marshal(WebSocketMessage{
+		Type:    "error",
+		ID:      id,
+		Payload: wsErr,
+	})
+	if err != nil {
+		log.Printf("Error creating WebSocket message: %v", err)
+		return
+	}
+
+	if !c.trySend(msgData) {
+		c.hub.disconnectSlow(c)
+	}
+}
+
+// isSubscribed tells whether the client is subscribed to an email address or
+// a pattern
+func (c *WebSocketClient) isSubscribed(email string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.subscriptions[email]
+}
+
+// rememberCredentials keeps the credentials used to subscribe to mailboxes
+func (c *WebSocketClient) rememberCredentials(emails []string, creds mailboxCredentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.credentials == nil {
+		c.credentials = make(map[string]mailboxCredentials)
+	}
+	for _, email := range emails {
+		if !isPattern(email) {
+			c.credentials[email] = creds
+		}
+	}
+}
+
+// forgetCredentials drops the credentials of mailboxes, or of all of them if
+// there are none
+func (c *WebSocketClient) forgetCredentials(emails []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(emails) == 0 {
+		c.credentials = nil
+	}
+	for _, email := range emails {
+		delete(c.credentials, email)
+	}
+}
+
+// rememberedCredentials returns the credentials used to subscribe to a
+// mailbox
+func (c *WebSocketClient) rememberedCredentials(email string) mailboxCredentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.credentials[email]
+}
+
+// openMailbox checks the credentials of a mailbox like accessMailbox does
+// for requests, it returns the private key of passphrase protected mailboxes
+func (w *WebServer) openMailbox(email string, creds mailboxCredentials) (*ecdh.PrivateKey, error) {
+	reservation, err := w.storage.GetReservation(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation: %w", err)
+	}
+
+	if reservation == nil || !reservation.PassphraseProtected {
+		_, err := w.authorizeOwner(email, creds.Token, nil)
+		return nil, err
+	}
+
+	return w.unlockMailboxWith(reservation, creds.Session, "")
+}
+
+// listMailbox returns the summaries of the messages of a mailbox
+func (w *WebServer) listMailbox(email string, creds mailboxCredentials) ([]*redis.MessageSummary, error) {
+	if _, err := w.openMailbox(email, creds); err != nil {
+		return nil, err
+	}
+
+	messages, err := w.storage.RetrieveMessages(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get emails: %w", err)
+	}
+
+	summaries := make([]*redis.MessageSummary, 0, len(messages))
+	for _, message := range messages {
+		summaries = append(summaries, message.Summary())
+	}
+	return summaries, nil
+}
+
+// readMessage returns a message of a mailbox, decrypted if the mailbox is
+// passphrase protected
+func (w *WebServer) readMessage(email, id string, creds mailboxCredentials) (*redis.Message, error) {
+	privateKey, err := w.openMailbox(email, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := w.storage.RetrieveMessage(email, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get email: %w", err)
+	}
+	if message == nil {
+		return nil, errMessageNotFound
+	}
+
+	if err := w.markRead(email, message); err != nil {
+		return nil, fmt.Errorf("failed to update email: %w", err)
+	}
+
+	decryptMessage(message, privateKey)
+	return message, nil
+}
+
+// removeMessage deletes a message of a mailbox and notifies its subscribers
+func (w *WebServer) removeMessage(email, id string, creds mailboxCredentials) error {
+	if _, err := w.authorizeOwner(email, creds.Token, nil); err != nil {
+		return err
+	}
+
+	deleted, err := w.storage.DeleteMessage(email, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete email: %w", err)
+	}
+	if !deleted {
+		return errMessageNotFound
+	}
+
+	w.unindexMessage(email, id)
+
+	if w.hub != nil {
+		w.hub.NotifyEmailDeleted(email, id)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+func TestWebSocketProtocol(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServerWithWebSocket(storage, []string{"example.com"})
+	server := httptest.NewServer(web.Router())
+	defer server.Close()
+
+	// Clients asking for the protocol are greeted with the commands
+	conn := dialWebSocket(t, server, "other.v2", webSocketProtocol)
+	if conn.Subprotocol() != webSocketProtocol {
+		t.Errorf("negotiated %q, want %q", conn.Subprotocol(), webSocketProtocol)
+	}
+	hello := readWebSocket(t, conn)
+	payload, _ := hello["payload"].(map[string]interface{})
+	if hello["type"] != "hello" || payload["protocol"] != webSocketProtocol {
+		t.Fatalf("got %v, want hello", hello)
+	}
+	if commands := fmt.Sprint(payload["commands"]); commands != fmt.Sprint(webSocketCommands) {
+		t.Errorf("got commands %s", commands)
+	}
+
+	// Others get the same commands without the greeting
+	conn = dialWebSocket(t, server)
+	if conn.Subprotocol() != "" {
+		t.Errorf("negotiated %q without asking", conn.Subprotocol())
+	}
+	conn.WriteJSON(map[string]interface{}{"type": "ping", "id": "1"})
+	if ack := readWebSocket(t, conn); ack["type"] != "ack" || ack["id"] != "1" {
+		t.Errorf("got %v, want the ping ack", ack)
+	}
+
+	// Clients asking for unknown protocols only are refused
+	dialer := websocket.Dialer{Subprotocols: []string{"other.v2"}}
+	_, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %v, want status %d", err, http.StatusBadRequest)
+	}
+}
+
+func TestWebSocketCommands(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServerWithWebSocket(storage, []string{"example.com"})
+	web.EnableReservations = true
+	web.wsHub.pubsub = nil // Events stay in process, the hub isn't running
+	server := httptest.NewServer(web.Router())
+	defer server.Close()
+
+	const email = "alice@example.com"
+	owner := reserve(t, web.WebServer, email)
+
+	var ids []string
+	for i := range 2 {
+		id, err := storage.StoreMessage(email, &redis.Message{Body: fmt.Sprintf("message %d", i), ReceivedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	conn := dialWebSocket(t, server, webSocketProtocol)
+	readWebSocket(t, conn) // hello
+
+	// run sends a command and returns its reply
+	var sent int
+	run := func(cmdType string, payload map[string]interface{}) (string, map[string]interface{}) {
+		t.Helper()
+
+		sent++
+		id := fmt.Sprint(sent)
+		if err := conn.WriteJSON(map[string]interface{}{"type": cmdType, "id": id, "payload": payload}); err != nil {
+			t.Fatal(err)
+		}
+		reply := readWebSocket(t, conn)
+		if reply["id"] != id {
+			t.Fatalf("%s: got reply %v, want id %s", cmdType, reply, id)
+		}
+		replyPayload, _ := reply["payload"].(map[string]interface{})
+		return reply["type"].(string), replyPayload
+	}
+
+	// expectError runs a command that must fail with code
+	expectError := func(cmdType string, payload map[string]interface{}, code string) map[string]interface{} {
+		t.Helper()
+
+		replyType, reply := run(cmdType, payload)
+		if replyType != "error" || reply["code"] != code {
+			t.Errorf("%s %v: got %s %v, want error %s", cmdType, payload, replyType, reply, code)
+		}
+		return reply
+	}
+
+	// Reserved mailboxes require the owner token
+	expectError("list", map[string]interface{}{"email": email}, errCodeUnauthorized)
+	expectError("list", map[string]interface{}{"email": email, "token": "wrong"}, errCodeUnauthorized)
+	expectError("get", map[string]interface{}{"email": email, "message_id": ids[0], "token": "wrong"}, errCodeUnauthorized)
+	expectError("delete", map[string]interface{}{"email": email, "message_id": ids[0]}, errCodeUnauthorized)
+	refused := expectError("subscribe", map[string]interface{}{"email": email, "token": "wrong"}, errCodeForbidden)
+	if reasons, _ := refused["refused"].(map[string]interface{}); reasons[email].(map[string]interface{})["code"] != errCodeUnauthorized {
+		t.Errorf("got refused %v", refused["refused"])
+	}
+	expectError("subscribe", map[string]interface{}{"email": "*@example.com", "token": owner.OwnerToken}, errCodeForbidden)
+
+	// Malformed commands
+	expectError("list", map[string]interface{}{}, errCodeInvalidRequest)
+	expectError("list", map[string]interface{}{"email": "*@example.com"}, errCodeInvalidRequest)
+	expectError("get", map[string]interface{}{"email": email, "token": owner.OwnerToken}, errCodeInvalidRequest)
+	expectError("delete", map[string]interface{}{"email": email, "token": owner.OwnerToken}, errCodeInvalidRequest)
+	expectError("subscribe", map[string]interface{}{}, errCodeInvalidRequest)
+	expectError("rename", map[string]interface{}{"email": email}, errCodeUnknownCommand)
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{"))
+	if reply := readWebSocket(t, conn); reply["type"] != "error" || reply["payload"].(map[string]interface{})["code"] != errCodeInvalidMessage {
+		t.Errorf("got %v, want error %s", reply, errCodeInvalidMessage)
+	}
+
+	// Commands run with the token they carry
+	replyType, reply := run("list", map[string]interface{}{"email": email, "token": owner.OwnerToken})
+	messages, _ := reply["messages"].([]interface{})
+	if replyType != "ack" || reply["command"] != "list" || len(messages) != 2 {
+		t.Fatalf("got %s %v, want the 2 messages", replyType, reply)
+	}
+
+	replyType, reply = run("get", map[string]interface{}{"email": email, "message_id": ids[0], "token": owner.OwnerToken})
+	message, _ := reply["message"].(map[string]interface{})
+	if replyType != "ack" || message["id"] != ids[0] || message["body"] != "message 0" {
+		t.Fatalf("got %s %v, want message %s", replyType, reply, ids[0])
+	}
+	if stored, _ := storage.RetrieveMessage(email, ids[0]); !stored.Read {
+		t.Error("message not marked read")
+	}
+	expectError("get", map[string]interface{}{"email": email, "message_id": "unknown", "token": owner.OwnerToken}, errCodeNotFound)
+
+	// Or with the credentials of the subscription
+	if replyType, _ := run("subscribe", map[string]interface{}{"email": email, "token": owner.OwnerToken}); replyType != "ack" {
+		t.Fatalf("subscribe: got %s", replyType)
+	}
+
+	// Subscribers are notified of the deletion, before it is acknowledged
+	conn.WriteJSON(map[string]interface{}{"type": "delete", "id": "delete", "payload": map[string]interface{}{"email": email, "message_id": ids[1]}})
+	event := readWebSocket(t, conn)
+	payload, _ := event["payload"].(map[string]interface{})
+	if event["type"] != "email_deleted" || payload["message_id"] != ids[1] {
+		t.Errorf("got %v, want email_deleted", event)
+	}
+	ack := readWebSocket(t, conn)
+	payload, _ = ack["payload"].(map[string]interface{})
+	if ack["type"] != "ack" || ack["id"] != "delete" || payload["message_id"] != ids[1] {
+		t.Fatalf("got %v, want the deletion of %s", ack, ids[1])
+	}
+
+	expectError("delete", map[string]interface{}{"email": email, "message_id": ids[1]}, errCodeNotFound)
+
+	_, reply = run("list", map[string]interface{}{"email": email})
+	var listed []string
+	for _, message := range reply["messages"].([]interface{}) {
+		listed = append(listed, message.(map[string]interface{})["id"].(string))
+	}
+	if !slices.Equal(listed, ids[:1]) {
+		t.Errorf("listed %v after the deletion, want %v", listed, ids[:1])
+	}
+}
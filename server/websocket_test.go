@@ -0,0 +1,399 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/michelangelomo/ephimail/internal/redis"
+)
+
+// drain counts the messages received by a client until it is closed
+func drain(client *WebSocketClient, received *atomic.Int64) {
+	for {
+		select {
+		case <-client.send:
+			received.Add(1)
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// dialWebSocket connects to the WebSocket endpoint of a test server
+func dialWebSocket(t *testing.T, server *httptest.Server, protocols ...string) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWebSocket reads the next message of a connection, each frame holding
+// a single JSON message
+func readWebSocket(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("frame %q is not a JSON message: %v", data, err)
+	}
+	return message
+}
+
+func TestHubConcurrentClients(t *testing.T) {
+	const (
+		mailboxes = 500
+		clients   = 5000
+		events    = 20
+	)
+
+	hub := NewWebSocketHub()
+
+	counters := make([]atomic.Int64, clients)
+	all := make([]*WebSocketClient, clients)
+	for i := range all {
+		client := newWebSocketClient(hub, nil)
+		hub.Register(client)
+		if err := hub.Subscribe(client, fmt.Sprintf("user%d@example.com", i%mailboxes)); err != nil {
+			t.Fatal(err)
+		}
+		all[i] = client
+		go drain(client, &counters[i])
+	}
+
+	// Churning clients subscribe, unsubscribe and disconnect while events
+	// are dispatched
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			var received atomic.Int64
+			client := newWebSocketClient(hub, nil)
+			hub.Register(client)
+			go drain(client, &received)
+
+			rng := rand.New(rand.NewSource(int64(i)))
+			for j := 0; j < 50; j++ {
+				email := fmt.Sprintf("user%d@example.com", rng.Intn(mailboxes))
+				hub.Subscribe(client, email)
+				hub.Subscribe(client, "*@example.com")
+				hub.Unsubscribe(client, email)
+				hub.Subscriptions(client)
+			}
+			hub.Unregister(client)
+		}(i)
+	}
+
+	for i := 0; i < mailboxes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				hub.NotifyEmailDeleted(fmt.Sprintf("user%d@example.com", i), fmt.Sprint(j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range counters {
+		waitFor(t, 5*time.Second, func() bool { return counters[i].Load() == events })
+	}
+
+	metrics := hub.Metrics()
+	if metrics.Clients != clients {
+		t.Errorf("expected %d clients, got %d", clients, metrics.Clients)
+	}
+	if metrics.Subscriptions != clients {
+		t.Errorf("expected %d subscriptions, got %d", clients, metrics.Subscriptions)
+	}
+	if metrics.SlowConsumers != 0 {
+		t.Errorf("expected no slow consumer, got %d", metrics.SlowConsumers)
+	}
+
+	for _, client := range all {
+		hub.Unregister(client)
+	}
+	if metrics := hub.Metrics(); metrics.Clients != 0 || metrics.Subscriptions != 0 {
+		t.Errorf("expected an empty hub, got %+v", metrics)
+	}
+}
+
+func TestHubUnregisterDuringDispatch(t *testing.T) {
+	hub := NewWebSocketHub()
+
+	var received atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		client := newWebSocketClient(hub, nil)
+		hub.Register(client)
+		hub.Subscribe(client, "shared@example.com")
+		go drain(client, &received)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			hub.NotifyEmailDeleted("shared@example.com", "id")
+		}()
+		go func() {
+			defer wg.Done()
+			hub.Unregister(client)
+			hub.Unregister(client)
+		}()
+	}
+	wg.Wait()
+
+	if metrics := hub.Metrics(); metrics.Clients != 0 || metrics.Subscriptions != 0 {
+		t.Errorf("expected an empty hub, got %+v", metrics)
+	}
+}
+
+func TestHubSlowConsumer(t *testing.T) {
+	hub := NewWebSocketHub()
+
+	// Never reads its queue
+	slow := newWebSocketClient(hub, nil)
+	hub.Register(slow)
+	hub.Subscribe(slow, "inbox@example.com")
+	hub.Subscribe(slow, "flood@example.com")
+
+	var received atomic.Int64
+	fast := newWebSocketClient(hub, nil)
+	hub.Register(fast)
+	hub.Subscribe(fast, "inbox@example.com")
+	go drain(fast, &received)
+
+	for i := 0; i < clientQueueSize+1; i++ {
+		hub.NotifyEmailDeleted("flood@example.com", fmt.Sprint(i))
+	}
+	hub.NotifyEmailDeleted("inbox@example.com", "id")
+
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("slow client not disconnected")
+	}
+	if !slow.slow.Load() {
+		t.Error("slow client not flagged as slow")
+	}
+	if err := hub.Subscribe(slow, "inbox@example.com"); err != errClientClosed {
+		t.Errorf("expected %v subscribing a closed client, got %v", errClientClosed, err)
+	}
+
+	waitFor(t, time.Second, func() bool { return received.Load() == 1 })
+
+	metrics := hub.Metrics()
+	if metrics.SlowConsumers != 1 {
+		t.Errorf("expected 1 slow consumer, got %d", metrics.SlowConsumers)
+	}
+	if metrics.Clients != 1 || metrics.Subscriptions != 1 {
+		t.Errorf("expected the fast client only, got %+v", metrics)
+	}
+}
+
+func TestHubPatternDeliveredOnce(t *testing.T) {
+	hub := NewWebSocketHub()
+
+	client := newWebSocketClient(hub, nil)
+	hub.Register(client)
+	hub.Subscribe(client, "inbox@example.com")
+	hub.Subscribe(client, "*@example.com")
+
+	hub.NotifyEmailDeleted("inbox@example.com", "id")
+	hub.NotifyEmailDeleted("other@example.com", "id")
+	hub.NotifyEmailDeleted("inbox@example.org", "id")
+
+	if len(client.send) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(client.send))
+	}
+}
+
+func TestHubSharedRedis(t *testing.T) {
+	storage, mr := newTestStorage(t)
+	other := redis.NewStorage()
+	other.Address, other.Port = storage.Address, storage.Port
+	other.Connect()
+
+	// Two instances share redis, each with its own hub
+	hubs := []*WebSocketHub{NewWebSocketHub(), NewWebSocketHub()}
+	clients := make([]*WebSocketClient, len(hubs))
+	for i, hub := range hubs {
+		hub.pubsub = []*redis.RedisStorage{storage, other}[i]
+		go hub.Run()
+
+		clients[i] = newWebSocketClient(hub, nil)
+		hub.Register(clients[i])
+		hub.Subscribe(clients[i], "inbox@example.com")
+	}
+	waitFor(t, time.Second, func() bool {
+		return mr.PubSubNumSub("events")["events"] == len(hubs)
+	})
+
+	hubs[0].NotifyEmailDeleted("inbox@example.com", "id")
+
+	// Clients of both instances get the event once, not again through redis
+	for i, client := range clients {
+		waitFor(t, time.Second, func() bool { return len(client.send) > 0 })
+		time.Sleep(50 * time.Millisecond)
+		if len(client.send) != 1 {
+			t.Errorf("client of hub %d got %d messages, want 1", i, len(client.send))
+		}
+	}
+	if events := hubs[1].Metrics().Events; events != 1 {
+		t.Errorf("hub 1 dispatched %d events, want 1", events)
+	}
+}
+
+func TestWebSocketReplayFrames(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServerWithWebSocket(storage, []string{"example.com"})
+	server := httptest.NewServer(web.Router())
+	defer server.Close()
+
+	const email = "alice@example.com"
+	const stored = 50
+	for i := range stored {
+		if _, err := storage.StoreMessage(email, &redis.Message{Body: fmt.Sprintf("message %d", i), ReceivedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := dialWebSocket(t, server)
+	err := conn.WriteJSON(map[string]interface{}{
+		"type":    "subscribe",
+		"payload": map[string]interface{}{"email": email, "since": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ack := readWebSocket(t, conn); ack["type"] != "ack" {
+		t.Fatalf("got %v, want ack", ack)
+	}
+
+	// The replay queues the messages faster than they are written, each one
+	// still gets a frame of its own
+	for want := 1; want <= stored; want++ {
+		message := readWebSocket(t, conn)
+		payload, _ := message["payload"].(map[string]interface{})
+		if message["type"] != "new_email" || payload["seq"] != float64(want) {
+			t.Fatalf("got %v, want new_email %d", message, want)
+		}
+	}
+}
+
+func TestReauthorizeSubscriptions(t *testing.T) {
+	storage, _ := newTestStorage(t)
+	web := NewWebServerWithWebSocket(storage, []string{"example.com"})
+	web.EnableReservations = true
+	web.wsHub.pubsub = nil // Events stay in process, the hub isn't running
+	server := httptest.NewServer(web.Router())
+	defer server.Close()
+
+	const email = "alice@example.com"
+	subscribe := func(conn *websocket.Conn, token string) {
+		t.Helper()
+
+		err := conn.WriteJSON(map[string]interface{}{
+			"type":    "subscribe",
+			"payload": map[string]interface{}{"email": email, "token": token},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack := readWebSocket(t, conn); ack["type"] != "ack" {
+			t.Fatalf("got %v, want ack", ack)
+		}
+	}
+	expectRevoked := func(conn *websocket.Conn) {
+		t.Helper()
+
+		message := readWebSocket(t, conn)
+		payload, _ := message["payload"].(map[string]interface{})
+		if message["type"] != "subscription_revoked" || payload["email"] != email {
+			t.Fatalf("got %v, want subscription_revoked", message)
+		}
+	}
+
+	// Subscriptions made while the mailbox was open end with the reservation
+	open := dialWebSocket(t, server)
+	subscribe(open, "")
+
+	streamCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(streamCtx, http.MethodGet, server.URL+"/api/inbox/"+email+"/events", nil)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	owner := reserve(t, web.WebServer, email)
+	expectRevoked(open)
+	if _, err := io.ReadAll(stream.Body); err != nil {
+		t.Errorf("event stream not closed: %v", err)
+	}
+
+	// The owner keeps them until the reservation is transferred
+	ownerConn := dialWebSocket(t, server)
+	subscribe(ownerConn, owner.OwnerToken)
+
+	transfer := httptest.NewRequest(http.MethodPatch, "/api/inbox/"+email+"/reservation", strings.NewReader(`{"transfer":true}`))
+	transfer.Header.Set("Authorization", "Bearer "+owner.OwnerToken)
+	rec := httptest.NewRecorder()
+	web.Router().ServeHTTP(rec, transfer)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("transfer: got status %d: %s", rec.Code, rec.Body)
+	}
+	var transferred ReservationResponse
+	json.NewDecoder(rec.Body).Decode(&transferred)
+
+	expectRevoked(ownerConn)
+
+	// The new owner gets the events, the previous one no longer does
+	newOwner := dialWebSocket(t, server)
+	subscribe(newOwner, transferred.OwnerToken)
+	web.wsHub.NotifyEmailDeleted(email, "id")
+	if message := readWebSocket(t, newOwner); message["type"] != "email_deleted" {
+		t.Errorf("new owner got %v, want email_deleted", message)
+	}
+
+	ownerConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := ownerConn.ReadMessage(); err == nil {
+		t.Errorf("previous owner got %s", data)
+	}
+}